@@ -7,17 +7,16 @@
 package main
 
 import (
-	"bufio"
-	"bytes"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"os"
 	"runtime/pprof"
-	"sort"
 	"strings"
 
 	"github.com/google/skylark"
+	"github.com/google/skylark/repl"
 	"github.com/google/skylark/resolve"
 	"github.com/google/skylark/syntax"
 )
@@ -26,6 +25,7 @@ import (
 var (
 	cpuprofile = flag.String("cpuprofile", "", "gather CPU profile in this file")
 	showenv    = flag.Bool("showenv", false, "on success, print final global environment")
+	dictunion  = flag.Bool("dictunion", false, "allow dict | dict")
 )
 
 // non-standard dialect flags
@@ -35,6 +35,8 @@ func init() {
 	flag.BoolVar(&resolve.AllowSet, "set", resolve.AllowSet, "allow set data type")
 	flag.BoolVar(&resolve.AllowLambda, "lambda", resolve.AllowLambda, "allow lambda expressions")
 	flag.BoolVar(&resolve.AllowNestedDef, "nesteddef", resolve.AllowNestedDef, "allow nested def statements")
+	flag.BoolVar(&resolve.AllowOptionalDot, "optdot", resolve.AllowOptionalDot, "allow optional attribute access x?.f")
+	flag.BoolVar(&resolve.AllowRecursion, "recursion", resolve.AllowRecursion, "allow functions to call themselves")
 }
 
 func main() {
@@ -55,7 +57,7 @@ func main() {
 
 	switch len(flag.Args()) {
 	case 0:
-		repl()
+		repl.REPL(&skylark.Thread{AllowDictUnion: *dictunion}, nil)
 	case 1:
 		execfile(flag.Args()[0])
 	default:
@@ -64,81 +66,36 @@ func main() {
 }
 
 func execfile(filename string) {
-	thread := new(skylark.Thread)
+	src, err := ioutil.ReadFile(filename)
+	if err != nil {
+		log.Fatal(err)
+	}
+	thread := &skylark.Thread{AllowDictUnion: *dictunion}
 	globals := make(skylark.StringDict)
-	if err := skylark.ExecFile(thread, filename, nil, globals); err != nil {
-		printError(err)
+	if err := skylark.ExecFile(thread, filename, src, globals); err != nil {
+		printError(err, src)
 		os.Exit(1)
 	}
 
 	// Print the global environment.
 	if *showenv {
-		var names []string
-		for name := range globals {
-			if !strings.HasPrefix(name, "_") {
-				names = append(names, name)
+		for _, name := range globals.Keys() {
+			if strings.HasPrefix(name, "_") {
+				continue
 			}
-		}
-		sort.Strings(names)
-		for _, name := range names {
 			fmt.Fprintf(os.Stderr, "%s = %s\n", name, globals[name])
 		}
 	}
 }
 
-func repl() {
-	thread := new(skylark.Thread)
-	globals := make(skylark.StringDict)
-
-	sc := bufio.NewScanner(os.Stdin)
-outer:
-	for {
-		fmt.Fprintf(os.Stderr, ">>> ")
-		if !sc.Scan() {
-			break
-		}
-		line := sc.Text()
-		if l := strings.TrimSpace(line); l == "" || l[0] == '#' {
-			continue // blank or comment
-		}
-
-		// If the line contains a well-formed
-		// expression, evaluate it.
-		if _, err := syntax.ParseExpr("<stdin>", line); err == nil {
-			if v, err := skylark.Eval(thread, "<stdin>", line, globals); err != nil {
-				printError(err)
-			} else if v != skylark.None {
-				fmt.Println(v)
-			}
-			continue
-		}
-
-		// Otherwise assume it is the first of several
-		// comprising a file, followed by a blank line.
-		var buf bytes.Buffer
-		fmt.Fprintln(&buf, line)
-		for {
-			fmt.Fprintf(os.Stderr, "... ")
-			if !sc.Scan() {
-				break outer
-			}
-			line := sc.Text()
-			if l := strings.TrimSpace(line); l == "" {
-				break // blank
-			}
-			fmt.Fprintln(&buf, line)
-		}
-		if err := skylark.ExecFile(thread, "<stdin>", &buf, globals); err != nil {
-			printError(err)
-		}
-	}
-	fmt.Println()
-}
-
-func printError(err error) {
-	if evalErr, ok := err.(*skylark.EvalError); ok {
-		fmt.Fprintln(os.Stderr, evalErr.Backtrace())
-	} else {
+// printError prints err, which arose while executing src.
+func printError(err error, src []byte) {
+	switch err := err.(type) {
+	case *skylark.EvalError:
+		fmt.Fprintln(os.Stderr, err.Backtrace())
+	case syntax.Error:
+		fmt.Fprintln(os.Stderr, err.CaretString(src))
+	default:
 		fmt.Fprintln(os.Stderr, err)
 	}
 }
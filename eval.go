@@ -11,8 +11,10 @@ import (
 	"math"
 	"sort"
 	"strings"
+	"time"
 	"unicode"
 	"unicode/utf8"
+	"unsafe"
 
 	"github.com/google/skylark/resolve"
 	"github.com/google/skylark/syntax"
@@ -28,10 +30,48 @@ type Thread struct {
 	frame *Frame
 
 	// Print is the client-supplied implementation of the Skylark
-	// 'print' function. If nil, fmt.Fprintln(os.Stderr, msg) is
-	// used instead.
+	// 'print' function. The message is the complete output of the
+	// call, including the end string (by default, a newline).
+	// If nil, the message is written to os.Stderr.
 	Print func(thread *Thread, msg string)
 
+	// SortedSets causes sets created by this thread, and sets derived
+	// from them, to yield their elements in sorted order, as defined
+	// by Compare, when iterated or printed. By default, set elements
+	// are yielded in insertion order.
+	SortedSets bool
+
+	// SortedDictRepr causes dicts created by this thread, and dicts
+	// derived from them, to list their entries in ascending order of
+	// key, as defined by Compare, when printed, instead of insertion
+	// order, for example to make test output deterministic.
+	// Keys that cannot be compared with each other are ordered by
+	// their type names, then by their string representations.
+	// It affects only the repr and str of a dict, not its iteration order.
+	SortedDictRepr bool
+
+	// AllowDictUnion permits programs executed by this thread to
+	// evaluate dict | dict, which yields a new dict containing the
+	// entries of both operands, those of the right operand taking
+	// precedence. By default, it is an error, as in Python 2.
+	// The Binary function always permits it.
+	AllowDictUnion bool
+
+	// Universe, if non-nil, is the set of universal built-ins
+	// available to programs executed by this thread, in place of the
+	// package-level Universe. A client may use it to restrict or
+	// extend the built-ins available to untrusted programs, for
+	// example by copying Universe and deleting "print".
+	// References to names not in the set are resolve-time errors.
+	Universe StringDict
+
+	// MaxCallArgs, if positive, limits the total number of positional
+	// and keyword arguments that a call may pass when expanding *args
+	// and **kwargs arguments. The limit is checked before the
+	// arguments are materialized, so that a program cannot exhaust
+	// memory by expanding a huge sequence into an argument list.
+	MaxCallArgs int
+
 	// Load is the client-supplied implementation of module loading.
 	// Repeated calls with the same module name must return the same
 	// module environment or error.
@@ -39,10 +79,174 @@ type Thread struct {
 
 	// locals holds arbitrary "thread-local" values belonging to the client.
 	locals map[string]interface{}
+
+	// deadline, if non-zero, is the time after which execution fails.
+	// It is set by SetDeadline and temporarily reduced by 'timeout'.
+	deadline time.Time
+
+	// expired is the deadline that caused the most recent failure.
+	expired time.Time
+
+	// calls is the log of built-in function calls made by this thread
+	// if recording, or yet to be replayed if replaying.
+	calls     []CallRecord
+	recording bool
+	replaying bool
+	callDepth int // number of active recorded built-in calls
+
+	// memos holds the result caches of functions created by memoize.
+	memos map[*Builtin]*Dict
+
+	// maxAllocs, if non-zero, is the number of bytes that allocs may
+	// not exceed. allocs counts the bytes allocated for new strings,
+	// lists, and tuples by operations that can create large ones.
+	maxAllocs, allocs int64
+}
+
+// A CallRecord records a call to a built-in function
+// and its outcome: either a result or an error.
+type CallRecord struct {
+	Name   string
+	Args   Tuple
+	Kwargs []Tuple
+	Result Value // nil if the call failed
+	Err    error
+}
+
+// RecordCalls causes the thread to record each call to a built-in
+// function (but not a method) made directly by Skylark code.
+// Calls made by a built-in during another call are not recorded.
+// The recorded calls are retrieved by RecordedCalls.
+func (thread *Thread) RecordCalls() {
+	thread.calls, thread.recording, thread.replaying = nil, true, false
+}
+
+// RecordedCalls returns the calls recorded since the most recent
+// call to RecordCalls.
+func (thread *Thread) RecordedCalls() []CallRecord {
+	if !thread.recording {
+		return nil
+	}
+	return thread.calls
+}
+
+// ReplayCalls causes each call to a built-in function that would be
+// recorded by RecordCalls to instead return the outcome of the next
+// call in calls, without invoking the function.
+// The call fails if the log is exhausted or the next recorded call
+// is to a function of a different name.
+//
+// Replay is intended for functions whose side effects are external
+// to the program, such as reading the clock. Functions that modify
+// their arguments or call back into Skylark code are not re-executed,
+// and recorded results are returned as is, without copying, so a log
+// should be replayed at most once.
+func (thread *Thread) ReplayCalls(calls []CallRecord) {
+	thread.calls, thread.recording, thread.replaying = calls, false, true
+}
+
+// callBuiltin calls b, recording or replaying the call if required.
+func (thread *Thread) callBuiltin(b *Builtin, args Tuple, kwargs []Tuple) (Value, error) {
+	if b.recv != nil || thread.callDepth > 0 || !(thread.recording || thread.replaying) {
+		return b.fn(thread, b, args, kwargs)
+	}
+
+	if thread.replaying {
+		if len(thread.calls) == 0 {
+			return nil, fmt.Errorf("replay: unexpected call to %s", b.Name())
+		}
+		call := thread.calls[0]
+		if call.Name != b.Name() {
+			return nil, fmt.Errorf("replay: call to %s, but recorded call was to %s", b.Name(), call.Name)
+		}
+		thread.calls = thread.calls[1:]
+		return call.Result, call.Err
+	}
+
+	res, err := b.callRecorded(thread, args, kwargs)
+	thread.calls = append(thread.calls, CallRecord{
+		Name:   b.Name(),
+		Args:   append(Tuple(nil), args...),
+		Kwargs: append([]Tuple(nil), kwargs...),
+		Result: res,
+		Err:    err,
+	})
+	return res, err
+}
+
+// callRecorded calls the builtin on behalf of a recording thread.
+// While it runs, thread.callDepth is positive, so that builtins it
+// calls in turn are not recorded.  The count is restored even if
+// the builtin panics.
+func (b *Builtin) callRecorded(thread *Thread, args Tuple, kwargs []Tuple) (Value, error) {
+	thread.callDepth++
+	defer func() { thread.callDepth-- }()
+	return b.fn(thread, b, args, kwargs)
+}
+
+// universe returns the set of universal built-ins for this thread.
+func (thread *Thread) universe() StringDict {
+	if thread.Universe != nil {
+		return thread.Universe
+	}
+	return Universe
+}
+
+// SetDeadline sets the time after which execution of Skylark code in
+// this thread fails with a "deadline exceeded" error.  The check is
+// made at each iteration of a loop or comprehension, so calls to
+// long-running built-ins are not interrupted.
+// A zero value for t means no deadline.
+func (thread *Thread) SetDeadline(t time.Time) { thread.deadline = t }
+
+// SetMaxAllocs limits the approximate number of bytes that the thread
+// may allocate for new strings, lists, tuples, dicts, and integers in
+// operations whose result size is controlled by the program:
+// repetition ("x" * n), concatenation, x ** y, dict | dict,
+// %-formatting, comprehensions, str.join, str.replace, list.extend,
+// and the list and tuple built-ins. An operation that would exceed
+// the limit fails instead of exhausting the memory of the application.
+// (A %-formatted string is charged once it is complete, and list.extend,
+// list, and tuple are charged only for iterables of known length.)
+// Other allocations, including those of application-defined built-ins
+// that do not call CheckAllocs, are not counted.
+// The count accumulates over the life of the thread.
+// A zero value for max means no limit.
+func (thread *Thread) SetMaxAllocs(max int64) { thread.maxAllocs = max }
+
+// CheckAllocs records that the thread is about to allocate n bytes,
+// and returns an error if that would exceed the limit set by
+// SetMaxAllocs. Built-in functions that create large values
+// may call it to respect the limit. An allocation that is rejected
+// is not recorded.
+func (thread *Thread) CheckAllocs(n int64) error {
+	if thread == nil || thread.maxAllocs == 0 {
+		return nil
+	}
+	// Compare without adding, as allocs+n may overflow.
+	if n > thread.maxAllocs-thread.allocs {
+		return fmt.Errorf("exceeded memory allowance")
+	}
+	thread.allocs += n
+	return nil
+}
+
+// checkDeadline returns an error if the thread's deadline has passed.
+func (fr *Frame) checkDeadline(posn syntax.Position) error {
+	if t := fr.thread.deadline; !t.IsZero() && time.Now().After(t) {
+		fr.thread.expired = t
+		return fr.errorf(posn, "deadline exceeded")
+	}
+	return nil
 }
 
 // SetLocal sets the thread-local value associated with the specified key.
 // It must not be called after execution begins.
+//
+// Thread-local values allow an application to pass state, such as a
+// logger or a database handle, to its built-ins through their Thread
+// argument, without global variables that would be shared by
+// concurrent executions. They are not visible to Skylark code.
 func (thread *Thread) SetLocal(key string, value interface{}) {
 	if thread.locals == nil {
 		thread.locals = make(map[string]interface{})
@@ -61,23 +265,36 @@ func (thread *Thread) Caller() *Frame {
 	return thread.frame
 }
 
+// CallStack returns a snapshot of the stack of active Skylark calls,
+// innermost first. The position of each frame is that of its current
+// point of execution, typically a call. When called from a built-in,
+// as by a debugger or sampling profiler, the position of the innermost
+// frame is that of the call to the built-in.
+func (thread *Thread) CallStack() []CallFrame {
+	return thread.frame.callStack()
+}
+
+// CallStackDepth returns the number of active Skylark calls,
+// including the module toplevel.
+func (thread *Thread) CallStackDepth() int {
+	depth := 0
+	for fr := thread.frame; fr != nil; fr = fr.parent {
+		depth++
+	}
+	return depth
+}
+
 // A StringDict is a mapping from names to values, and represents
 // an environment such as the global variables of a module.
 // It is not a true skylark.Value.
 type StringDict map[string]Value
 
 func (d StringDict) String() string {
-	names := make([]string, 0, len(d))
-	for name := range d {
-		names = append(names, name)
-	}
-	sort.Strings(names)
-
 	var buf bytes.Buffer
 	path := make([]Value, 0, 4)
 	buf.WriteByte('{')
 	sep := ""
-	for _, name := range names {
+	for _, name := range d.Keys() {
 		buf.WriteString(sep)
 		buf.WriteString(name)
 		buf.WriteString(": ")
@@ -94,7 +311,37 @@ func (d StringDict) Freeze() {
 	}
 }
 
-func (d StringDict) has(name string) bool { _, ok := d[name]; return ok }
+// Keys returns a new sorted slice of d's keys.
+func (d StringDict) Keys() []string {
+	names := make([]string, 0, len(d))
+	for name := range d {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Has reports whether d contains the specified name.
+// Its signature suits the predicates accepted by resolve.File.
+func (d StringDict) Has(name string) bool { _, ok := d[name]; return ok }
+
+// Clone returns a new StringDict with the same bindings as d.
+// The values themselves are shared, not copied.
+func (d StringDict) Clone() StringDict {
+	clone := make(StringDict, len(d))
+	for name, v := range d {
+		clone[name] = v
+	}
+	return clone
+}
+
+// Merge adds the bindings of other to d, replacing any existing
+// binding of the same name.
+func (d StringDict) Merge(other StringDict) {
+	for name, v := range other {
+		d[name] = v
+	}
+}
 
 // A Frame holds the execution state of a single Skylark function call
 // or module toplevel.
@@ -106,12 +353,17 @@ type Frame struct {
 	globals StringDict      // current global environment
 	locals  []Value         // local variables, starting with parameters
 	result  Value           // operand of current function's return statement
+	depth   int             // number of enclosing frames
 }
 
+// maxCallDepth limits the depth of the call stack, which is reached
+// only by recursion (see resolve.AllowRecursion).
+const maxCallDepth = 10000
+
 func (fr *Frame) errorf(posn syntax.Position, format string, args ...interface{}) *EvalError {
 	fr.posn = posn
 	msg := fmt.Sprintf(format, args...)
-	return &EvalError{Msg: msg, Frame: fr}
+	return &EvalError{Msg: msg, Frame: fr, callStack: fr.callStack()}
 }
 
 // Position returns the source position of the current point of execution in this frame.
@@ -128,6 +380,8 @@ func (fr *Frame) set(id *syntax.Ident, v Value) {
 	switch resolve.Scope(id.Scope) {
 	case resolve.Local:
 		fr.locals[id.Index] = v
+	case resolve.Cell:
+		fr.locals[id.Index].(*cell).v = v
 	case resolve.Global:
 		fr.globals[id.Name] = v
 	default:
@@ -142,8 +396,14 @@ func (fr *Frame) lookup(id *syntax.Ident) (Value, error) {
 		if v := fr.locals[id.Index]; v != nil {
 			return v, nil
 		}
+	case resolve.Cell:
+		if v := fr.locals[id.Index].(*cell).v; v != nil {
+			return v, nil
+		}
 	case resolve.Free:
-		return fr.fn.freevars[id.Index], nil
+		if v := fr.fn.freevars[id.Index].(*cell).v; v != nil {
+			return v, nil
+		}
 	case resolve.Global:
 		if v := fr.globals[id.Name]; v != nil {
 			return v, nil
@@ -152,24 +412,80 @@ func (fr *Frame) lookup(id *syntax.Ident) (Value, error) {
 			// Gross spec, gross hack.
 			// Users should just call package_name() function.
 			if v, ok := fr.globals["package_name"].(*Builtin); ok {
-				return v.fn(fr.thread, v, nil, nil)
+				return v.Call(fr.thread, nil, nil)
 			}
 		}
 	case resolve.Builtin:
-		return Universe[id.Name], nil
+		if v := fr.thread.universe()[id.Name]; v != nil {
+			return v, nil
+		}
+		// The thread's Universe differs from the one used
+		// to resolve a Program.
+		return nil, fr.errorf(id.NamePos, "undefined: %s", id.Name)
+	}
+	scope := resolve.Scope(id.Scope)
+	if scope == resolve.Cell {
+		scope = resolve.Local
+	}
+	return nil, fr.errorf(id.NamePos, "%s variable %s referenced before assignment", scope, id.Name)
+}
+
+// makeCells replaces each element of locals that is a cell variable,
+// according to idents, by a new cell containing its current value.
+func makeCells(locals []Value, idents []*syntax.Ident) {
+	for i, id := range idents {
+		if resolve.Scope(id.Scope) == resolve.Cell {
+			locals[i] = &cell{locals[i]}
+		}
+	}
+}
+
+// A cell holds the value of a local variable captured by a nested
+// function, so that the enclosing function and the closure share
+// the variable, and each sees the other's assignments to it.
+// The value is nil until the variable is first assigned.
+type cell struct{ v Value }
+
+var _ Value = (*cell)(nil)
+
+func (c *cell) String() string        { return "cell" }
+func (c *cell) Type() string          { return "cell" }
+func (c *cell) Truth() Bool           { return True }
+func (c *cell) Hash() (uint32, error) { return 0, fmt.Errorf("unhashable type: cell") }
+func (c *cell) Freeze() {
+	if c.v != nil {
+		c.v.Freeze()
 	}
-	return nil, fr.errorf(id.NamePos, "%s variable %s referenced before assignment",
-		resolve.Scope(id.Scope), id.Name)
 }
 
 // An EvalError is a Skylark evaluation error and its associated call stack.
 type EvalError struct {
 	Msg   string
 	Frame *Frame
+
+	callStack []CallFrame // snapshot of the stack when the error occurred
 }
 
 func (e *EvalError) Error() string { return e.Msg }
 
+// CaretString returns the error message, prefixed by the position at
+// which the error occurred, followed by the offending line of src and a
+// caret marking the position of the error. src must be the source of the
+// file containing that position, which is not necessarily the file
+// being executed if the error occurred within a loaded module.
+func (e *EvalError) CaretString(src []byte) string {
+	for _, fr := range e.callStack {
+		if fr.Pos.IsValid() {
+			msg := fr.Pos.String() + ": " + e.Msg
+			if excerpt := fr.Pos.Excerpt(src); excerpt != "" {
+				msg += "\n" + excerpt
+			}
+			return msg
+		}
+	}
+	return e.Msg
+}
+
 // Backtrace returns a user-friendly error message describing the stack
 // of calls that led to this error.
 func (e *EvalError) Backtrace() string {
@@ -187,20 +503,24 @@ func (fr *Frame) WriteBacktrace(out *bytes.Buffer) {
 		if fr != nil {
 			print(fr.parent)
 
-			name := "<toplevel>"
-			if fr.fn != nil {
-				name = fr.fn.Name()
-			}
 			fmt.Fprintf(out, "  %s:%d:%d: in %s\n",
 				fr.posn.Filename(),
 				fr.posn.Line,
 				fr.posn.Col,
-				name)
+				fr.name())
 		}
 	}
 	print(fr)
 }
 
+// name returns the name of the frame's function, or "<toplevel>".
+func (fr *Frame) name() string {
+	if fr.fn != nil {
+		return fr.fn.Name()
+	}
+	return "<toplevel>"
+}
+
 // Stack returns the stack of frames, innermost first.
 func (e *EvalError) Stack() []*Frame {
 	var stack []*Frame
@@ -210,6 +530,26 @@ func (e *EvalError) Stack() []*Frame {
 	return stack
 }
 
+// A CallFrame records the name of an active Skylark function
+// and the source position of the current point of execution within it.
+type CallFrame struct {
+	Name string          // function name, or "<toplevel>"
+	Pos  syntax.Position // position of the call or error
+}
+
+// CallStack returns a snapshot of the stack of active Skylark calls at
+// the point of the error, innermost first. Unlike the frames returned by
+// Stack, the snapshot is unaffected by subsequent execution.
+func (e *EvalError) CallStack() []CallFrame { return e.callStack }
+
+func (fr *Frame) callStack() []CallFrame {
+	var stack []CallFrame
+	for ; fr != nil; fr = fr.parent {
+		stack = append(stack, CallFrame{Name: fr.name(), Pos: fr.posn})
+	}
+	return stack
+}
+
 // ExecFile parses, resolves, and executes a Skylark file in the
 // specified global environment, which may be modified during execution.
 //
@@ -236,6 +576,10 @@ type ExecOptions struct {
 	// instead of Filename.  See syntax.Parse for details.
 	Source interface{}
 
+	// ParseOptions specifies options that affect parsing,
+	// such as whether chained comparisons are permitted.
+	ParseOptions syntax.ParseOptions
+
 	// Globals is the environment of the module.
 	// It may be modified during execution.
 	Globals StringDict
@@ -249,42 +593,126 @@ type ExecOptions struct {
 // Exec is a variant of ExecFile that gives the client greater control
 // over optional features.
 func Exec(opts ExecOptions) error {
+	return execOpts(opts, true)
+}
+
+// ExecREPLChunk is a variant of ExecFile for use by a read/eval/print
+// loop, which executes a sequence of chunks of source in the same
+// global environment.  Unlike ExecFile, it does not freeze the
+// environment, so values created by one chunk may be modified by
+// later ones.
+func ExecREPLChunk(thread *Thread, filename string, src interface{}, globals StringDict) error {
+	return execOpts(ExecOptions{Thread: thread, Filename: filename, Source: src, Globals: globals}, false)
+}
+
+// execOpts implements Exec. If freeze is set, it freezes the global
+// environment after execution.
+func execOpts(opts ExecOptions, freeze bool) error {
 	if debug {
 		fmt.Printf("ExecFile %s\n", opts.Filename)
 		defer fmt.Printf("ExecFile %s done\n", opts.Filename)
 	}
-	f, err := syntax.Parse(opts.Filename, opts.Source)
+	f, err := opts.ParseOptions.Parse(opts.Filename, opts.Source)
 	if err != nil {
 		return err
 	}
 
 	globals := opts.Globals
-	if err := resolve.File(f, globals.has, Universe.has); err != nil {
+	thread := opts.Thread
+	if _, err := resolve.File(f, globals.Has, thread.universe().Has); err != nil {
 		return err
 	}
 
-	thread := opts.Thread
-
 	if opts.BeforeExec != nil {
 		if err := opts.BeforeExec(thread, f); err != nil {
 			return err
 		}
 	}
 
+	if !freeze {
+		return execResolvedStmts(thread, f, globals)
+	}
+	return execResolvedFile(thread, f, globals)
+}
+
+// execResolvedFile executes the resolved file f in the specified
+// global environment, then freezes the environment.
+func execResolvedFile(thread *Thread, f *syntax.File, globals StringDict) error {
+	err := execResolvedStmts(thread, f, globals)
+
+	// Freeze the global environment.
+	globals.Freeze()
+
+	return err
+}
+
+// execResolvedStmts executes the statements of the resolved file f
+// in the specified global environment.
+func execResolvedStmts(thread *Thread, f *syntax.File, globals StringDict) error {
 	fr := &Frame{
 		thread:  thread,
 		parent:  thread.frame,
 		globals: globals,
 		locals:  make([]Value, len(f.Locals)),
 	}
+	makeCells(fr.locals, f.Locals)
 	thread.frame = fr
-	err = execStmts(fr, f.Stmts)
+	err := execStmts(fr, f.Stmts)
 	thread.frame = fr.parent
+	return err
+}
 
-	// Freeze the global environment.
-	globals.Freeze()
+// A Program is a Skylark file that has been parsed and resolved.
+// It may be executed many times, by different threads and in
+// different environments, without repeating that work.
+type Program struct {
+	file *syntax.File
+}
 
-	return err
+// CompileFile parses and resolves a Skylark file, and returns a
+// Program that may be executed by its Init method.
+//
+// The filename and src parameters are as for syntax.Parse.
+// The isPredeclared predicate reports whether a name will be
+// defined by the environment of each execution; all other free
+// names must be defined by the file itself or be universal.
+// The isUniversal predicate reports whether a name is a universal
+// built-in; a program to be executed by threads with a custom
+// Universe should pass that set's Has method. If isUniversal is nil,
+// the package-level Universe is used.
+func CompileFile(filename string, src interface{}, isPredeclared, isUniversal func(name string) bool) (*Program, error) {
+	f, err := syntax.Parse(filename, src)
+	if err != nil {
+		return nil, err
+	}
+	if isUniversal == nil {
+		isUniversal = Universe.Has
+	}
+	if _, err := resolve.File(f, isPredeclared, isUniversal); err != nil {
+		return nil, err
+	}
+	return &Program{f}, nil
+}
+
+// Filename returns the name of the program's file.
+func (prog *Program) Filename() string { return prog.file.Path }
+
+// Init executes the program in a new global environment that initially
+// contains the bindings of predeclared, which is not modified.
+// It returns the environment, frozen, even if execution fails.
+//
+// The predeclared environment should bind every name for which the
+// isPredeclared predicate passed to CompileFile reported true,
+// and the thread's Universe, if set, should bind every name for which
+// the isUniversal predicate reported true; otherwise, a reference to a missing name
+// fails when executed.
+//
+// If Init fails during evaluation, it returns an *EvalError
+// containing a backtrace.
+func (prog *Program) Init(thread *Thread, predeclared StringDict) (StringDict, error) {
+	globals := predeclared.Clone()
+	err := execResolvedFile(thread, prog.file, globals)
+	return globals, err
 }
 
 // Eval parses, resolves, and evaluates an expression within the
@@ -303,7 +731,7 @@ func Eval(thread *Thread, filename string, src interface{}, globals StringDict)
 		return nil, err
 	}
 
-	locals, err := resolve.Expr(expr, globals.has, Universe.has)
+	locals, err := resolve.Expr(expr, globals.Has, thread.universe().Has)
 	if err != nil {
 		return nil, err
 	}
@@ -314,6 +742,7 @@ func Eval(thread *Thread, filename string, src interface{}, globals StringDict)
 		globals: globals,
 		locals:  make([]Value, len(locals)),
 	}
+	makeCells(fr.locals, locals)
 	thread.frame = fr
 	v, err := eval(fr, expr)
 	thread.frame = fr.parent
@@ -352,14 +781,35 @@ func exec(fr *Frame, stmt syntax.Stmt) error {
 			return errContinue
 		}
 
-	case *syntax.IfStmt:
-		cond, err := eval(fr, stmt.Cond)
+	case *syntax.DelStmt:
+		x, err := eval(fr, stmt.Target.X)
 		if err != nil {
 			return err
 		}
-		if cond.Truth() {
-			return execStmts(fr, stmt.True)
-		} else {
+		y, err := eval(fr, stmt.Target.Y)
+		if err != nil {
+			return err
+		}
+		return delIndex(fr, stmt.Target.Lbrack, x, y)
+
+	case *syntax.IfStmt:
+		// The parser represents each elif as an if statement that is
+		// the sole statement of the previous False branch.
+		// Iterate over the chain rather than recursing.
+		for {
+			cond, err := eval(fr, stmt.Cond)
+			if err != nil {
+				return err
+			}
+			if cond.Truth() {
+				return execStmts(fr, stmt.True)
+			}
+			if len(stmt.False) == 1 {
+				if elif, ok := stmt.False[0].(*syntax.IfStmt); ok {
+					stmt = elif
+					continue
+				}
+			}
 			return execStmts(fr, stmt.False)
 		}
 
@@ -446,14 +896,26 @@ func exec(fr *Frame, stmt syntax.Stmt) error {
 				if err := xlist.checkMutable("apply += to", true); err != nil {
 					return fr.errorf(stmt.OpPos, "%v", err)
 				}
+				if n := Len(y); n > 0 {
+					if err := fr.thread.CheckAllocs(int64(n) * valueSize); err != nil {
+						return fr.errorf(stmt.OpPos, "%v", err)
+					}
+				}
 				listExtend(xlist, yiter)
 				return nil
 			}
 
-			new, err := Binary(stmt.Op-syntax.PLUS_EQ+syntax.PLUS, old, y)
+			op := stmt.Op - syntax.PLUS_EQ + syntax.PLUS
+			if err := fr.thread.CheckAllocs(binaryAllocs(op, old, y)); err != nil {
+				return fr.errorf(stmt.OpPos, "%v", err)
+			}
+			new, err := Binary(op, old, y)
 			if err != nil {
 				return fr.errorf(stmt.OpPos, "%v", err)
 			}
+			if err := fr.thread.CheckAllocs(formatAllocs(op, new)); err != nil {
+				return fr.errorf(stmt.OpPos, "%v", err)
+			}
 			return set(fr, new)
 
 		default:
@@ -480,6 +942,9 @@ func exec(fr *Frame, stmt syntax.Stmt) error {
 		defer iter.Done()
 		var elem Value
 		for iter.Next(&elem) {
+			if err := fr.checkDeadline(stmt.For); err != nil {
+				return err
+			}
 			if err := assign(fr, stmt.For, stmt.Vars, elem); err != nil {
 				return err
 			}
@@ -558,7 +1023,43 @@ func getAttr(fr *Frame, x Value, dot *syntax.DotExpr) (Value, error) {
 		}
 	}
 
-	return nil, fr.errorf(dot.Dot, "%s has no .%s field or method", x.Type(), name)
+	return nil, wrapError(fr, dot.Dot, noSuchAttrError(x, name))
+}
+
+// noSuchAttrError returns the error for a missing field or method of x.
+// If x has any attributes, the message lists them.
+func noSuchAttrError(x Value, name string) error {
+	msg := fmt.Sprintf("%s has no .%s field or method", x.Type(), name)
+	if x, ok := x.(HasAttrs); ok {
+		if names := x.AttrNames(); len(names) > 0 {
+			names = append([]string(nil), names...)
+			sort.Strings(names)
+			msg += " (available: " + strings.Join(names, ", ") + ")"
+		}
+	}
+	return fmt.Errorf("%s", msg)
+}
+
+// getOptAttr implements x?.dot, which yields None
+// if x is None or has no such field or method.
+func getOptAttr(fr *Frame, x Value, dot *syntax.OptDotExpr) (Value, error) {
+	name := dot.Name.Name
+	if x, ok := x.(HasAttrs); ok {
+		v, err := x.Attr(name)
+		if err == nil && v != nil {
+			return v, nil
+		}
+		// Some types report a missing attribute as an error;
+		// report only errors for attributes that are present.
+		if err != nil {
+			for _, attr := range x.AttrNames() {
+				if attr == name {
+					return nil, wrapError(fr, dot.Question, err)
+				}
+			}
+		}
+	}
+	return None, nil
 }
 
 // setField implements x.name = y.
@@ -585,16 +1086,17 @@ func getIndex(fr *Frame, lbrack syntax.Position, x, y Value) (Value, error) {
 
 	case Indexable: // string, list, tuple
 		n := x.Len()
-		i, err := AsInt32(y)
+		orig, err := AsInt32(y)
 		if err != nil {
 			return nil, fr.errorf(lbrack, "%s index: %s", x.Type(), err)
 		}
+		i := orig
 		if i < 0 {
 			i += n
 		}
 		if i < 0 || i >= n {
 			return nil, fr.errorf(lbrack, "%s index %d out of range [0:%d]",
-				x.Type(), i, n)
+				x.Type(), orig, n)
 		}
 		return x.Index(i), nil
 	}
@@ -610,15 +1112,16 @@ func setIndex(fr *Frame, lbrack syntax.Position, x, y, z Value) error {
 		}
 
 	case HasSetIndex:
-		i, err := AsInt32(y)
+		orig, err := AsInt32(y)
 		if err != nil {
 			return wrapError(fr, lbrack, err)
 		}
+		i := orig
 		if i < 0 {
 			i += x.Len()
 		}
 		if i < 0 || i >= x.Len() {
-			return fr.errorf(lbrack, "%s index %d out of range [0:%d]", x.Type(), i, x.Len())
+			return fr.errorf(lbrack, "%s index %d out of range [0:%d]", x.Type(), orig, x.Len())
 		}
 		return wrapError(fr, lbrack, x.SetIndex(i, z))
 
@@ -628,6 +1131,41 @@ func setIndex(fr *Frame, lbrack syntax.Position, x, y, z Value) error {
 	return nil
 }
 
+// delIndex implements del x[y].
+func delIndex(fr *Frame, lbrack syntax.Position, x, y Value) error {
+	switch x := x.(type) {
+	case *Dict:
+		_, found, err := x.Delete(y)
+		if err != nil {
+			return fr.errorf(lbrack, "%v", err) // dict is frozen or key is unhashable
+		}
+		if !found {
+			return fr.errorf(lbrack, "key %v not in dict", y)
+		}
+
+	case *List:
+		orig, err := AsInt32(y)
+		if err != nil {
+			return wrapError(fr, lbrack, err)
+		}
+		i := orig
+		if i < 0 {
+			i += x.Len()
+		}
+		if i < 0 || i >= x.Len() {
+			return fr.errorf(lbrack, "list index %d out of range [0:%d]", orig, x.Len())
+		}
+		if err := x.checkMutable("delete from", true); err != nil {
+			return fr.errorf(lbrack, "%v", err)
+		}
+		x.elems = append(x.elems[:i], x.elems[i+1:]...)
+
+	default:
+		return fr.errorf(lbrack, "%s value does not support item deletion", x.Type())
+	}
+	return nil
+}
+
 // assign implements lhs = rhs for arbitrary expressions lhs.
 func assign(fr *Frame, pos syntax.Position, lhs syntax.Expr, rhs Value) error {
 	switch lhs := lhs.(type) {
@@ -655,6 +1193,16 @@ func assign(fr *Frame, pos syntax.Position, lhs syntax.Expr, rhs Value) error {
 		}
 		return setIndex(fr, lhs.Lbrack, x, y, rhs)
 
+	case *syntax.SliceExpr:
+		// x[lo:hi:step] = rhs
+		x, lo, hi, step, err := evalSliceOperands(fr, lhs)
+		if err != nil {
+			return err
+		}
+		if err := setSlice(x, lo, hi, step, rhs); err != nil {
+			return fr.errorf(lhs.Lbrack, "%s", err)
+		}
+
 	case *syntax.DotExpr:
 		// x.f = rhs
 		x, err := eval(fr, lhs.X)
@@ -758,7 +1306,7 @@ func eval(fr *Frame, e syntax.Expr) (Value, error) {
 	case *syntax.Comprehension:
 		var result Value
 		if e.Curly {
-			result = new(Dict)
+			result = &Dict{sortedRepr: fr.thread.SortedDictRepr}
 		} else {
 			result = new(List)
 		}
@@ -777,7 +1325,7 @@ func eval(fr *Frame, e syntax.Expr) (Value, error) {
 		return tuple, nil
 
 	case *syntax.DictExpr:
-		dict := new(Dict)
+		dict := &Dict{sortedRepr: fr.thread.SortedDictRepr}
 		for i, entry := range e.List {
 			entry := entry.(*syntax.DictEntry)
 			k, err := eval(fr, entry.Key)
@@ -844,12 +1392,50 @@ func eval(fr *Frame, e syntax.Expr) (Value, error) {
 		}
 
 		// binary operators
+		if err := fr.checkDictUnion(e.Op, x, y); err != nil {
+			return nil, fr.errorf(e.OpPos, "%s", err)
+		}
+		if err := fr.thread.CheckAllocs(binaryAllocs(e.Op, x, y)); err != nil {
+			return nil, fr.errorf(e.OpPos, "%s", err)
+		}
 		z, err := Binary(e.Op, x, y)
 		if err != nil {
 			return nil, fr.errorf(e.OpPos, "%s", err)
 		}
+		if err := fr.thread.CheckAllocs(formatAllocs(e.Op, z)); err != nil {
+			return nil, fr.errorf(e.OpPos, "%s", err)
+		}
 		return z, nil
 
+	case *syntax.ComparisonChain:
+		x, err := eval(fr, e.Operands[0])
+		if err != nil {
+			return nil, err
+		}
+		for i, op := range e.Ops {
+			y, err := eval(fr, e.Operands[i+1])
+			if err != nil {
+				return nil, err
+			}
+			var z Value
+			switch op {
+			case syntax.IN, syntax.NOT_IN:
+				z, err = Binary(op, x, y)
+			default:
+				var ok bool
+				ok, err = Compare(op, x, y)
+				z = Bool(ok)
+			}
+			if err != nil {
+				return nil, fr.errorf(e.OpPos[i], "%s", err)
+			}
+			if !z.Truth() {
+				return False, nil
+			}
+			x = y
+		}
+		return True, nil
+
 	case *syntax.DotExpr:
 		x, err := eval(fr, e.X)
 		if err != nil {
@@ -857,6 +1443,13 @@ func eval(fr *Frame, e syntax.Expr) (Value, error) {
 		}
 		return getAttr(fr, x, e)
 
+	case *syntax.OptDotExpr:
+		x, err := eval(fr, e.X)
+		if err != nil {
+			return nil, err
+		}
+		return getOptAttr(fr, x, e)
+
 	case *syntax.CallExpr:
 		return evalCall(fr, e)
 
@@ -884,12 +1477,37 @@ func Unary(op syntax.Token, x Value) (Value, error) {
 		case Int, Float:
 			return x, nil
 		}
+	case syntax.TILDE:
+		if x, ok := x.(Int); ok {
+			return x.Not(), nil
+		}
 	case syntax.NOT:
 		return !x.Truth(), nil
 	}
 	return nil, fmt.Errorf("unknown unary op: %s %s", op, x.Type())
 }
 
+// floatPow returns x ** y.
+func floatPow(x, y Float) (Value, error) {
+	if x == 0 && y < 0 {
+		return nil, fmt.Errorf("0.0 cannot be raised to a negative power")
+	}
+	return Float(math.Pow(float64(x), float64(y))), nil
+}
+
+// checkDictUnion returns an error if x op y is a dict union
+// and the thread does not permit it; see Thread.AllowDictUnion.
+func (fr *Frame) checkDictUnion(op syntax.Token, x, y Value) error {
+	if op == syntax.PIPE && !fr.thread.AllowDictUnion {
+		if _, ok := x.(*Dict); ok {
+			if _, ok := y.(*Dict); ok {
+				return fmt.Errorf("unknown binary op: dict | dict")
+			}
+		}
+	}
+	return nil
+}
+
 // Binary applies a strict binary operator (not AND or OR) to its operands.
 // For equality tests or ordered comparisons, use Compare instead.
 func Binary(op syntax.Token, x, y Value) (Value, error) {
@@ -934,14 +1552,7 @@ func Binary(op syntax.Token, x, y Value) (Value, error) {
 			//   tools/build_defs/haskell/def.bzl:448
 			// TODO(adonovan): clarify spec; see b/36360157.
 			if y, ok := y.(*Dict); ok {
-				z := new(Dict)
-				for _, item := range x.Items() {
-					z.Set(item[0], item[1])
-				}
-				for _, item := range y.Items() {
-					z.Set(item[0], item[1])
-				}
-				return z, nil
+				return dictUnion(x, y), nil
 			}
 		}
 
@@ -961,6 +1572,12 @@ func Binary(op syntax.Token, x, y Value) (Value, error) {
 			case Int:
 				return x - y.Float(), nil
 			}
+		case *Set: // difference
+			if y, ok := y.(*Set); ok {
+				iter := y.Iterate()
+				defer iter.Done()
+				return x.Difference(iter)
+			}
 		}
 
 	case syntax.STAR:
@@ -971,21 +1588,8 @@ func Binary(op syntax.Token, x, y Value) (Value, error) {
 				return x.Mul(y), nil
 			case Float:
 				return x.Float() * y, nil
-			case String:
-				if i, err := AsInt32(x); err == nil {
-					if i < 1 {
-						return String(""), nil
-					}
-					return String(strings.Repeat(string(y), i)), nil
-				}
-			case *List:
-				if i, err := AsInt32(x); err == nil {
-					return NewList(repeat(y.elems, i)), nil
-				}
-			case Tuple:
-				if i, err := AsInt32(x); err == nil {
-					return Tuple(repeat([]Value(y), i)), nil
-				}
+			case String, *List, Tuple:
+				return repeatSequence(y, x)
 			}
 		case Float:
 			switch y := y.(type) {
@@ -994,28 +1598,10 @@ func Binary(op syntax.Token, x, y Value) (Value, error) {
 			case Int:
 				return x * y.Float(), nil
 			}
-		case String:
-			if y, ok := y.(Int); ok {
-				if i, err := AsInt32(y); err == nil {
-					if i < 1 {
-						return String(""), nil
-					}
-					return String(strings.Repeat(string(x), i)), nil
-				}
-			}
-		case *List:
-			if y, ok := y.(Int); ok {
-				if i, err := AsInt32(y); err == nil {
-					return NewList(repeat(x.elems, i)), nil
-				}
-			}
-		case Tuple:
+		case String, *List, Tuple:
 			if y, ok := y.(Int); ok {
-				if i, err := AsInt32(y); err == nil {
-					return Tuple(repeat([]Value(x), i)), nil
-				}
+				return repeatSequence(x, y)
 			}
-
 		}
 
 	case syntax.SLASH:
@@ -1063,7 +1649,7 @@ func Binary(op syntax.Token, x, y Value) (Value, error) {
 				if y == 0.0 {
 					return nil, fmt.Errorf("floored division by zero")
 				}
-				return floor((x.Float() / y)), nil
+				return floordiv(x.Float(), y), nil
 			}
 		case Float:
 			switch y := y.(type) {
@@ -1071,13 +1657,13 @@ func Binary(op syntax.Token, x, y Value) (Value, error) {
 				if y == 0.0 {
 					return nil, fmt.Errorf("floored division by zero")
 				}
-				return floor(x / y), nil
+				return floordiv(x, y), nil
 			case Int:
 				yf := y.Float()
 				if yf == 0.0 {
 					return nil, fmt.Errorf("floored division by zero")
 				}
-				return floor(x / yf), nil
+				return floordiv(x, yf), nil
 			}
 		}
 
@@ -1102,7 +1688,7 @@ func Binary(op syntax.Token, x, y Value) (Value, error) {
 				if y == 0.0 {
 					return nil, fmt.Errorf("float modulo by zero")
 				}
-				return Float(math.Mod(float64(x), float64(y))), nil
+				return x.Mod(y), nil
 			case Int:
 				if y.Sign() == 0 {
 					return nil, fmt.Errorf("float modulo by zero")
@@ -1113,6 +1699,51 @@ func Binary(op syntax.Token, x, y Value) (Value, error) {
 			return interpolate(string(x), y)
 		}
 
+	case syntax.LTLT, syntax.GTGT:
+		if x, ok := x.(Int); ok {
+			if y, ok := y.(Int); ok {
+				if y.Sign() < 0 {
+					return nil, fmt.Errorf("negative shift count: %v", y)
+				}
+				n, ok := y.Int64()
+				if op == syntax.LTLT {
+					if !ok || n >= maxShift {
+						return nil, fmt.Errorf("shift count too large: %v", y)
+					}
+					return x.Lsh(uint(n)), nil
+				}
+				// A right shift by at least the size of x yields 0 or -1.
+				if size := int64(x.bigint.BitLen()); !ok || n > size {
+					n = size
+				}
+				return x.Rsh(uint(n)), nil
+			}
+		}
+
+	case syntax.STARSTAR:
+		switch x := x.(type) {
+		case Int:
+			switch y := y.(type) {
+			case Int:
+				if y.Sign() >= 0 {
+					if _, ok := intPowBits(x, y); !ok {
+						return nil, fmt.Errorf("excessive exponent: %v ** %v", x, y)
+					}
+					return x.Exp(y), nil
+				}
+				return floatPow(x.Float(), y.Float()) // 2 ** -1 == 0.5
+			case Float:
+				return floatPow(x.Float(), y)
+			}
+		case Float:
+			switch y := y.(type) {
+			case Float:
+				return floatPow(x, y)
+			case Int:
+				return floatPow(x, y.Float())
+			}
+		}
+
 	case syntax.NOT_IN:
 		z, err := Binary(syntax.IN, x, y)
 		if err != nil {
@@ -1146,6 +1777,16 @@ func Binary(op syntax.Token, x, y Value) (Value, error) {
 		case *Set:
 			ok, err := y.Has(x)
 			return Bool(ok), err
+		case rangeValue:
+			switch x := x.(type) {
+			case Int:
+				return Bool(y.contains(x)), nil
+			case Float:
+				// An integral float equals the corresponding int.
+				f := float64(x)
+				return Bool(isFinite(f) && f == math.Trunc(f) && y.contains(finiteFloatToInt(x))), nil
+			}
+			return False, nil
 		case String:
 			needle, ok := x.(String)
 			if !ok {
@@ -1165,6 +1806,10 @@ func Binary(op syntax.Token, x, y Value) (Value, error) {
 				defer iter.Done()
 				return x.Union(iter)
 			}
+		case *Dict: // merge
+			if y, ok := y.(*Dict); ok {
+				return dictUnion(x, y), nil
+			}
 		}
 
 	case syntax.AMP:
@@ -1175,17 +1820,23 @@ func Binary(op syntax.Token, x, y Value) (Value, error) {
 			}
 		case *Set: // intersection
 			if y, ok := y.(*Set); ok {
-				set := new(Set)
-				if x.Len() > y.Len() {
-					x, y = y, x // opt: range over smaller set
-				}
-				for _, xelem := range x.elems() {
-					// Has, Insert cannot fail here.
-					if found, _ := y.Has(xelem); found {
-						set.Insert(xelem)
-					}
-				}
-				return set, nil
+				iter := y.Iterate()
+				defer iter.Done()
+				return x.Intersection(iter)
+			}
+		}
+
+	case syntax.CIRCUMFLEX:
+		switch x := x.(type) {
+		case Int:
+			if y, ok := y.(Int); ok {
+				return x.Xor(y), nil
+			}
+		case *Set: // symmetric difference
+			if y, ok := y.(*Set); ok {
+				iter := y.Iterate()
+				defer iter.Done()
+				return x.SymmetricDifference(iter)
 			}
 		}
 
@@ -1213,6 +1864,141 @@ unknown:
 	return nil, fmt.Errorf("unknown binary op: %s %s %s", x.Type(), op, y.Type())
 }
 
+// dictUnion returns a new dictionary containing the items of x
+// followed by those of y. If a key is present in both, the
+// result contains the value from y.
+func dictUnion(x, y *Dict) *Dict {
+	z := NewDict(x.Len() + y.Len())
+	z.sortedRepr = x.sortedRepr || y.sortedRepr
+	for _, item := range x.Items() {
+		z.Set(item[0], item[1])
+	}
+	for _, item := range y.Items() {
+		z.Set(item[0], item[1])
+	}
+	return z
+}
+
+// valueSize is the size in bytes of a Value, an element of a list or tuple.
+const valueSize = int64(unsafe.Sizeof(Value(nil)))
+
+// dictEntrySize is the approximate size in bytes of a dict entry.
+const dictEntrySize = int64(unsafe.Sizeof(entry{}))
+
+// binaryAllocs returns the approximate number of bytes that
+// Binary(op, x, y) allocates for a new string, list, or tuple
+// produced by concatenation or repetition, a dict produced by
+// union, or an integer produced by exponentiation, and zero otherwise.
+// (The size of a %-formatted string is not known in advance;
+// see formatAllocs.)
+func binaryAllocs(op syntax.Token, x, y Value) int64 {
+	elemSize := func(x Value) int64 {
+		switch x.(type) {
+		case String:
+			return 1
+		case *List, Tuple:
+			return valueSize
+		}
+		return 0
+	}
+	switch op {
+	case syntax.PLUS:
+		if size := elemSize(x); size > 0 && size == elemSize(y) {
+			return int64(Len(x)+Len(y)) * size
+		}
+	case syntax.PIPE:
+		if x, ok := x.(*Dict); ok {
+			if y, ok := y.(*Dict); ok {
+				return int64(x.Len()+y.Len()) * dictEntrySize
+			}
+		}
+	case syntax.STARSTAR:
+		if x, ok := x.(Int); ok {
+			if y, ok := y.(Int); ok && y.Sign() >= 0 {
+				bits, _ := intPowBits(x, y)
+				return bits / 8
+			}
+		}
+	case syntax.STAR:
+		n, ok := y.(Int)
+		if !ok {
+			x, y = y, x
+			n, ok = y.(Int)
+		}
+		if size, xlen := elemSize(x), int64(Len(x)); ok && size > 0 && xlen > 0 && n.Sign() > 0 {
+			count, ok := n.Int64()
+			if !ok || count > math.MaxInt64/size/xlen {
+				return math.MaxInt64 // excessive
+			}
+			return count * xlen * size
+		}
+	}
+	return 0
+}
+
+// formatAllocs returns the number of bytes allocated for z,
+// the result of Binary(op, x, y), if it is a %-formatted string,
+// and zero otherwise.
+func formatAllocs(op syntax.Token, z Value) int64 {
+	if s, ok := z.(String); ok && op == syntax.PERCENT {
+		return int64(len(s))
+	}
+	return 0
+}
+
+// maxRepeat is the maximum length of a sequence produced by repetition
+// (x * n), in elements or, for strings, bytes.
+const maxRepeat = 1 << 30
+
+// maxShift bounds the shift count of x << n,
+// limiting the size of the result.
+const maxShift = 512
+
+// maxPowBits bounds the size in bits of the result of x ** y
+// for integer operands.
+const maxPowBits = 1 << 20
+
+// intPowBits returns an upper bound on the size in bits of x ** y,
+// for non-negative y, and reports whether it is within maxPowBits.
+func intPowBits(x, y Int) (int64, bool) {
+	xbits := int64(x.bigint.BitLen())
+	if xbits <= 1 {
+		return 1, true // x is -1, 0, or 1
+	}
+	n, ok := y.Int64()
+	if !ok || n > maxPowBits/xbits {
+		return math.MaxInt64, false
+	}
+	return n * xbits, true
+}
+
+// repeatSequence returns the string, list, or tuple x repeated n times.
+func repeatSequence(x Value, n Int) (Value, error) {
+	length := Len(x)
+	i, err := AsInt32(n)
+	if err != nil {
+		if n.Sign() > 0 && length > 0 {
+			return nil, fmt.Errorf("excessive repeat (%d * %s elements)", length, n)
+		}
+		i = 0
+	}
+	if i < 1 || length == 0 {
+		i = 0
+	} else if i > maxRepeat/length {
+		return nil, fmt.Errorf("excessive repeat (%d * %d elements)", length, i)
+	}
+
+	switch x := x.(type) {
+	case String:
+		return String(strings.Repeat(string(x), i)), nil
+	case *List:
+		return NewList(repeat(x.elems, i)), nil
+	case Tuple:
+		return Tuple(repeat(x, i)), nil
+	}
+	panic(x)
+}
+
 func repeat(elems []Value, n int) (res []Value) {
 	if n > 0 {
 		res = make([]Value, 0, len(elems)*n)
@@ -1223,7 +2009,7 @@ func repeat(elems []Value, n int) (res []Value) {
 	return res
 }
 
-func evalCall(fr *Frame, call *syntax.CallExpr) (Value, error) {
+func evalCall(fr *Frame, call *syntax.CallExpr) (_ Value, err error) {
 	var fn Value
 
 	// Use optimized path for calling methods of built-ins: x.f(...)
@@ -1241,7 +2027,8 @@ func evalCall(fr *Frame, call *syntax.CallExpr) (Value, error) {
 			}
 
 			// Make the call.
-			res, err := method(name, recv, args, kwargs)
+			defer recoverCall(fr, call.Lparen, recv.Type()+"."+name, &err)
+			res, err := method(fr.thread, name, recv, args, kwargs)
 			return res, wrapError(fr, call.Lparen, err)
 		}
 
@@ -1251,7 +2038,6 @@ func evalCall(fr *Frame, call *syntax.CallExpr) (Value, error) {
 			return nil, err
 		}
 	} else {
-		var err error
 		fn, err = eval(fr, call.Fn)
 		if err != nil {
 			return nil, err
@@ -1269,6 +2055,15 @@ func evalCall(fr *Frame, call *syntax.CallExpr) (Value, error) {
 	return res, wrapError(fr, call.Lparen, err)
 }
 
+// recoverCall, when deferred around a call to a built-in method,
+// turns a panic in that method into an error at the call position.
+// (Panics in other functions implemented in Go are recovered by Call.)
+func recoverCall(fr *Frame, posn syntax.Position, name string, err *error) {
+	if x := recover(); x != nil {
+		*err = fr.errorf(posn, "internal error: panic in %s: %v", name, x)
+	}
+}
+
 // wrapError wraps the error in a skylark.EvalError only if needed.
 func wrapError(fr *Frame, posn syntax.Position, err error) error {
 	switch err := err.(type) {
@@ -1281,6 +2076,8 @@ func wrapError(fr *Frame, posn syntax.Position, err error) error {
 func evalArgs(fr *Frame, call *syntax.CallExpr) (args Tuple, kwargs []Tuple, err error) {
 	// evaluate arguments.
 	var kwargsAlloc Tuple // allocate a single backing array
+	max := fr.thread.MaxCallArgs
+	expanded := false // whether the call has *args or **kwargs
 	for i, arg := range call.Args {
 		// keyword argument, k=v
 		if binop, ok := arg.(*syntax.BinaryExpr); ok && binop.Op == syntax.EQ {
@@ -1314,8 +2111,16 @@ func evalArgs(fr *Frame, call *syntax.CallExpr) (args Tuple, kwargs []Tuple, err
 					return nil, nil, fr.errorf(unop.OpPos, "argument after * must be iterable, not %s", x.Type())
 				}
 				defer iter.Done()
+				expanded = true
+				if n := knownLen(x); max > 0 && len(args)+len(kwargs)+n > max {
+					return nil, nil, fr.errorf(unop.OpPos, "too many arguments: %d exceeds limit of %d", len(args)+len(kwargs)+n, max)
+				}
 				var elem Value
 				for iter.Next(&elem) {
+					// The length of some iterables is not known in advance.
+					if max > 0 && len(args)+len(kwargs) >= max {
+						return nil, nil, fr.errorf(unop.OpPos, "too many arguments: more than %d", max)
+					}
 					args = append(args, elem)
 				}
 				continue
@@ -1327,11 +2132,19 @@ func evalArgs(fr *Frame, call *syntax.CallExpr) (args Tuple, kwargs []Tuple, err
 				if err != nil {
 					return nil, nil, err
 				}
-				xdict, ok := x.(*Dict)
+				xdict, ok := x.(IterableMapping)
 				if !ok {
 					return nil, nil, fr.errorf(unop.OpPos, "argument after ** must be a mapping, not %s", x.Type())
 				}
+				expanded = true
+				// Check the length, if known, before materializing the items.
+				if n := knownLen(x); max > 0 && len(args)+len(kwargs)+n > max {
+					return nil, nil, fr.errorf(unop.OpPos, "too many arguments: %d exceeds limit of %d", len(args)+len(kwargs)+n, max)
+				}
 				items := xdict.Items()
+				if n := len(items); max > 0 && len(args)+len(kwargs)+n > max {
+					return nil, nil, fr.errorf(unop.OpPos, "too many arguments: %d exceeds limit of %d", len(args)+len(kwargs)+n, max)
+				}
 				for _, item := range items {
 					if _, ok := item[0].(String); !ok {
 						return nil, nil, fr.errorf(unop.OpPos, "keywords must be strings, not %s", item[0].Type())
@@ -1353,16 +2166,41 @@ func evalArgs(fr *Frame, call *syntax.CallExpr) (args Tuple, kwargs []Tuple, err
 		}
 		args = append(args, v)
 	}
+	if n := len(args) + len(kwargs); expanded && max > 0 && n > max {
+		return nil, nil, fr.errorf(call.Lparen, "too many arguments: %d exceeds limit of %d", n, max)
+	}
 	return args, kwargs, err
 }
 
+// knownLen returns the length of x, or zero if it is not known in advance.
+func knownLen(x Value) int {
+	if n := Len(x); n > 0 {
+		return n
+	}
+	return 0
+}
+
 // Call calls the function fn with the specified positional and keyword arguments.
-func Call(thread *Thread, fn Value, args Tuple, kwargs []Tuple) (Value, error) {
+// fn may be any Callable, such as a *Function or *Builtin; it is an
+// error if it is not callable. If fn is a Skylark function, an error
+// that occurs during the call is an *EvalError whose backtrace begins
+// at the function. A panic in a Callable implemented in Go is reported
+// as an error.
+func Call(thread *Thread, fn Value, args Tuple, kwargs []Tuple) (res Value, err error) {
 	c, ok := fn.(Callable)
 	if !ok {
 		return nil, fmt.Errorf("invalid call of non-function (%s)", fn.Type())
 	}
-	res, err := c.Call(thread, args, kwargs)
+	if _, ok := c.(*Function); !ok {
+		// A panic in a function implemented in Go becomes an error,
+		// so that a faulty built-in cannot crash the application.
+		defer func() {
+			if x := recover(); x != nil {
+				res, err = nil, fmt.Errorf("internal error: panic in %s: %v", c.Name(), x)
+			}
+		}()
+	}
+	res, err = c.Call(thread, args, kwargs)
 	// Sanity check: nil is not a valid Skylark value.
 	if err == nil && res == nil {
 		return nil, fmt.Errorf("internal error: nil (not None) returned from %s", fn)
@@ -1371,38 +2209,97 @@ func Call(thread *Thread, fn Value, args Tuple, kwargs []Tuple) (Value, error) {
 }
 
 func evalSliceExpr(fr *Frame, e *syntax.SliceExpr) (Value, error) {
-	// Unlike Python, Skylark does not allow a slice on the LHS of
-	// an assignment statement.
-
-	x, err := eval(fr, e.X)
+	x, lo, hi, step, err := evalSliceOperands(fr, e)
 	if err != nil {
 		return nil, err
 	}
+	res, err := slice(x, lo, hi, step)
+	if err != nil {
+		return nil, fr.errorf(e.Lbrack, "%s", err)
+	}
+	return res, nil
+}
 
-	var lo, hi, step Value = None, None, None
+// evalSliceOperands evaluates the operands of x[lo:hi:step].
+// Missing indices are None.
+func evalSliceOperands(fr *Frame, e *syntax.SliceExpr) (x, lo, hi, step Value, err error) {
+	x, err = eval(fr, e.X)
+	if err != nil {
+		return
+	}
+	lo, hi, step = None, None, None
 	if e.Lo != nil {
 		lo, err = eval(fr, e.Lo)
 		if err != nil {
-			return nil, err
+			return
 		}
 	}
 	if e.Hi != nil {
 		hi, err = eval(fr, e.Hi)
 		if err != nil {
-			return nil, err
+			return
 		}
 	}
 	if e.Step != nil {
 		step, err = eval(fr, e.Step)
 		if err != nil {
-			return nil, err
+			return
 		}
 	}
-	res, err := slice(x, lo, hi, step)
+	return
+}
+
+// setSlice implements x[lo:hi:step] = z.
+// Only lists support slice assignment.
+// With a stride of 1, the slice is replaced by the elements of z,
+// which may change the length of the list;
+// otherwise z must have exactly one element for each slot of the slice.
+func setSlice(x, lo, hi, step, z Value) error {
+	list, ok := x.(*List)
+	if !ok {
+		return fmt.Errorf("%s value does not support slice assignment", x.Type())
+	}
+	iter := Iterate(z)
+	if iter == nil {
+		return fmt.Errorf("can only assign an iterable to a slice, got %s", z.Type())
+	}
+	// Copy the elements of z first, since z may be the list itself.
+	var elems []Value
+	var elem Value
+	for iter.Next(&elem) {
+		elems = append(elems, elem)
+	}
+	iter.Done()
+
+	// Compute the indices of the slice by slicing the range of indices of list.
+	n := list.Len()
+	v, err := slice(rangeValue{start: 0, stop: n, step: 1, len: n}, lo, hi, step)
 	if err != nil {
-		return nil, fr.errorf(e.Lbrack, "%s", err)
+		return err
 	}
-	return res, nil
+	r := v.(rangeValue)
+
+	if r.step == 1 {
+		if err := list.checkMutable("assign to slice of", true); err != nil {
+			return err
+		}
+		start, end := r.start, r.start+r.len
+		tail := append([]Value{}, list.elems[end:]...)
+		list.elems = append(append(list.elems[:start], elems...), tail...)
+		return nil
+	}
+
+	// extended slice
+	if len(elems) != r.len {
+		return fmt.Errorf("attempt to assign sequence of size %d to extended slice of size %d", len(elems), r.len)
+	}
+	if err := list.checkMutable("assign to slice of", false); err != nil {
+		return err
+	}
+	for i, elem := range elems {
+		list.elems[r.start+i*r.step] = elem
+	}
+	return nil
 }
 
 func slice(x, lo, hi, step_ Value) (Value, error) {
@@ -1499,6 +2396,14 @@ func slice(x, lo, hi, step_ Value) (Value, error) {
 			tuple = append(tuple, x[i])
 		}
 		return tuple, nil
+	case rangeValue:
+		// The result is another range; no elements are materialized.
+		return rangeValue{
+			start: x.start + start*x.step,
+			stop:  x.start + end*x.step,
+			step:  x.step * step,
+			len:   rangeLen(start, end, step),
+		}, nil
 	}
 
 	return nil, fmt.Errorf("invalid slice operand %s", x.Type())
@@ -1571,15 +2476,25 @@ func evalComprehension(fr *Frame, comp *syntax.Comprehension, result Value, clau
 			if err != nil {
 				return err
 			}
-			if err := result.(*Dict).Set(k, v); err != nil {
+			dict := result.(*Dict)
+			n := dict.Len()
+			if err := dict.Set(k, v); err != nil {
 				return fr.errorf(entry.Colon, "%v", err)
 			}
+			if dict.Len() > n {
+				if err := fr.thread.CheckAllocs(dictEntrySize); err != nil {
+					return fr.errorf(comp.Lbrack, "%v", err)
+				}
+			}
 		} else {
 			// list: [body for vars in x]
 			x, err := eval(fr, comp.Body)
 			if err != nil {
 				return err
 			}
+			if err := fr.thread.CheckAllocs(valueSize); err != nil {
+				return fr.errorf(comp.Lbrack, "%v", err)
+			}
 			list := result.(*List)
 			list.elems = append(list.elems, x)
 		}
@@ -1610,6 +2525,9 @@ func evalComprehension(fr *Frame, comp *syntax.Comprehension, result Value, clau
 		defer iter.Done()
 		var elem Value
 		for iter.Next(&elem) {
+			if err := fr.checkDeadline(clause.For); err != nil {
+				return err
+			}
 			if err := assign(fr, clause.For, clause.Vars, elem); err != nil {
 				return err
 			}
@@ -1642,15 +2560,16 @@ func evalFunction(fr *Frame, pos syntax.Position, name string, function *syntax.
 		}
 	}
 
-	// Capture the values of the function's
+	// Capture the cells of the function's
 	// free variables from the lexical environment.
 	freevars := make([]Value, len(function.FreeVars))
 	for i, freevar := range function.FreeVars {
-		v, err := fr.lookup(freevar)
-		if err != nil {
-			return nil, fr.errorf(pos, "%s", err)
+		switch resolve.Scope(freevar.Scope) {
+		case resolve.Cell:
+			freevars[i] = fr.locals[freevar.Index]
+		case resolve.Free:
+			freevars[i] = fr.fn.freevars[freevar.Index]
 		}
-		freevars[i] = v
 	}
 
 	return &Function{
@@ -1663,18 +2582,27 @@ func evalFunction(fr *Frame, pos syntax.Position, name string, function *syntax.
 	}, nil
 }
 
+// exec executes the body of fn in the frame fr, which has been pushed
+// on its thread's stack, and pops it, even if execution panics.
+func (fn *Function) exec(fr *Frame) error {
+	defer func() { fr.thread.frame = fr.parent }()
+	return execStmts(fr, fn.syntax.Body)
+}
+
 func (fn *Function) Call(thread *Thread, args Tuple, kwargs []Tuple) (Value, error) {
 	if debug {
 		fmt.Printf("call of %s %v %v\n", fn.Name(), args, kwargs)
 	}
 
 	// detect recursion
-	for fr := thread.frame; fr != nil; fr = fr.parent {
-		// We look for the same syntactic function,
-		// not function value, otherwise the user could
-		// defeat it by writing the Y combinator.
-		if fr.fn != nil && fr.fn.syntax == fn.syntax {
-			return nil, fmt.Errorf("function %s called recursively", fn.Name())
+	if !resolve.AllowRecursion {
+		for fr := thread.frame; fr != nil; fr = fr.parent {
+			// We look for the same syntactic function,
+			// not function value, otherwise the user could
+			// defeat it by writing the Y combinator.
+			if fr.fn != nil && fr.fn.syntax == fn.syntax {
+				return nil, fmt.Errorf("function %s called recursively", fn.Name())
+			}
 		}
 	}
 
@@ -1685,14 +2613,20 @@ func (fn *Function) Call(thread *Thread, args Tuple, kwargs []Tuple) (Value, err
 		globals: fn.globals,
 		locals:  make([]Value, len(fn.syntax.Locals)),
 	}
+	if thread.frame != nil {
+		fr.depth = thread.frame.depth + 1
+		if fr.depth > maxCallDepth {
+			return nil, fmt.Errorf("function %s: call stack depth exceeds %d", fn.Name(), maxCallDepth)
+		}
+	}
 
 	if err := fn.setArgs(fr, args, kwargs); err != nil {
 		return nil, err
 	}
+	makeCells(fr.locals, fn.syntax.Locals)
 
 	thread.frame = fr
-	err := execStmts(fr, fn.syntax.Body)
-	thread.frame = fr.parent // restore
+	err := fn.exec(fr)
 
 	if err != nil {
 		if err == errReturn {
@@ -1727,7 +2661,8 @@ func (fn *Function) setArgs(fr *Frame, args Tuple, kwargs []Tuple) error {
 	n := len(args)
 	if nparams > 0 || fn.syntax.HasVarargs || fn.syntax.HasKwargs {
 		if fn.syntax.HasKwargs {
-			kwdict = new(Dict)
+			kwdict = NewDict(len(kwargs))
+			kwdict.sortedRepr = fr.thread.SortedDictRepr
 			fr.locals[len(fn.syntax.Params)-1] = kwdict
 		}
 
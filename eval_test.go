@@ -7,15 +7,24 @@ package skylark_test
 import (
 	"bytes"
 	"fmt"
+	"io/ioutil"
 	"math"
 	"path/filepath"
+	"regexp"
+	"sort"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/google/skylark"
 	"github.com/google/skylark/internal/chunkedfile"
 	"github.com/google/skylark/resolve"
+	"github.com/google/skylark/skylarkjson"
+	"github.com/google/skylark/skylarkmath"
+	"github.com/google/skylark/skylarkstruct"
 	"github.com/google/skylark/skylarktest"
+	"github.com/google/skylark/skylarktime"
+	"github.com/google/skylark/syntax"
 )
 
 func init() {
@@ -25,6 +34,7 @@ func init() {
 	resolve.AllowFloat = true
 	resolve.AllowFreeze = true
 	resolve.AllowSet = true
+	resolve.AllowOptionalDot = true
 }
 
 func TestEvalExpr(t *testing.T) {
@@ -93,8 +103,11 @@ func TestEvalExpr(t *testing.T) {
 
 func TestExecFile(t *testing.T) {
 	testdata := skylarktest.DataFile("skylark", ".")
-	thread := &skylark.Thread{Load: load}
+	thread := &skylark.Thread{Load: load, AllowDictUnion: true}
 	skylarktest.SetReporter(thread, t)
+	skylarktime.SetNow(thread, func() time.Time {
+		return time.Date(2017, 7, 14, 2, 40, 0, 0, time.UTC) // a fixed clock for time.sky
+	})
 	for _, file := range []string{
 		"testdata/assign.sky",
 		"testdata/bool.sky",
@@ -104,10 +117,14 @@ func TestExecFile(t *testing.T) {
 		"testdata/float.sky",
 		"testdata/function.sky",
 		"testdata/int.sky",
+		"testdata/json.sky",
 		"testdata/list.sky",
+		"testdata/math.sky",
 		"testdata/misc.sky",
 		"testdata/set.sky",
 		"testdata/string.sky",
+		"testdata/struct.sky",
+		"testdata/time.sky",
 		"testdata/tuple.sky",
 	} {
 		filename := filepath.Join(testdata, file)
@@ -165,6 +182,18 @@ func load(thread *skylark.Thread, module string) (skylark.StringDict, error) {
 	if module == "assert.sky" {
 		return skylarktest.LoadAssertModule()
 	}
+	if module == "json.sky" {
+		return skylark.StringDict{"json": skylarkjson.Module}, nil
+	}
+	if module == "math.sky" {
+		return skylark.StringDict{"math": skylarkmath.Module}, nil
+	}
+	if module == "time.sky" {
+		return skylark.StringDict{"time": skylarktime.Module}, nil
+	}
+	if module == "struct.sky" {
+		return skylark.StringDict{"struct": skylark.NewBuiltin("struct", skylarkstruct.Make)}, nil
+	}
 
 	// TODO(adonovan): test load() using this execution path.
 	globals := make(skylark.StringDict)
@@ -305,6 +334,9 @@ func TestPrint(t *testing.T) {
 print("hello")
 def f(): print("world")
 f()
+print("a", 1, [2], sep=", ", end=";\n")
+print("no newline", end="")
+print("", x=3, sep="|")
 `
 	buf := new(bytes.Buffer)
 	print := func(thread *skylark.Thread, msg string) {
@@ -313,7 +345,7 @@ f()
 		if caller.Function() != nil {
 			name = caller.Function().Name()
 		}
-		fmt.Fprintf(buf, "%s: %s: %s\n", caller.Position(), name, msg)
+		fmt.Fprintf(buf, "%s: %s: %s", caller.Position(), name, msg)
 	}
 	thread := &skylark.Thread{Print: print}
 	globals := make(skylark.StringDict)
@@ -321,12 +353,463 @@ f()
 		t.Fatal(err)
 	}
 	want := "foo.go:2:6: <module>: hello\n" +
-		"foo.go:3:15: f: world\n"
+		"foo.go:3:15: f: world\n" +
+		"foo.go:5:6: <module>: a, 1, [2];\n" +
+		"foo.go:6:6: <module>: no newline" +
+		"foo.go:7:6: <module>: |x=3\n"
 	if got := buf.String(); got != want {
 		t.Errorf("output was %s, want %s", got, want)
 	}
 }
 
+// TestSortedSets ensures that Thread.SortedSets causes sets,
+// and sets derived from them, to be iterated in sorted order.
+func TestSortedSets(t *testing.T) {
+	const src = `
+x = set([3, 1, 'b', 2, 'a', (1,)])
+y = x | [0, 1.5]
+z = set([3, 1, 2])
+z.add(-1)
+results = "\n".join([
+    str(x),
+    str(list(x)),
+    str([e for e in y]),
+    str(z.union([1])),
+    str(z - set([2])),
+    str(sorted(z) == list(z)),
+])
+`
+	for _, test := range []struct {
+		sorted bool
+		want   string
+	}{
+		{false, `set([3, 1, "b", 2, "a", (1,)])
+[3, 1, "b", 2, "a", (1,)]
+[3, 1, "b", 2, "a", (1,), 0, 1.5]
+set([3, 1, 2, -1])
+set([3, 1, -1])
+False`},
+		{true, `set([1, 2, 3, "a", "b", (1,)])
+[1, 2, 3, "a", "b", (1,)]
+[0, 1, 1.5, 2, 3, "a", "b", (1,)]
+set([-1, 1, 2, 3])
+set([-1, 1, 3])
+True`},
+	} {
+		thread := &skylark.Thread{SortedSets: test.sorted}
+		globals := make(skylark.StringDict)
+		if err := skylark.ExecFile(thread, "sets.sky", src, globals); err != nil {
+			t.Fatal(err)
+		}
+		if got, _ := skylark.AsString(globals["results"]); got != test.want {
+			t.Errorf("SortedSets=%t: got\n%s\nwant\n%s", test.sorted, got, test.want)
+		}
+	}
+}
+
+func TestSortedDictRepr(t *testing.T) {
+	const src = `
+d = {"b": 1, 2: [{"z": 0, "y": 1}], "a": None, 1.5: 0, (1,): 0, 1: 0, True: 0}
+e = dict(d, **{"c": 0}) | {0: 0}
+results = "\n".join([str(d), repr(d), str(list(d)), str(e)])
+`
+	for _, test := range []struct {
+		sorted bool
+		want   string
+	}{
+		{false, `{"b": 1, 2: [{"z": 0, "y": 1}], "a": None, 1.5: 0, (1,): 0, 1: 0, True: 0}
+{"b": 1, 2: [{"z": 0, "y": 1}], "a": None, 1.5: 0, (1,): 0, 1: 0, True: 0}
+["b", 2, "a", 1.5, (1,), 1, True]
+{"b": 1, 2: [{"z": 0, "y": 1}], "a": None, 1.5: 0, (1,): 0, 1: 0, True: 0, "c": 0, 0: 0}`},
+		// Only the repr is affected, not the iteration order.
+		{true, `{True: 0, 1: 0, 1.5: 0, 2: [{"y": 1, "z": 0}], "a": None, "b": 1, (1,): 0}
+{True: 0, 1: 0, 1.5: 0, 2: [{"y": 1, "z": 0}], "a": None, "b": 1, (1,): 0}
+["b", 2, "a", 1.5, (1,), 1, True]
+{True: 0, 0: 0, 1: 0, 1.5: 0, 2: [{"y": 1, "z": 0}], "a": None, "b": 1, "c": 0, (1,): 0}`},
+	} {
+		thread := &skylark.Thread{SortedDictRepr: test.sorted, AllowDictUnion: true}
+		globals := make(skylark.StringDict)
+		if err := skylark.ExecFile(thread, "dicts.sky", src, globals); err != nil {
+			t.Fatal(err)
+		}
+		if got, _ := skylark.AsString(globals["results"]); got != test.want {
+			t.Errorf("SortedDictRepr=%t: got\n%s\nwant\n%s", test.sorted, got, test.want)
+		}
+	}
+}
+
+// TestUniverse ensures that a thread may restrict the set of built-ins.
+func TestUniverse(t *testing.T) {
+	universe := make(skylark.StringDict)
+	for name, v := range skylark.Universe {
+		if name != "print" {
+			universe[name] = v
+		}
+	}
+	universe["double"] = skylark.NewBuiltin("double", func(thread *skylark.Thread, fn *skylark.Builtin, args skylark.Tuple, kwargs []skylark.Tuple) (skylark.Value, error) {
+		var x int
+		if err := skylark.UnpackPositionalArgs("double", args, kwargs, 1, &x); err != nil {
+			return nil, err
+		}
+		return skylark.MakeInt(2 * x), nil
+	})
+	thread := &skylark.Thread{Universe: universe}
+
+	// print is not defined, even in a nested function.
+	for _, src := range []string{`print("x")`, "def f():\n  print(\"x\")"} {
+		err := skylark.ExecFile(thread, "universe.sky", src, skylark.StringDict{})
+		if got, want := fmt.Sprint(err), "undefined: print"; !strings.Contains(got, want) {
+			t.Errorf("ExecFile(%q) returned %q, want error containing %q", src, got, want)
+		}
+	}
+	if _, err := skylark.Eval(thread, "universe.sky", `print`, skylark.StringDict{}); err == nil {
+		t.Errorf("Eval(print) succeeded unexpectedly")
+	}
+
+	// Other built-ins, including the new one, are available.
+	globals := skylark.StringDict{}
+	if err := skylark.ExecFile(thread, "universe.sky", `x = double(len("abc"))`, globals); err != nil {
+		t.Fatal(err)
+	}
+	if got := globals["x"].String(); got != "6" {
+		t.Errorf("x = %s, want 6", got)
+	}
+
+	// The package-level Universe is unaffected.
+	if _, err := skylark.Eval(new(skylark.Thread), "universe.sky", `double`, skylark.StringDict{}); err == nil {
+		t.Errorf("Eval(double) succeeded unexpectedly with default universe")
+	}
+}
+
+// TestAssertModule exercises the functions of skylarktest.Assert.
+func TestAssertModule(t *testing.T) {
+	globals := skylark.StringDict{"assert": skylarktest.Assert}
+	for _, test := range []struct{ src, wantErr string }{
+		{`assert.eq(1 + 1, 2)`, ""},
+		{`assert.eq([1], [1])`, ""},
+		{`assert.eq(1, "1")`, `1 != "1"`},
+		{`assert.ne(1, 2)`, ""},
+		{`assert.ne("a", "a")`, `"a" == "a"`},
+		{`assert.lt(1, 2)`, ""},
+		{`assert.lt(2, 1)`, `2 is not less than 1`},
+		{`assert.lt(1, "a")`, `assert.lt: int < string not implemented`},
+		{`assert.true(1)`, ""},
+		{`assert.true([])`, `assertion failed`},
+		{`assert.true(False, "oops")`, `oops`},
+		{`assert.contains([1, 2], 2)`, ""},
+		{`assert.contains("abc", "d")`, `"abc" does not contain "d"`},
+		{`assert.fails(lambda: 1 // 0, "division by zero")`, ""},
+		{`assert.fails(lambda: 1 // 0, "^div")`, `regular expression \(\^div\) did not match error \(floored division by zero\)`},
+		{`assert.fails(lambda: 1, "division by zero")`, `evaluation succeeded unexpectedly \(want error matching "division by zero"\)`},
+		{`assert.fails(lambda: assert.eq(1, 2), "1 != 2")`, ""}, // execution continues after a caught failure
+		{`assert.fails(lambda: 1, "(")`, `assert.fails: error parsing regexp`},
+	} {
+		err := skylark.ExecFile(new(skylark.Thread), "assert.sky", test.src, globals)
+		if test.wantErr == "" {
+			if err != nil {
+				t.Errorf("%s: unexpected error: %v", test.src, err)
+			}
+			continue
+		}
+		if err == nil {
+			t.Errorf("%s: succeeded unexpectedly, want error %q", test.src, test.wantErr)
+			continue
+		}
+		if !regexp.MustCompile(test.wantErr).MatchString(err.Error()) {
+			t.Errorf("%s: got error %q, want %q", test.src, err, test.wantErr)
+		}
+	}
+
+	// The backtrace of a failed assertion indicates its position.
+	src := "x = 1\nassert.eq(x, 2)\n"
+	err := skylark.ExecFile(new(skylark.Thread), "assert.sky", src, globals)
+	evalErr, ok := err.(*skylark.EvalError)
+	if !ok {
+		t.Fatalf("ExecFile returned %v, want EvalError", err)
+	}
+	if got, want := evalErr.Backtrace(), "assert.sky:2:10: in <toplevel>"; !strings.Contains(got, want) {
+		t.Errorf("backtrace is %q, want it to contain %q", got, want)
+	}
+}
+
+// TestThreadLocal ensures that a built-in can retrieve
+// state provided by the application through its thread.
+func TestThreadLocal(t *testing.T) {
+	type logger struct{ lines []string }
+	log := skylark.NewBuiltin("log", func(thread *skylark.Thread, fn *skylark.Builtin, args skylark.Tuple, kwargs []skylark.Tuple) (skylark.Value, error) {
+		var msg string
+		if err := skylark.UnpackPositionalArgs(fn.Name(), args, kwargs, 1, &msg); err != nil {
+			return nil, err
+		}
+		l, ok := thread.Local("logger").(*logger)
+		if !ok {
+			return nil, fmt.Errorf("log: no logger")
+		}
+		l.lines = append(l.lines, msg)
+		return skylark.None, nil
+	})
+	globals := skylark.StringDict{"log": log}
+	if err := skylark.ExecFile(new(skylark.Thread), "local.sky", "def f(x): log(x)", globals); err != nil {
+		t.Fatal(err)
+	}
+
+	// Each thread has its own logger.
+	var loggers [2]logger
+	for i := range loggers {
+		thread := new(skylark.Thread)
+		thread.SetLocal("logger", &loggers[i])
+		if _, err := skylark.Call(thread, globals["f"], skylark.Tuple{skylark.String(fmt.Sprint("hello ", i))}, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got, want := fmt.Sprint(loggers), "[{[hello 0]} {[hello 1]}]"; got != want {
+		t.Errorf("logged %s, want %s", got, want)
+	}
+
+	// Without the application's logger, the built-in fails.
+	_, err := skylark.Call(new(skylark.Thread), globals["f"], skylark.Tuple{skylark.String("hello")}, nil)
+	if got, want := fmt.Sprint(err), "log: no logger"; got != want {
+		t.Errorf("Call returned %q, want %q", got, want)
+	}
+}
+
+// An adder is a test-only implementation of Callable
+// that returns the sum of its arguments.
+type adder struct{ name string }
+
+var _ skylark.Callable = adder{}
+
+func (a adder) String() string        { return "<adder " + a.name + ">" }
+func (a adder) Type() string          { return "adder" }
+func (a adder) Freeze()               {}
+func (a adder) Truth() skylark.Bool   { return true }
+func (a adder) Hash() (uint32, error) { return 0, fmt.Errorf("unhashable type: adder") }
+func (a adder) Name() string          { return a.name }
+
+func (a adder) Call(thread *skylark.Thread, args skylark.Tuple, kwargs []skylark.Tuple) (skylark.Value, error) {
+	if len(kwargs) > 0 {
+		return nil, fmt.Errorf("%s: unexpected keyword arguments", a.name)
+	}
+	var sum skylark.Value = skylark.MakeInt(0)
+	for _, arg := range args {
+		var err error
+		sum, err = skylark.Binary(syntax.PLUS, sum, arg)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", a.name, err)
+		}
+	}
+	return sum, nil
+}
+
+// TestCustomCallable ensures that values of application-defined
+// types that implement Callable may be called.
+func TestCustomCallable(t *testing.T) {
+	globals := skylark.StringDict{"add": adder{"add"}}
+	for _, test := range []struct{ src, want string }{
+		{`add()`, `0`},
+		{`add(1, 2, 3)`, `6`},
+		{`add(*[1.5, 2])`, `3.5`},
+		{`[add(x, x) for x in range(3)]`, `[0, 2, 4]`},
+		{`sorted([3, 1, 2], cmp=lambda x, y: add(x, -y))`, `[1, 2, 3]`},
+		{`add(1, "a")`, `add: unknown binary op: int + string`},
+		{`add(x=1)`, `add: unexpected keyword arguments`},
+		{`add`, `<adder add>`},
+	} {
+		var got string
+		if v, err := skylark.Eval(new(skylark.Thread), "callable.sky", test.src, globals); err != nil {
+			got = err.Error()
+		} else {
+			got = v.String()
+		}
+		if got != test.want {
+			t.Errorf("%s = %s, want %s", test.src, got, test.want)
+		}
+	}
+}
+
+// A point is a test-only implementation of HasAttrs
+// with two fixed attributes.
+type point struct{ x, y int }
+
+var _ skylark.HasAttrs = point{}
+
+func (p point) String() string        { return fmt.Sprintf("point(%d, %d)", p.x, p.y) }
+func (p point) Type() string          { return "point" }
+func (p point) Freeze()               {}
+func (p point) Truth() skylark.Bool   { return true }
+func (p point) Hash() (uint32, error) { return uint32(p.x ^ p.y), nil }
+func (p point) AttrNames() []string   { return []string{"y", "x"} }
+
+func (p point) Attr(name string) (skylark.Value, error) {
+	switch name {
+	case "x":
+		return skylark.MakeInt(p.x), nil
+	case "y":
+		return skylark.MakeInt(p.y), nil
+	}
+	return nil, nil
+}
+
+// TestHasAttrs ensures that the attributes of values of
+// application-defined types that implement HasAttrs may be accessed.
+func TestHasAttrs(t *testing.T) {
+	globals := skylark.StringDict{"p": point{1, 2}}
+	for _, test := range []struct{ src, want string }{
+		{`p.x`, `1`},
+		{`p.x + p.y`, `3`},
+		{`dir(p)`, `["x", "y"]`}, // sorted
+		{`[getattr(p, name) for name in dir(p)]`, `[1, 2]`},
+		{`(hasattr(p, "x"), hasattr(p, "z"))`, `(True, False)`},
+		{`getattr(p, "z", None)`, `None`},
+		{`p.z`, `point has no .z field or method (available: x, y)`},
+		{`getattr(p, "z")`, `point has no .z field or method (available: x, y)`},
+		{`None.z`, `NoneType has no .z field or method`},
+	} {
+		var got string
+		if v, err := skylark.Eval(new(skylark.Thread), "attrs.sky", test.src, globals); err != nil {
+			got = err.Error()
+		} else {
+			got = v.String()
+		}
+		if got != test.want {
+			t.Errorf("%s = %s, want %s", test.src, got, test.want)
+		}
+	}
+}
+
+// TestMaxCallArgs ensures that the expansion of *args and **kwargs
+// is limited by Thread.MaxCallArgs.
+func TestMaxCallArgs(t *testing.T) {
+	thread := &skylark.Thread{MaxCallArgs: 3}
+	for _, test := range []struct{ src, wantErr string }{
+		{`f(*[1, 2, 3])`, ""},
+		{`f(1, *[2], **{"a": 3})`, ""},
+		{`f(1, 2, 3, 4)`, ""}, // only expansions are limited
+		{`f(*range(1000000000))`, "too many arguments: 1000000000 exceeds limit of 3"},
+		{`f(1, *[2, 3, 4])`, "too many arguments: 4 exceeds limit of 3"},
+		{`f(1, 2, **{"a": 3, "b": 4})`, "too many arguments: 4 exceeds limit of 3"},
+		{`f(a=1, *[2, 3, 4])`, "too many arguments: 4 exceeds limit of 3"},
+		{`f(1, 2, 3, *fib)`, "too many arguments: more than 3"},
+		{`f(1, 2, 3, 4, *fib)`, "too many arguments: 4 exceeds limit of 3"},
+		{`f(1, 2, a=3, b=4, *fib)`, "too many arguments: 4 exceeds limit of 3"},
+		{`f(1, 2, 3, 4, **{})`, "too many arguments: 4 exceeds limit of 3"},
+	} {
+		const prelude = "def f(*args, **kwargs): pass\n"
+		err := skylark.ExecFile(thread, "maxargs.sky", prelude+test.src, skylark.StringDict{"fib": fib{}})
+		if got := fmt.Sprint(err); test.wantErr == "" && err != nil || test.wantErr != "" && got != test.wantErr {
+			t.Errorf("%s: got error %v, want %q", test.src, err, test.wantErr)
+		}
+	}
+}
+
+// A sizedMapping is a goMapping of known length
+// that counts calls to its Items method.
+type sizedMapping struct {
+	goMapping
+	itemsCalls *int
+}
+
+func (m sizedMapping) Len() int { return len(m.m) }
+
+func (m sizedMapping) Items() []skylark.Tuple {
+	*m.itemsCalls++
+	return m.goMapping.Items()
+}
+
+// TestMaxCallArgsKwargs ensures that the length of a **kwargs mapping
+// is checked against Thread.MaxCallArgs before its items are materialized.
+func TestMaxCallArgsKwargs(t *testing.T) {
+	var lookups []string
+	var itemsCalls int
+	m := sizedMapping{goMapping{map[string]int{"a": 1, "b": 2}, &lookups}, &itemsCalls}
+	thread := &skylark.Thread{MaxCallArgs: 3}
+	const src = "def f(*args, **kwargs): pass\nf(1, 2, **m)"
+	err := skylark.ExecFile(thread, "maxargs.sky", src, skylark.StringDict{"m": m})
+	if got, want := fmt.Sprint(err), "too many arguments: 4 exceeds limit of 3"; got != want {
+		t.Errorf("got error %s, want %s", got, want)
+	}
+	if itemsCalls != 0 {
+		t.Errorf("Items called %d times, want 0", itemsCalls)
+	}
+}
+
+// TestDeadline ensures that execution fails once the thread's deadline passes.
+func TestDeadline(t *testing.T) {
+	const src = `
+def f():
+  for x in range(1000000000):
+    pass
+f()
+`
+	thread := new(skylark.Thread)
+	thread.SetDeadline(time.Now().Add(10 * time.Millisecond))
+	err := skylark.ExecFile(thread, "deadline.sky", src, skylark.StringDict{})
+	if err == nil {
+		t.Fatal("ExecFile succeeded unexpectedly")
+	}
+	if got, want := err.Error(), "deadline exceeded"; got != want {
+		t.Errorf("ExecFile failed with %q, want %q", got, want)
+	}
+}
+
+// TestRecordReplay ensures that a recording of built-in calls
+// can be replayed without invoking the built-ins.
+func TestRecordReplay(t *testing.T) {
+	const src = `
+def f():
+  return [rand(), rand()]
+x = sorted(f(), key=lambda x: -x) + [len("abc")]
+`
+	n := 0
+	rand := skylark.NewBuiltin("rand", func(thread *skylark.Thread, fn *skylark.Builtin, args skylark.Tuple, kwargs []skylark.Tuple) (skylark.Value, error) {
+		n++
+		return skylark.MakeInt(n * 10), nil
+	})
+
+	// Record.
+	thread := new(skylark.Thread)
+	thread.RecordCalls()
+	globals := skylark.StringDict{"rand": rand}
+	if err := skylark.ExecFile(thread, "record.sky", src, globals); err != nil {
+		t.Fatal(err)
+	}
+	const want = "[20, 10, 3]"
+	if got := globals["x"].String(); got != want {
+		t.Fatalf("recording: x = %s, want %s", got, want)
+	}
+	calls := thread.RecordedCalls()
+	var names []string
+	for _, call := range calls {
+		names = append(names, call.Name)
+	}
+	if got, want := fmt.Sprint(names), "[rand rand sorted len]"; got != want {
+		t.Errorf("recorded calls %s, want %s", got, want)
+	}
+
+	// Replay, without calling rand.
+	n = 1000
+	thread = new(skylark.Thread)
+	thread.ReplayCalls(calls)
+	globals = skylark.StringDict{"rand": rand}
+	if err := skylark.ExecFile(thread, "replay.sky", src, globals); err != nil {
+		t.Fatal(err)
+	}
+	if got := globals["x"].String(); got != want {
+		t.Errorf("replay: x = %s, want %s", got, want)
+	}
+	if n != 1000 {
+		t.Errorf("replay called rand")
+	}
+
+	// Replay a log that does not match the program.
+	thread = new(skylark.Thread)
+	thread.ReplayCalls(calls[2:])
+	err := skylark.ExecFile(thread, "replay.sky", src, skylark.StringDict{"rand": rand})
+	if got, want := fmt.Sprint(err), "replay: call to rand, but recorded call was to sorted"; got != want {
+		t.Errorf("replay of mismatched log failed with %q, want %q", got, want)
+	}
+}
+
 func Benchmark(b *testing.B) {
 	testdata := skylarktest.DataFile("skylark", ".")
 	thread := new(skylark.Thread)
@@ -433,3 +916,721 @@ Error: floored division by zero`
 		t.Errorf("ExecFile failed with %v, wanted *EvalError", err)
 	}
 }
+
+func TestCallStack(t *testing.T) {
+	const src = `
+def f(x): return x[1]
+def g(x): return f(x)
+def h(): return g([])
+h()
+`
+	thread := new(skylark.Thread)
+	globals := make(skylark.StringDict)
+	err := skylark.ExecFile(thread, "crash.go", src, globals)
+	evalErr, ok := err.(*skylark.EvalError)
+	if !ok {
+		t.Fatalf("ExecFile failed with %v, wanted *EvalError", err)
+	}
+	var got []string
+	for _, fr := range evalErr.CallStack() {
+		got = append(got, fmt.Sprintf("%s@%s", fr.Name, fr.Pos))
+	}
+	want := "f@crash.go:2:19 g@crash.go:3:19 h@crash.go:4:18 <toplevel>@crash.go:5:2"
+	if got := strings.Join(got, " "); got != want {
+		t.Errorf("call stack was %s, want %s", got, want)
+	}
+}
+
+func TestThreadCallStack(t *testing.T) {
+	var stack []skylark.CallFrame
+	var depth int
+	breakpoint := skylark.NewBuiltin("breakpoint", func(thread *skylark.Thread, fn *skylark.Builtin, args skylark.Tuple, kwargs []skylark.Tuple) (skylark.Value, error) {
+		stack = thread.CallStack()
+		depth = thread.CallStackDepth()
+		return skylark.None, nil
+	})
+	const src = `
+def f():
+  g()
+
+def g():
+  x = 1
+  breakpoint()
+
+f()
+`
+	globals := skylark.StringDict{"breakpoint": breakpoint}
+	if err := skylark.ExecFile(new(skylark.Thread), "stack.sky", src, globals); err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, fr := range stack {
+		got = append(got, fmt.Sprintf("%s@%s", fr.Name, fr.Pos))
+	}
+	want := "[g@stack.sky:7:13 f@stack.sky:3:4 <toplevel>@stack.sky:9:2]"
+	if fmt.Sprint(got) != want {
+		t.Errorf("CallStack = %s, want %s", got, want)
+	}
+	if depth != 3 {
+		t.Errorf("CallStackDepth = %d, want 3", depth)
+	}
+}
+
+func TestCall(t *testing.T) {
+	const src = `
+def f(a, b=2, *args, **kwargs): return (a, b, args, kwargs)
+def g(x): return h(x)
+def h(x): return 1//x
+`
+	thread := new(skylark.Thread)
+	globals := make(skylark.StringDict)
+	if err := skylark.ExecFile(thread, "call.sky", src, globals); err != nil {
+		t.Fatal(err)
+	}
+	one, two := skylark.MakeInt(1), skylark.MakeInt(2)
+	for _, test := range []struct {
+		fn     skylark.Value
+		args   skylark.Tuple
+		kwargs []skylark.Tuple
+		want   string
+	}{
+		{globals["f"], skylark.Tuple{one}, nil, `(1, 2, (), {})`},
+		{globals["f"], skylark.Tuple{one, two, two}, nil, `(1, 2, (2,), {})`},
+		{globals["f"], nil, []skylark.Tuple{{skylark.String("a"), one}}, `(1, 2, (), {})`},
+		{globals["f"], skylark.Tuple{one}, []skylark.Tuple{{skylark.String("c"), two}}, `(1, 2, (), {"c": 2})`},
+		{globals["f"], nil, nil, `function f takes at least 1 argument (0 given)`},
+		{skylark.Universe["len"], skylark.Tuple{skylark.String("abc")}, nil, `3`},
+		{skylark.Universe["len"], nil, nil, `len: got 0 arguments, want 1`},
+		{one, nil, nil, `invalid call of non-function (int)`},
+	} {
+		var got string
+		if v, err := skylark.Call(thread, test.fn, test.args, test.kwargs); err != nil {
+			got = err.Error()
+		} else {
+			got = v.String()
+		}
+		if got != test.want {
+			t.Errorf("Call(%s, %s, %s) = %s, want %s", test.fn, test.args, test.kwargs, got, test.want)
+		}
+	}
+
+	// An error within a function called from Go carries a backtrace.
+	_, err := skylark.Call(thread, globals["g"], skylark.Tuple{skylark.MakeInt(0)}, nil)
+	evalErr, ok := err.(*skylark.EvalError)
+	if !ok {
+		t.Fatalf("Call failed with %v, wanted *EvalError", err)
+	}
+	const want = `Traceback (most recent call last):
+  call.sky:3:19: in g
+  call.sky:4:19: in h
+Error: floored division by zero`
+	if got := evalErr.Backtrace(); got != want {
+		t.Errorf("error was %s, want %s", got, want)
+	}
+}
+
+func TestChainedComparisons(t *testing.T) {
+	const src = `
+calls = []
+def f(x):
+  calls.append(x)
+  return x
+
+a = 1 < 2 < 3
+b = 1 < 3 < 2
+c = 1 == 1 != 2 in [2] not in [3]
+d = f(3) < f(2) < f(1)  # stops after first false comparison
+e = f(1) < f(2) < f(3)  # f(2) called once
+`
+	thread := new(skylark.Thread)
+	globals := make(skylark.StringDict)
+	opts := skylark.ExecOptions{
+		Thread:       thread,
+		Filename:     "chain.sky",
+		Source:       src,
+		Globals:      globals,
+		ParseOptions: syntax.ParseOptions{AllowChainedComparisons: true},
+	}
+	if err := skylark.Exec(opts); err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct{ name, want string }{
+		{"a", "True"},
+		{"b", "False"},
+		{"c", "True"},
+		{"d", "False"},
+		{"e", "True"},
+		{"calls", "[3, 2, 1, 2, 3]"},
+	} {
+		if got := globals[test.name].String(); got != test.want {
+			t.Errorf("%s = %s, want %s", test.name, got, test.want)
+		}
+	}
+
+	// Errors are reported at the failing operator.
+	opts.Source = `x = 1 < 2 < "3"`
+	opts.Globals = make(skylark.StringDict)
+	err := skylark.Exec(opts)
+	evalErr, ok := err.(*skylark.EvalError)
+	if !ok {
+		t.Fatalf("Exec failed with %v, wanted *EvalError", err)
+	}
+	const want = `Traceback (most recent call last):
+  chain.sky:1:11: in <toplevel>
+Error: int < string not implemented`
+	if got := evalErr.Backtrace(); got != want {
+		t.Errorf("error was %s, want %s", got, want)
+	}
+
+	// By default, chains are a syntax error.
+	opts.ParseOptions = syntax.ParseOptions{}
+	err = skylark.Exec(opts)
+	if want := `chain.sky:1:12: < does not associate with < (use parens)`; err == nil || err.Error() != want {
+		t.Errorf("Exec: got error %v, want %s", err, want)
+	}
+}
+
+func TestIterate(t *testing.T) {
+	const src = `
+squares = [x * x for x in range(5)]
+evens = {x: None for x in range(0, 10, 2)}
+`
+	globals := skylark.StringDict{}
+	if err := skylark.ExecFile(new(skylark.Thread), "iterate.sky", src, globals); err != nil {
+		t.Fatal(err)
+	}
+
+	elems, err := skylark.Elements(globals["squares"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := fmt.Sprint(elems), "[0 1 4 9 16]"; got != want {
+		t.Errorf("Elements(squares) = %s, want %s", got, want)
+	}
+
+	var keys []string
+	iter := skylark.Iterate(globals["evens"])
+	var x skylark.Value
+	for iter.Next(&x) {
+		keys = append(keys, x.String())
+	}
+	iter.Done()
+	if got, want := strings.Join(keys, " "), "0 2 4 6 8"; got != want {
+		t.Errorf("keys of evens = %s, want %s", got, want)
+	}
+
+	if _, err := skylark.Elements(skylark.MakeInt(1)); err == nil {
+		t.Errorf("Elements(1) succeeded unexpectedly")
+	} else if got, want := err.Error(), "int value is not iterable"; got != want {
+		t.Errorf("Elements(1) failed with %q, want %q", got, want)
+	}
+
+	// A list may not be modified while the host iterates over it.
+	list := skylark.NewList([]skylark.Value{skylark.MakeInt(1)})
+	iter = skylark.Iterate(list)
+	if err := list.Append(skylark.MakeInt(2)); err == nil {
+		t.Errorf("Append during iteration succeeded unexpectedly")
+	} else if got, want := err.Error(), "cannot append to list during iteration"; got != want {
+		t.Errorf("Append during iteration failed with %q, want %q", got, want)
+	}
+	iter.Done()
+	if err := list.Append(skylark.MakeInt(2)); err != nil {
+		t.Errorf("Append after iteration failed: %v", err)
+	}
+}
+
+func TestBuiltinPanic(t *testing.T) {
+	const src = `
+def f():
+  return oops(1)
+
+f()
+`
+	oops := skylark.NewBuiltin("oops", func(thread *skylark.Thread, fn *skylark.Builtin, args skylark.Tuple, kwargs []skylark.Tuple) (skylark.Value, error) {
+		var m map[string]int
+		m["x"] = 1 // panics
+		return skylark.None, nil
+	})
+	thread := new(skylark.Thread)
+	thread.RecordCalls()
+	globals := skylark.StringDict{"oops": oops}
+	err := skylark.ExecFile(thread, "panic.sky", src, globals)
+	evalErr, ok := err.(*skylark.EvalError)
+	if !ok {
+		t.Fatalf("ExecFile returned %v, want EvalError", err)
+	}
+	if got, want := evalErr.Error(), "internal error: panic in oops: assignment to entry in nil map"; got != want {
+		t.Errorf("ExecFile failed with %q, want %q", got, want)
+	}
+	if got, want := evalErr.Backtrace(), "panic.sky:3:14: in f"; !strings.Contains(got, want) {
+		t.Errorf("backtrace %q does not contain %q", got, want)
+	}
+
+	// The thread remains usable: its stack is empty,
+	// and later built-in calls are still recorded.
+	if depth := thread.CallStackDepth(); depth != 0 {
+		t.Errorf("after panic, CallStackDepth = %d, want 0", depth)
+	}
+	if err := skylark.ExecFile(thread, "after.sky", `x = len("abc")`, skylark.StringDict{}); err != nil {
+		t.Fatal(err)
+	}
+	if calls := thread.RecordedCalls(); len(calls) != 1 || calls[0].Name != "len" {
+		t.Errorf("after panic, recorded calls = %v, want [len]", calls)
+	}
+
+	// A panic in a built-in called directly by the application is also recovered.
+	if _, err := skylark.Call(thread, oops, nil, nil); err == nil || err.Error() != "internal error: panic in oops: assignment to entry in nil map" {
+		t.Errorf("Call of panicking builtin returned %v", err)
+	}
+}
+
+func TestDelStmt(t *testing.T) {
+	for _, test := range []struct{ src, want string }{
+		{`d = {"a": 1, "b": 2, "c": 3}; del d["b"]; x = d`, `{"a": 1, "c": 3}`},
+		{`l = [1, 2, 3, 4]; del l[1]; del l[-1]; x = l`, `[1, 3]`},
+		{`x = {"a": {"b": [1, 2]}}; del x["a"]["b"][0]`, `{"a": {"b": [2]}}`},
+		{`d = {}; del d["a"]`, `key "a" not in dict`},
+		{`d = {1: 2}; del d[[]]`, `unhashable type: list`},
+		{`l = [1]; del l[1]`, `list index 1 out of range [0:1]`},
+		{`l = [1]; del l[-2]`, `list index -2 out of range [0:1]`},
+		{`l = [1]; del l["a"]`, `got string, want int`},
+		{`t = (1, 2); del t[0]`, `tuple value does not support item deletion`},
+		{`
+l = [1, 2]
+def f():
+  for x in l:
+    del l[0]
+f()`, `cannot delete from list during iteration`},
+	} {
+		globals := make(skylark.StringDict)
+		opts := skylark.ExecOptions{
+			Thread:       new(skylark.Thread),
+			Filename:     "del.sky",
+			Source:       test.src,
+			Globals:      globals,
+			ParseOptions: syntax.ParseOptions{AllowDel: true},
+		}
+		var got string
+		if err := skylark.Exec(opts); err != nil {
+			got = err.Error()
+		} else {
+			got = globals["x"].String()
+		}
+		if got != test.want {
+			t.Errorf("Exec(%q) = %s, want %s", test.src, got, test.want)
+		}
+	}
+}
+
+func TestStringDict(t *testing.T) {
+	d := skylark.StringDict{"b": skylark.MakeInt(1), "a": skylark.MakeInt(2)}
+	clone := d.Clone()
+	clone.Merge(skylark.StringDict{"b": skylark.MakeInt(3), "c": skylark.True})
+	if got, want := strings.Join(clone.Keys(), " "), "a b c"; got != want {
+		t.Errorf("Keys() = %s, want %s", got, want)
+	}
+	if got, want := clone.String(), "{a: 2, b: 3, c: True}"; got != want {
+		t.Errorf("merged dict = %s, want %s", got, want)
+	}
+	// The original is unaffected by changes to its clone.
+	if got, want := d.String(), "{a: 2, b: 1}"; got != want {
+		t.Errorf("original dict = %s, want %s", got, want)
+	}
+	if !clone.Has("c") || d.Has("c") {
+		t.Errorf("Has(c): got %t for clone, %t for original", clone.Has("c"), d.Has("c"))
+	}
+}
+
+func TestRecursion(t *testing.T) {
+	resolve.AllowRecursion = true
+	defer func() { resolve.AllowRecursion = false }()
+
+	const src = `
+def fact(n):
+  if n < 2:
+    return 1
+  return n * fact(n - 1)
+
+x = fact(20)
+
+def forever(n):
+  return forever(n + 1)
+`
+	globals := make(skylark.StringDict)
+	thread := new(skylark.Thread)
+	if err := skylark.ExecFile(thread, "recursion.sky", src, globals); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := globals["x"].String(), "2432902008176640000"; got != want {
+		t.Errorf("fact(20) = %s, want %s", got, want)
+	}
+
+	// Unbounded recursion fails cleanly.
+	_, err := skylark.Call(thread, globals["forever"], skylark.Tuple{skylark.MakeInt(0)}, nil)
+	if want := "call stack depth exceeds 10000"; err == nil || !strings.Contains(err.Error(), want) {
+		t.Errorf("forever(0) returned error %v, want %q", err, want)
+	}
+}
+
+func TestProgram(t *testing.T) {
+	const src = `
+greeting = prefix + ", " + name
+size = len(greeting)
+`
+	isPredeclared := func(name string) bool { return name == "prefix" || name == "name" }
+	prog, err := skylark.CompileFile("greet.sky", src, isPredeclared, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := prog.Filename(), "greet.sky"; got != want {
+		t.Errorf("Filename() = %s, want %s", got, want)
+	}
+
+	// The same program runs in several environments.
+	for _, name := range []string{"world", "gopher"} {
+		predeclared := skylark.StringDict{
+			"prefix": skylark.String("hello"),
+			"name":   skylark.String(name),
+		}
+		globals, err := prog.Init(new(skylark.Thread), predeclared)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := globals["greeting"].String(), `"hello, `+name+`"`; got != want {
+			t.Errorf("greeting = %s, want %s", got, want)
+		}
+		if got, want := globals["size"].String(), fmt.Sprint(len("hello, ")+len(name)); got != want {
+			t.Errorf("size = %s, want %s", got, want)
+		}
+		if predeclared.Has("greeting") {
+			t.Errorf("Init modified the predeclared environment")
+		}
+	}
+
+	// Compilation reports resolver errors.
+	if _, err := skylark.CompileFile("bad.sky", "x = y", isPredeclared, nil); err == nil || err.Error() != "bad.sky:1:5: undefined: y" {
+		t.Errorf("CompileFile returned error %v, want undefined: y", err)
+	}
+
+	// A predeclared name missing at execution is a dynamic error.
+	_, err = prog.Init(new(skylark.Thread), skylark.StringDict{"prefix": skylark.String("hi")})
+	if want := "global variable name referenced before assignment"; err == nil || err.Error() != want {
+		t.Errorf("Init returned error %v, want %s", err, want)
+	}
+
+	// A program may be compiled for a thread with an extended Universe.
+	universe := skylark.Universe.Clone()
+	universe["double"] = skylark.NewBuiltin("double", func(thread *skylark.Thread, fn *skylark.Builtin, args skylark.Tuple, kwargs []skylark.Tuple) (skylark.Value, error) {
+		var x skylark.Value
+		if err := skylark.UnpackPositionalArgs("double", args, kwargs, 1, &x); err != nil {
+			return nil, err
+		}
+		return skylark.Binary(syntax.PLUS, x, x)
+	})
+	if _, err := skylark.CompileFile("double.sky", "x = double(21)", isPredeclared, nil); err == nil || err.Error() != "double.sky:1:5: undefined: double" {
+		t.Errorf("CompileFile returned error %v, want undefined: double", err)
+	}
+	prog, err = skylark.CompileFile("double.sky", "x = double(21)", isPredeclared, universe.Has)
+	if err != nil {
+		t.Fatal(err)
+	}
+	globals, err := prog.Init(&skylark.Thread{Universe: universe}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := globals["x"].String(), "42"; got != want {
+		t.Errorf("x = %s, want %s", got, want)
+	}
+}
+
+// BenchmarkProgram compares repeated execution of a file
+// with compiling it once and executing it repeatedly.
+func BenchmarkProgram(b *testing.B) {
+	filename := filepath.Join(skylarktest.DataFile("skylark", "."), "testdata/benchmark.sky")
+	src, err := ioutil.ReadFile(filename)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Run("ExecFile", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if err := skylark.ExecFile(new(skylark.Thread), filename, src, skylark.StringDict{}); err != nil {
+				reportEvalError(b, err)
+			}
+		}
+	})
+	b.Run("Program", func(b *testing.B) {
+		prog, err := skylark.CompileFile(filename, src, func(string) bool { return false }, nil)
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if _, err := prog.Init(new(skylark.Thread), nil); err != nil {
+				reportEvalError(b, err)
+			}
+		}
+	})
+}
+
+func TestMaxAllocs(t *testing.T) {
+	for _, test := range []struct {
+		src, want string
+	}{
+		{`x = "abc" * 10`, ""},
+		{`x = [1, 2] + [3] * 100`, ""},
+		{`x = "x" * 1000000`, "exceeded memory allowance"},
+		{`x = 1000000 * "x"`, "exceeded memory allowance"},
+		{`x = [0] * 1000000`, "exceeded memory allowance"},
+		{`x = (0,) * (1 << 62)`, "exceeded memory allowance"},
+		{`x = "x" * 1000; y = x + x + x + x + x`, "exceeded memory allowance"},
+		{`x = "x" * 1000; y = ",".join([x] * 10)`, "exceeded memory allowance"},
+		{`x = 2 ** 100`, ""},
+		{`x = 3 ** 100000`, "exceeded memory allowance"},
+		{`x = "abc".replace("b", "bbb")`, ""},
+		{`x = ("x" * 100).replace("x", "x" * 100)`, "replace: exceeded memory allowance"},
+		{`x = [i for i in range(10)]`, ""},
+		{`x = "" * 10**30`, ""},
+		{`x = [1] * -(10**30)`, ""},
+		{`x = 10**30 * ()`, ""},
+		{`x = [i for i in range(1000000)]`, "exceeded memory allowance"},
+		{`x = {i: i for i in range(1000000)}`, "exceeded memory allowance"},
+		{`x = []; x.extend(range(1000000))`, "extend: exceeded memory allowance"},
+		{`x = list(range(1000000))`, "list: exceeded memory allowance"},
+		{`x = tuple(range(1000000))`, "tuple: exceeded memory allowance"},
+		{`x = "x" * 100; y = "%s%s%s%s%s%s%s%s%s%s" % (x, x, x, x, x, x, x, x, x, x)`, ""},
+		{`x = "x" * 1000; y = "%s%s%s%s%s" % (x, x, x, x, x)`, "exceeded memory allowance"},
+		{`x = {i: i for i in range(10)}; y = x | x`, ""},
+		{`
+def f():
+  x = {}
+  for i in range(100):
+    x = x | {i: i}
+f()`, "exceeded memory allowance"},
+		{`
+def f():
+  x = []
+  for i in range(100):
+    x += [i] * 10
+f()`, "exceeded memory allowance"},
+	} {
+		thread := &skylark.Thread{AllowDictUnion: true}
+		thread.SetMaxAllocs(4000)
+		err := skylark.ExecFile(thread, "max.sky", test.src, skylark.StringDict{})
+		got := ""
+		if err != nil {
+			got = err.Error()
+		}
+		if !strings.Contains(got, test.want) || (test.want == "") != (got == "") {
+			t.Errorf("%s: got error %q, want %q", test.src, got, test.want)
+		}
+	}
+
+	// A rejected allocation is not charged to the thread.
+	thread := new(skylark.Thread)
+	thread.SetMaxAllocs(4000)
+	if err := skylark.ExecFile(thread, "max.sky", `x = "x" * 10**30`, skylark.StringDict{}); err == nil {
+		t.Errorf("huge allocation succeeded unexpectedly")
+	}
+	if err := skylark.ExecFile(thread, "max.sky", `x = "x" * 10`, skylark.StringDict{}); err != nil {
+		t.Errorf("after rejected allocation: %v", err)
+	}
+
+	// A zero limit means no limit.
+	thread = new(skylark.Thread)
+	if err := skylark.ExecFile(thread, "max.sky", `x = "x" * 1000000`, skylark.StringDict{}); err != nil {
+		t.Errorf("without limit: %v", err)
+	}
+}
+
+func TestDictUnionOption(t *testing.T) {
+	thread := new(skylark.Thread)
+	err := skylark.ExecFile(thread, "union.sky", `x = {"a": 1} | {"b": 2}`, skylark.StringDict{})
+	if err == nil || !strings.Contains(err.Error(), "unknown binary op: dict | dict") {
+		t.Errorf("dict | dict without option: got error %v", err)
+	}
+
+	// The option is a property of the thread, not of the Binary function.
+	if _, err := skylark.Binary(syntax.PIPE, new(skylark.Dict), new(skylark.Dict)); err != nil {
+		t.Errorf("Binary(dict | dict): %v", err)
+	}
+	globals := skylark.StringDict{}
+	if err := skylark.ExecFile(&skylark.Thread{AllowDictUnion: true}, "union.sky", `x = {"a": 1} | {"b": 2}`, globals); err != nil {
+		t.Errorf("dict | dict with option: %v", err)
+	} else if got, want := globals["x"].String(), `{"a": 1, "b": 2}`; got != want {
+		t.Errorf("dict | dict = %s, want %s", got, want)
+	}
+
+	// dict + dict is unaffected by the option.
+	if err := skylark.ExecFile(thread, "union.sky", `x = {"a": 1} + {"b": 2}`, skylark.StringDict{}); err != nil {
+		t.Errorf("dict + dict: %v", err)
+	}
+}
+
+func TestEvalErrorCaretString(t *testing.T) {
+	const src = `
+def f(x):
+	return x + "s"
+
+f(1)
+`
+	thread := new(skylark.Thread)
+	err := skylark.ExecFile(thread, "caret.sky", src, skylark.StringDict{})
+	evalErr, ok := err.(*skylark.EvalError)
+	if !ok {
+		t.Fatalf("ExecFile returned %v, want EvalError", err)
+	}
+	got := evalErr.CaretString([]byte(src))
+	want := "caret.sky:3:11: unknown binary op: int + string\n\treturn x + \"s\"\n\t         ^"
+	if got != want {
+		t.Errorf("CaretString: got\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestLongElifChain(t *testing.T) {
+	const n = 500
+	var buf bytes.Buffer
+	buf.WriteString("def f(x):\n  if x == 0:\n    return 0\n")
+	for i := 1; i < n; i++ {
+		fmt.Fprintf(&buf, "  elif x == %d:\n    return %d\n", i, i*i)
+	}
+	buf.WriteString("  else:\n    return -1\n")
+	buf.WriteString("results = [f(0), f(1), f(250), f(499), f(500)]\n")
+
+	thread := new(skylark.Thread)
+	globals := skylark.StringDict{}
+	if err := skylark.ExecFile(thread, "elif.sky", buf.Bytes(), globals); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := globals["results"].String(), "[0, 1, 62500, 249001, -1]"; got != want {
+		t.Errorf("results = %s, want %s", got, want)
+	}
+}
+
+func TestTimeNow(t *testing.T) {
+	thread := new(skylark.Thread)
+	globals := skylark.StringDict{"time": skylarktime.Module}
+
+	// Without a stub, time.now reports the host's clock.
+	before := time.Now()
+	if err := skylark.ExecFile(thread, "now.sky", "t = time.now()", globals); err != nil {
+		t.Fatal(err)
+	}
+	after := time.Now()
+	if got := time.Time(globals["t"].(skylarktime.Time)); got.Before(before) || got.After(after) {
+		t.Errorf("time.now() = %v, want between %v and %v", got, before, after)
+	}
+
+	// A stubbed clock is consulted on each call.
+	clock := time.Unix(0, 0)
+	skylarktime.SetNow(thread, func() time.Time {
+		clock = clock.Add(time.Second)
+		return clock
+	})
+	globals = skylark.StringDict{"time": skylarktime.Module}
+	if err := skylark.ExecFile(thread, "now.sky", "d = time.now() - time.now()", globals); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := globals["d"].String(), "-1s"; got != want {
+		t.Errorf("d = %s, want %s", got, want)
+	}
+}
+
+// A goMapping is an IterableMapping backed by a Go map.
+// Its values are computed on demand, and it records each lookup.
+type goMapping struct {
+	m       map[string]int
+	lookups *[]string
+}
+
+func (m goMapping) String() string        { return "goMapping" }
+func (m goMapping) Type() string          { return "goMapping" }
+func (m goMapping) Freeze()               {}
+func (m goMapping) Truth() skylark.Bool   { return len(m.m) > 0 }
+func (m goMapping) Hash() (uint32, error) { return 0, fmt.Errorf("unhashable: goMapping") }
+
+func (m goMapping) Get(k skylark.Value) (skylark.Value, bool, error) {
+	s, ok := k.(skylark.String)
+	if !ok {
+		return nil, false, fmt.Errorf("goMapping key must be a string, not %s", k.Type())
+	}
+	*m.lookups = append(*m.lookups, string(s))
+	v, found := m.m[string(s)]
+	if !found {
+		return nil, false, nil
+	}
+	return skylark.MakeInt(v * 10), true, nil
+}
+
+func (m goMapping) keys() []string {
+	var keys []string
+	for k := range m.m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (m goMapping) Iterate() skylark.Iterator {
+	var elems []skylark.Value
+	for _, k := range m.keys() {
+		elems = append(elems, skylark.String(k))
+	}
+	return skylark.Tuple(elems).Iterate()
+}
+
+func (m goMapping) Items() []skylark.Tuple {
+	var items []skylark.Tuple
+	for _, k := range m.keys() {
+		items = append(items, skylark.Tuple{skylark.String(k), skylark.MakeInt(m.m[k] * 10)})
+	}
+	return items
+}
+
+func TestIterableMapping(t *testing.T) {
+	var lookups []string
+	m := goMapping{map[string]int{"b": 2, "a": 1}, &lookups}
+	const src = `
+a = m["a"]
+has = ["a" in m, "z" in m]
+keys = [k for k in m]
+d = dict(m)
+e = {"c": 3}
+e.update(m)
+def f(**kwargs):
+  return kwargs
+kw = f(**m)
+s = "%(a)d-%(b)d" % m
+`
+	thread := new(skylark.Thread)
+	globals := skylark.StringDict{"m": m}
+	if err := skylark.ExecFile(thread, "mapping.sky", src, globals); err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct{ name, want string }{
+		{"a", "10"},
+		{"has", "[True, False]"},
+		{"keys", `["a", "b"]`},
+		{"d", `{"a": 10, "b": 20}`},
+		{"e", `{"c": 3, "a": 10, "b": 20}`},
+		{"kw", `{"a": 10, "b": 20}`},
+		{"s", `"10-20"`},
+	} {
+		if got := globals[test.name].String(); got != test.want {
+			t.Errorf("%s = %s, want %s", test.name, got, test.want)
+		}
+	}
+	if got, want := strings.Join(lookups, " "), "a a z a b"; got != want {
+		t.Errorf("lookups = %s, want %s", got, want)
+	}
+
+	// errors
+	for _, test := range []struct{ src, want string }{
+		{`m["z"]`, `key "z" not in goMapping`},
+		{`m[1]`, `goMapping key must be a string, not int`},
+	} {
+		_, err := skylark.Eval(thread, "mapping.sky", test.src, skylark.StringDict{"m": m})
+		if err == nil || err.Error() != test.want {
+			t.Errorf("%s: got error %v, want %s", test.src, err, test.want)
+		}
+	}
+}
@@ -26,7 +26,7 @@ squares = [x*x for x in range(10)]
 `
 
 	thread := &skylark.Thread{
-		Print: func(_ *skylark.Thread, msg string) { fmt.Println(msg) },
+		Print: func(_ *skylark.Thread, msg string) { fmt.Print(msg) },
 	}
 	globals := skylark.StringDict{
 		"greeting": skylark.String("hello"),
@@ -39,13 +39,8 @@ squares = [x*x for x in range(10)]
 	}
 
 	// Print the global environment.
-	var names []string
-	for name := range globals {
-		names = append(names, name)
-	}
-	sort.Strings(names)
 	fmt.Println("\nGlobals:")
-	for _, name := range names {
+	for _, name := range globals.Keys() {
 		v := globals[name]
 		fmt.Printf("%s (%s) = %s\n", name, v.Type(), v.String())
 	}
@@ -234,7 +229,7 @@ func (c *cache) get(cc *cycleChecker, module string) (skylark.StringDict, error)
 
 func (c *cache) doLoad(cc *cycleChecker, module string) (skylark.StringDict, error) {
 	thread := &skylark.Thread{
-		Print: func(_ *skylark.Thread, msg string) { fmt.Println(msg) },
+		Print: func(_ *skylark.Thread, msg string) { fmt.Print(msg) },
 		Load: func(_ *skylark.Thread, module string) (skylark.StringDict, error) {
 			// Tunnel the cycle-checker state for this "thread of loading".
 			return c.get(cc, module)
@@ -0,0 +1,230 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package skylark
+
+import (
+	"fmt"
+	"unicode/utf8"
+)
+
+// A globPattern is a compiled file-path glob pattern.
+//
+// In a pattern, '*' matches any sequence of characters other than '/',
+// and '?' matches any single character other than '/'.
+// A character class such as "[a-z_]" matches any single character other
+// than '/' in the class; the class is negated if it begins with '!' or '^'.
+// The sequence "**" matches any sequence of characters, including '/';
+// "**/" additionally matches the empty string, so "a/**/b" matches "a/b".
+// A backslash causes the following character to be matched literally.
+// The empty pattern matches only the empty string.
+type globPattern struct {
+	elems []globElem
+}
+
+type globElemKind uint8
+
+const (
+	globLiteral    globElemKind = iota // the rune r
+	globAny                            // ?
+	globStar                           // *
+	globStarStar                       // **
+	globStarStarSl                     // **/
+	globClass                          // [...]
+)
+
+type globElem struct {
+	kind   globElemKind
+	r      rune      // for globLiteral
+	ranges [][2]rune // for globClass: inclusive ranges
+	negate bool      // for globClass
+}
+
+// compileGlob parses a glob pattern.
+func compileGlob(pattern string) (*globPattern, error) {
+	var elems []globElem
+	for i := 0; i < len(pattern); {
+		r, size := utf8.DecodeRuneInString(pattern[i:])
+		i += size
+		switch r {
+		case '?':
+			elems = append(elems, globElem{kind: globAny})
+		case '*':
+			if i < len(pattern) && pattern[i] == '*' {
+				i++
+				if i < len(pattern) && pattern[i] == '/' {
+					i++
+					elems = append(elems, globElem{kind: globStarStarSl})
+				} else {
+					elems = append(elems, globElem{kind: globStarStar})
+				}
+			} else {
+				elems = append(elems, globElem{kind: globStar})
+			}
+		case '[':
+			elem, n, err := compileGlobClass(pattern[i:])
+			if err != nil {
+				return nil, err
+			}
+			i += n
+			elems = append(elems, elem)
+		case '\\':
+			if i == len(pattern) {
+				return nil, fmt.Errorf("invalid glob pattern: trailing backslash")
+			}
+			r, size = utf8.DecodeRuneInString(pattern[i:])
+			i += size
+			elems = append(elems, globElem{kind: globLiteral, r: r})
+		default:
+			elems = append(elems, globElem{kind: globLiteral, r: r})
+		}
+	}
+	return &globPattern{elems}, nil
+}
+
+// compileGlobClass parses the portion of a character class following
+// its opening '['. It returns the class and the number of bytes consumed,
+// including the closing ']'.
+func compileGlobClass(s string) (globElem, int, error) {
+	elem := globElem{kind: globClass}
+	i := 0
+	if i < len(s) && (s[i] == '!' || s[i] == '^') {
+		elem.negate = true
+		i++
+	}
+	// next reads one possibly escaped rune of the class.
+	next := func() (rune, error) {
+		if i < len(s) && s[i] == '\\' {
+			i++
+		}
+		if i == len(s) {
+			return 0, fmt.Errorf("invalid glob pattern: unterminated [")
+		}
+		r, size := utf8.DecodeRuneInString(s[i:])
+		i += size
+		return r, nil
+	}
+	for first := true; ; first = false {
+		if i == len(s) {
+			return elem, 0, fmt.Errorf("invalid glob pattern: unterminated [")
+		}
+		if s[i] == ']' && !first {
+			i++
+			break
+		}
+		lo, err := next()
+		if err != nil {
+			return elem, 0, err
+		}
+		hi := lo
+		if i+1 < len(s) && s[i] == '-' && s[i+1] != ']' {
+			i++ // '-'
+			if hi, err = next(); err != nil {
+				return elem, 0, err
+			}
+			if hi < lo {
+				return elem, 0, fmt.Errorf("invalid glob pattern: bad range %c-%c", lo, hi)
+			}
+		}
+		elem.ranges = append(elem.ranges, [2]rune{lo, hi})
+	}
+	return elem, i, nil
+}
+
+func (elem *globElem) matchClass(r rune) bool {
+	for _, rng := range elem.ranges {
+		if rng[0] <= r && r <= rng[1] {
+			return !elem.negate
+		}
+	}
+	return elem.negate
+}
+
+// match reports whether s matches the pattern.
+//
+// It simulates the pattern as a nondeterministic automaton whose
+// states are the positions between pattern elements, scanning s once
+// and tracking the set of states reachable after each character.
+// Matching takes time proportional to the product of the lengths of
+// the pattern and of s, and space proportional to the length of the
+// pattern alone, whatever the length of s.
+func (p *globPattern) match(s string) bool {
+	// cur[i] records whether state i, in which elems[:i] have been
+	// matched, is reachable (atElem), and whether elems[i], a "**/",
+	// has matched a non-empty prefix of the rest of s not yet ending
+	// in '/' (inSlash).
+	n := len(p.elems)
+	cur := make([]uint8, n+1)
+	next := make([]uint8, n+1)
+	cur[0] = atElem
+	p.closure(cur)
+	for _, r := range s {
+		for i := range next {
+			next[i] = 0
+		}
+		for i, st := range cur[:n] {
+			if st == 0 {
+				continue
+			}
+			elem := &p.elems[i]
+			if st&inSlash != 0 {
+				next[i] |= inSlash
+				if r == '/' {
+					next[i+1] |= atElem
+				}
+			}
+			if st&atElem == 0 {
+				continue
+			}
+			switch elem.kind {
+			case globLiteral:
+				if r == elem.r {
+					next[i+1] |= atElem
+				}
+			case globAny:
+				if r != '/' {
+					next[i+1] |= atElem
+				}
+			case globClass:
+				if r != '/' && elem.matchClass(r) {
+					next[i+1] |= atElem
+				}
+			case globStar:
+				if r != '/' {
+					next[i] |= atElem
+				}
+			case globStarStar:
+				next[i] |= atElem
+			case globStarStarSl:
+				next[i] |= inSlash
+				if r == '/' {
+					next[i+1] |= atElem
+				}
+			}
+		}
+		p.closure(next)
+		cur, next = next, cur
+	}
+	return cur[n]&atElem != 0
+}
+
+// States of a position in the automaton of a glob pattern; see match.
+const (
+	atElem  = 1 << iota // the elements before the position have been matched
+	inSlash             // the "**/" at the position is partway through its match
+)
+
+// closure adds to states those reachable without consuming input,
+// by matching a star with the empty string.
+func (p *globPattern) closure(states []uint8) {
+	for i := range p.elems {
+		if states[i]&atElem == 0 {
+			continue
+		}
+		switch p.elems[i].kind {
+		case globStar, globStarStar, globStarStarSl:
+			states[i+1] |= atElem
+		}
+	}
+}
@@ -33,6 +33,24 @@ type entry struct {
 	prevLink   **entry // address of link to this entry (perhaps &head)
 }
 
+// init allocates enough buckets for the table to hold size
+// entries without growing.
+func (ht *hashtable) init(size int) {
+	if size < 0 {
+		panic("size < 0")
+	}
+	nb := 1
+	for overloaded(size, nb) {
+		nb = nb << 1
+	}
+	if nb < 2 {
+		ht.table = ht.bucket0[:1]
+	} else {
+		ht.table = make([]bucket, nb)
+	}
+	ht.tailLink = &ht.head
+}
+
 func (ht *hashtable) freeze() {
 	if !ht.frozen {
 		ht.frozen = true
@@ -54,12 +72,8 @@ func (ht *hashtable) insert(k, v Value) error {
 	if ht.frozen {
 		return fmt.Errorf("cannot insert into frozen hash table")
 	}
-	if ht.itercount > 0 {
-		return fmt.Errorf("cannot insert into hash table during iteration")
-	}
 	if ht.table == nil {
-		ht.table = ht.bucket0[:1]
-		ht.tailLink = &ht.head
+		ht.init(1)
 	}
 	h, err := k.Hash()
 	if err != nil {
@@ -101,6 +115,12 @@ retry:
 
 	// Key not found.  p points to the last bucket.
 
+	// Updating the value of an existing key is permitted
+	// during iteration, but adding a new one is not.
+	if ht.itercount > 0 {
+		return fmt.Errorf("cannot insert into hash table during iteration")
+	}
+
 	// Does the number of elements exceed the buckets' load factor?
 	if overloaded(int(ht.len), len(ht.table)) {
 		ht.grow()
@@ -331,9 +351,10 @@ func (it *keyIterator) Done() {
 	}
 }
 
-// hashString computes the FNV hash of s.
+// hashString computes the 32-bit FNV-1a hash of s.
+// The result does not vary from run to run.
 func hashString(s string) uint32 {
-	var h uint32
+	var h uint32 = 2166136261
 	for i := 0; i < len(s); i++ {
 		h ^= uint32(s[i])
 		h *= 16777619
@@ -75,3 +75,78 @@ func testHashtable(tb testing.TB, sane map[int]bool) {
 		}
 	}
 }
+
+func TestNewDict(t *testing.T) {
+	for _, size := range []int{0, 1, 8, 9, 100, 1000} {
+		d := NewDict(size)
+		buckets := len(d.ht.table)
+		for i := 0; i < size; i++ {
+			if err := d.Set(MakeInt(i), MakeInt(i*i)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if len(d.ht.table) != buckets {
+			t.Errorf("NewDict(%d): table grew from %d to %d buckets", size, buckets, len(d.ht.table))
+		}
+		if d.Len() != size {
+			t.Errorf("NewDict(%d): Len = %d", size, d.Len())
+		}
+		for i, k := range d.Keys() {
+			v, _, _ := d.Get(k)
+			if eqk, _ := Equal(k, MakeInt(i)); !eqk {
+				t.Errorf("NewDict(%d): entry %d has key %v", size, i, k)
+				break
+			}
+			if eqv, _ := Equal(v, MakeInt(i*i)); !eqv {
+				t.Errorf("NewDict(%d): entry %d has value %v", size, i, v)
+				break
+			}
+		}
+	}
+}
+
+func BenchmarkDictInsert(b *testing.B) {
+	const n = 10000
+	keys := make([]Value, n)
+	for i := range keys {
+		keys[i] = MakeInt(i)
+	}
+	for _, test := range []struct {
+		name    string
+		newDict func() *Dict
+	}{
+		{"new", func() *Dict { return new(Dict) }},
+		{"NewDict", func() *Dict { return NewDict(n) }},
+	} {
+		b.Run(test.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				d := test.newDict()
+				for _, k := range keys {
+					d.Set(k, None)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkListAppend(b *testing.B) {
+	const n = 10000
+	for _, test := range []struct {
+		name    string
+		newList func() *List
+	}{
+		{"empty", func() *List { return NewList(nil) }},
+		{"preallocated", func() *List { return NewList(make([]Value, 0, n)) }},
+	} {
+		b.Run(test.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				l := test.newList()
+				for j := 0; j < n; j++ {
+					l.Append(None)
+				}
+			}
+		})
+	}
+}
@@ -43,6 +43,15 @@ func MakeUint64(x uint64) Int {
 	return Int{new(big.Int).SetUint64(uint64(x))}
 }
 
+// MakeBigInt returns a Skylark int for the specified big.Int.
+// The caller must not subsequently modify x.
+func MakeBigInt(x *big.Int) Int {
+	if x.IsInt64() {
+		return MakeInt64(x.Int64()) // share small ints
+	}
+	return Int{x}
+}
+
 var (
 	smallint   [256]big.Int
 	smallintok bool
@@ -140,6 +149,14 @@ func (x Int) Sub(y Int) Int { return Int{new(big.Int).Sub(x.bigint, y.bigint)} }
 func (x Int) Mul(y Int) Int { return Int{new(big.Int).Mul(x.bigint, y.bigint)} }
 func (x Int) Or(y Int) Int  { return Int{new(big.Int).Or(x.bigint, y.bigint)} }
 func (x Int) And(y Int) Int { return Int{new(big.Int).And(x.bigint, y.bigint)} }
+func (x Int) Xor(y Int) Int { return Int{new(big.Int).Xor(x.bigint, y.bigint)} }
+
+func (x Int) Not() Int       { return Int{new(big.Int).Not(x.bigint)} }
+func (x Int) Lsh(n uint) Int { return Int{new(big.Int).Lsh(x.bigint, n)} }
+func (x Int) Rsh(n uint) Int { return Int{new(big.Int).Rsh(x.bigint, n)} }
+
+// Exp returns x ** y. y must not be negative.
+func (x Int) Exp(y Int) Int { return Int{new(big.Int).Exp(x.bigint, y.bigint, nil)} }
 
 // Precondition: y is nonzero.
 func (x Int) Div(y Int) Int {
@@ -13,11 +13,13 @@ import (
 	"bytes"
 	"fmt"
 	"log"
+	"math"
 	"math/big"
 	"os"
 	"sort"
 	"strconv"
 	"strings"
+	"time"
 	"unicode"
 	"unicode/utf8"
 
@@ -27,7 +29,9 @@ import (
 // Universe defines the set of universal built-ins, such as None, True, and len.
 //
 // The Go application may add or remove items from the
-// universe dictionary before Skylark evaluation begins.
+// universe dictionary before Skylark evaluation begins,
+// or provide a different set of built-ins to each thread
+// using the Thread.Universe field.
 // All values in the dictionary must be immutable.
 // Skylark programs cannot modify the dictionary.
 var Universe StringDict
@@ -35,42 +39,102 @@ var Universe StringDict
 func init() {
 	// See https://bazel.build/versions/master/docs/skylark/lib/globals.html#XYZ
 	Universe = StringDict{
-		"None":      None,
-		"True":      True,
-		"False":     False,
-		"any":       NewBuiltin("any", any),
-		"all":       NewBuiltin("all", all),
-		"bool":      NewBuiltin("bool", bool_),
-		"chr":       NewBuiltin("chr", chr),
-		"cmp":       NewBuiltin("cmp", cmp),
-		"dict":      NewBuiltin("dict", dict),
-		"dir":       NewBuiltin("dir", dir),
-		"enumerate": NewBuiltin("enumerate", enumerate),
-		"float":     NewBuiltin("float", float),   // requires resolve.AllowFloat
-		"freeze":    NewBuiltin("freeze", freeze), // requires resolve.AllowFreeze
-		"getattr":   NewBuiltin("getattr", getattr),
-		"hasattr":   NewBuiltin("hasattr", hasattr),
-		"hash":      NewBuiltin("hash", hash),
-		"int":       NewBuiltin("int", int_),
-		"len":       NewBuiltin("len", len_),
-		"list":      NewBuiltin("list", list),
-		"max":       NewBuiltin("max", minmax),
-		"min":       NewBuiltin("min", minmax),
-		"ord":       NewBuiltin("ord", ord),
-		"print":     NewBuiltin("print", print),
-		"range":     NewBuiltin("range", range_),
-		"repr":      NewBuiltin("repr", repr),
-		"reversed":  NewBuiltin("reversed", reversed),
-		"set":       NewBuiltin("set", set), // requires resolve.AllowSet
-		"sorted":    NewBuiltin("sorted", sorted),
-		"str":       NewBuiltin("str", str),
-		"tuple":     NewBuiltin("tuple", tuple),
-		"type":      NewBuiltin("type", type_),
-		"zip":       NewBuiltin("zip", zip),
-	}
-}
-
-type builtinMethod func(fnname string, recv Value, args Tuple, kwargs []Tuple) (Value, error)
+		"None":              None,
+		"True":              True,
+		"False":             False,
+		"any":               NewBuiltin("any", any),
+		"all":               NewBuiltin("all", all),
+		"bool":              NewBuiltin("bool", bool_),
+		"chr":               NewBuiltin("chr", chr),
+		"cmp":               NewBuiltin("cmp", cmp),
+		"closest":           NewBuiltin("closest", closest),
+		"dict":              NewBuiltin("dict", dict),
+		"dir":               NewBuiltin("dir", dir),
+		"edit_distance":     NewBuiltin("edit_distance", edit_distance),
+		"enumerate":         NewBuiltin("enumerate", enumerate),
+		"float":             NewBuiltin("float", float),   // requires resolve.AllowFloat
+		"freeze":            NewBuiltin("freeze", freeze), // requires resolve.AllowFreeze
+		"getattr":           NewBuiltin("getattr", getattr),
+		"glob_match":        NewBuiltin("glob_match", glob_match),
+		"hasattr":           NewBuiltin("hasattr", hasattr),
+		"hash":              NewBuiltin("hash", hash),
+		"help":              NewBuiltin("help", help),
+		"int":               NewBuiltin("int", int_),
+		"len":               NewBuiltin("len", len_),
+		"list":              NewBuiltin("list", list),
+		"list_difference":   NewBuiltin("list_difference", listSetOp),
+		"list_intersection": NewBuiltin("list_intersection", listSetOp),
+		"list_union":        NewBuiltin("list_union", listSetOp),
+		"max":               NewBuiltin("max", minmax),
+		"memoize":           NewBuiltin("memoize", memoize),
+		"min":               NewBuiltin("min", minmax),
+		"ord":               NewBuiltin("ord", ord),
+		"print":             NewBuiltin("print", print),
+		"range":             NewBuiltin("range", range_),
+		"repr":              NewBuiltin("repr", repr),
+		"reversed":          NewBuiltin("reversed", reversed),
+		"set":               NewBuiltin("set", set), // requires resolve.AllowSet
+		"setattr":           NewBuiltin("setattr", setattr),
+		"sorted":            NewBuiltin("sorted", sorted),
+		"str":               NewBuiltin("str", str),
+		"sum":               NewBuiltin("sum", sum),
+		"timeout":           NewBuiltin("timeout", timeout),
+		"tuple":             NewBuiltin("tuple", tuple),
+		"type":              NewBuiltin("type", type_),
+		"zip":               NewBuiltin("zip", zip),
+	}
+	for name, doc := range universeDocs {
+		b := Universe[name].(*Builtin)
+		b.doc = doc
+	}
+}
+
+// universeDocs holds the documentation of each built-in function
+// in the Universe, as reported by help.
+var universeDocs = map[string]string{
+	"any":               "any(x) reports whether any element of the iterable sequence x is true.",
+	"all":               "all(x) reports whether all elements of the iterable sequence x are true.",
+	"bool":              "bool(x) interprets x as a Boolean value.",
+	"chr":               "chr(i) returns the string encoding the Unicode code point i.",
+	"cmp":               "cmp(x, y) returns -1, 0, or +1 according to whether x is less than, equal to, or greater than y.",
+	"closest":           "closest(s, candidates) returns the string among candidates with the least edit distance from s, or None.",
+	"dict":              "dict(pairs, **kwargs) creates a dictionary from an iterable of key/value pairs and keyword arguments.",
+	"dir":               "dir(x) returns a sorted list of the names of the attributes of x.",
+	"edit_distance":     "edit_distance(x, y) returns the Levenshtein distance between strings x and y.",
+	"enumerate":         "enumerate(x, start=0) returns a list of (index, value) pairs for the elements of the iterable sequence x, with indices counting from start.",
+	"float":             "float(x) interprets x as a floating-point number.",
+	"freeze":            "freeze(x) makes x, and everything reachable from it, immutable.",
+	"getattr":           "getattr(x, name) returns the value of the attribute of x with the specified name.",
+	"glob_match":        "glob_match(pattern, s) reports whether string s matches the glob pattern.",
+	"hasattr":           "hasattr(x, name) reports whether x has an attribute with the specified name.",
+	"hash":              "hash(x) returns an integer hash of x such that x == y implies hash(x) == hash(y).",
+	"help":              "help(f) returns the documentation of the function f.",
+	"int":               "int(x, base=10) interprets x as an integer.",
+	"len":               "len(x) returns the number of elements in x.",
+	"list":              "list(x) returns a new list containing the elements of the iterable sequence x.",
+	"list_difference":   "list_difference(x, y) returns the elements of list x that are not in list y.",
+	"list_intersection": "list_intersection(x, y) returns the elements of list x that are also in list y.",
+	"list_union":        "list_union(x, y) returns the elements of list x followed by those of list y not in x.",
+	"max":               "max(x, key=None) returns the greatest element of the iterable sequence x, or of the arguments.",
+	"memoize":           "memoize(fn, maxsize=0) returns a function like fn that caches its results, keyed by the arguments of each call.",
+	"min":               "min(x, key=None) returns the least element of the iterable sequence x, or of the arguments.",
+	"ord":               "ord(s) returns the Unicode code point encoded by the string s.",
+	"print":             "print(*args, sep=\" \", end=\"\\n\") prints its arguments.",
+	"range":             "range(start, stop, step) returns an immutable sequence of integers.",
+	"repr":              "repr(x) formats x as a string, quoting strings.",
+	"reversed":          "reversed(x) returns a new list containing the elements of the iterable sequence x in reverse order.",
+	"set":               "set(x) returns a new set containing the elements of the iterable sequence x.",
+	"setattr":           "setattr(x, name, value) sets the attribute of x with the specified name.",
+	"sorted":            "sorted(x, cmp=None, key=None, reverse=False) returns a new sorted list of the elements of x.",
+	"str":               "str(x) formats x as a string; a string is returned unchanged.",
+	"sum":               "sum(x, start=0) returns the sum of start and the elements of the iterable sequence x.",
+	"timeout":           "timeout(fn, seconds) calls fn() and returns its result, but fails if the call takes longer than the specified number of seconds.",
+	"tuple":             "tuple(x) returns a tuple containing the elements of the iterable sequence x.",
+	"type":              "type(x) returns a string describing the type of x.",
+	"zip":               "zip(*args) returns a list of tuples of corresponding elements of the iterable sequences args.",
+}
+
+type builtinMethod func(thread *Thread, fnname string, recv Value, args Tuple, kwargs []Tuple) (Value, error)
 
 // methods of built-in types
 var (
@@ -102,8 +166,10 @@ var (
 	stringMethods = map[string]builtinMethod{
 		"bytes":            string_iterable,
 		"capitalize":       string_capitalize,
+		"codepoint_ords":   string_iterable,
 		"codepoints":       string_iterable,
 		"count":            string_count,
+		"elems":            string_iterable,
 		"endswith":         string_endswith,
 		"find":             string_find,
 		"format":           string_format,
@@ -137,7 +203,15 @@ var (
 
 	// See https://bazel.build/versions/master/docs/skylark/lib/set.html.
 	setMethods = map[string]builtinMethod{
-		"union": set_union,
+		"add":                  set_add,
+		"clear":                set_clear,
+		"difference":           set_difference,
+		"discard":              set_discard,
+		"intersection":         set_intersection,
+		"pop":                  set_pop,
+		"remove":               set_remove,
+		"symmetric_difference": set_symmetric_difference,
+		"union":                set_union,
 	}
 )
 
@@ -163,7 +237,7 @@ func builtinAttr(recv Value, name string, methods map[string]builtinMethod) (Val
 
 	// Allocate a closure over 'method'.
 	impl := func(thread *Thread, b *Builtin, args Tuple, kwargs []Tuple) (Value, error) {
-		return method(b.Name(), b.Receiver(), args, kwargs)
+		return method(thread, b.Name(), b.Receiver(), args, kwargs)
 	}
 	return NewBuiltin(name, impl).BindReceiver(recv), nil
 }
@@ -347,7 +421,7 @@ func all(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, error)
 // See https://bazel.build/versions/master/docs/skylark/lib/globals.html#any
 func any(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, error) {
 	var iterable Iterable
-	if err := UnpackPositionalArgs("all", args, kwargs, 1, &iterable); err != nil {
+	if err := UnpackPositionalArgs("any", args, kwargs, 1, &iterable); err != nil {
 		return nil, err
 	}
 	iter := iterable.Iterate()
@@ -413,12 +487,49 @@ func cmp(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, error)
 	return zero, nil // x == y or one of the operands is NaN
 }
 
+// closest(s, candidates) returns the string among candidates
+// with the least edit distance from s, or None if there are no candidates.
+// Ties are resolved in favor of the earliest candidate.
+func closest(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, error) {
+	var s string
+	var candidates Iterable
+	if err := UnpackPositionalArgs("closest", args, kwargs, 2, &s, &candidates); err != nil {
+		return nil, err
+	}
+	iter := candidates.Iterate()
+	defer iter.Done()
+	var best Value = None
+	bestDist := -1
+	var x Value
+	for iter.Next(&x) {
+		c, ok := x.(String)
+		if !ok {
+			return nil, fmt.Errorf("closest: got %s candidate, want string", x.Type())
+		}
+		if d := editDistance(s, string(c)); bestDist < 0 || d < bestDist {
+			best, bestDist = c, d
+		}
+	}
+	return best, nil
+}
+
 // See https://bazel.build/versions/master/docs/skylark/lib/globals.html#dict
 func dict(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, error) {
 	if len(args) > 1 {
 		return nil, fmt.Errorf("dict: got %d arguments, want at most 1", len(args))
 	}
-	dict := new(Dict)
+	size := len(kwargs)
+	if len(args) == 1 {
+		// Preallocate only for mappings, whose length is the number of
+		// entries; other iterables are validated element by element.
+		if m, ok := args[0].(IterableMapping); ok {
+			if n := Len(m); n > 0 {
+				size += n
+			}
+		}
+	}
+	dict := NewDict(size)
+	dict.sortedRepr = thread.SortedDictRepr
 	if err := updateDict(dict, args, kwargs); err != nil {
 		return nil, fmt.Errorf("dict: %v", err)
 	}
@@ -436,7 +547,8 @@ func dir(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, error)
 
 	var names []string
 	if x, ok := args[0].(HasAttrs); ok {
-		names = x.AttrNames()
+		names = append(names, x.AttrNames()...)
+		sort.Strings(names)
 	}
 	elems := make([]Value, len(names))
 	for i, name := range names {
@@ -445,11 +557,58 @@ func dir(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, error)
 	return NewList(elems), nil
 }
 
+// edit_distance(a, b) returns the Levenshtein distance between strings a and b,
+// that is, the least number of single-character insertions, deletions,
+// and substitutions needed to transform one into the other.
+func edit_distance(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, error) {
+	var a, b string
+	if err := UnpackPositionalArgs("edit_distance", args, kwargs, 2, &a, &b); err != nil {
+		return nil, err
+	}
+	return MakeInt(editDistance(a, b)), nil
+}
+
+// editDistance returns the Levenshtein distance between a and b,
+// measured in Unicode code points.
+func editDistance(a, b string) int {
+	x, y := []rune(a), []rune(b)
+	if len(x) < len(y) {
+		x, y = y, x // keep the rows short
+	}
+	prev := make([]int, len(y)+1)
+	curr := make([]int, len(y)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := range x {
+		curr[0] = i + 1
+		for j := range y {
+			cost := 1
+			if x[i] == y[j] {
+				cost = 0
+			}
+			curr[j+1] = min3(prev[j+1]+1, curr[j]+1, prev[j]+cost)
+		}
+		prev, curr = curr, prev
+	}
+	return prev[len(y)]
+}
+
+func min3(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
+
 // See https://bazel.build/versions/master/docs/skylark/lib/globals.html#enumerate
 func enumerate(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, error) {
 	var iterable Iterable
 	var start int
-	if err := UnpackPositionalArgs("enumerate", args, kwargs, 1, &iterable, &start); err != nil {
+	if err := UnpackArgs("enumerate", args, kwargs, "iterable", &iterable, "start?", &start); err != nil {
 		return nil, err
 	}
 
@@ -542,7 +701,21 @@ func getattr(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, err
 	if dflt != nil {
 		return dflt, nil
 	}
-	return nil, fmt.Errorf("%s has no .%s field or method", object.Type(), name)
+	return nil, noSuchAttrError(object, name)
+}
+
+// glob_match(pattern, s) reports whether the string s matches the glob pattern.
+// See globPattern for the pattern syntax.
+func glob_match(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, error) {
+	var pattern, s string
+	if err := UnpackPositionalArgs("glob_match", args, kwargs, 2, &pattern, &s); err != nil {
+		return nil, err
+	}
+	p, err := compileGlob(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("glob_match: %v", err)
+	}
+	return Bool(p.match(s)), nil
 }
 
 // See https://bazel.build/versions/master/docs/skylark/lib/globals.html#hasattr
@@ -567,7 +740,29 @@ func hash(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, error)
 		return nil, err
 	}
 	h, err := x.Hash()
-	return MakeUint(uint(h)), err
+	if err != nil {
+		return nil, err
+	}
+	return MakeUint(uint(h)), nil
+}
+
+// help(f) returns the documentation of the function f: the documentation
+// of a built-in, or the docstring of a function defined in Skylark.
+func help(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, error) {
+	var f Value
+	if err := UnpackPositionalArgs("help", args, kwargs, 1, &f); err != nil {
+		return nil, err
+	}
+	var doc string
+	switch f := f.(type) {
+	case *Builtin:
+		doc = f.Doc()
+	case *Function:
+		doc = f.Doc()
+	default:
+		return nil, fmt.Errorf("help: got %s, want function", f.Type())
+	}
+	return String(doc), nil
 }
 
 // See https://bazel.build/versions/master/docs/skylark/lib/globals.html#int
@@ -589,7 +784,7 @@ func int_(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, error)
 			}
 		}
 
-		orig := s // save original for error message
+		orig, origBase := s, b // save originals for error message
 
 		if len(s) > 1 {
 			var sign string
@@ -611,6 +806,14 @@ func int_(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, error)
 						hasbase = 8
 					case 'x', 'X':
 						hasbase = 16
+					case 'b', 'B':
+						// Nor does it understand "0b101",
+						// so strip the prefix. In bases above 11,
+						// 'b' is a digit, e.g. int("0b1", 16).
+						if b == 0 || b == 2 {
+							s = sign + s[i+2:]
+							hasbase = 2
+						}
 					}
 
 					if hasbase != 0 && b != 0 {
@@ -624,6 +827,9 @@ func int_(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, error)
 						// if there's a base prefix.
 						b = 0
 					}
+					if hasbase == 2 {
+						b = 2 // prefix was stripped
+					}
 				}
 
 				// For automatic base detection,
@@ -646,7 +852,7 @@ func int_(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, error)
 		}
 
 	invalid:
-		return nil, fmt.Errorf("int: invalid literal with base %d: %s", b, orig)
+		return nil, fmt.Errorf("int: invalid literal with base %d: %s", origBase, orig)
 	}
 
 	if base != nil {
@@ -683,6 +889,9 @@ func list(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, error)
 		iter := iterable.Iterate()
 		defer iter.Done()
 		if n := Len(iterable); n > 0 {
+			if err := thread.CheckAllocs(int64(n) * valueSize); err != nil {
+				return nil, fmt.Errorf("list: %v", err)
+			}
 			elems = make([]Value, 0, n) // preallocate if length known
 		}
 		var x Value
@@ -693,6 +902,125 @@ func list(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, error)
 	return NewList(elems), nil
 }
 
+// listSetOp implements list_union, list_intersection, and list_difference.
+// Unlike the set operators, the result is a list whose elements appear
+// in the order they were first encountered, without duplicates.
+func listSetOp(thread *Thread, fn *Builtin, args Tuple, kwargs []Tuple) (Value, error) {
+	var a, b Iterable
+	if err := UnpackPositionalArgs(fn.Name(), args, kwargs, 2, &a, &b); err != nil {
+		return nil, err
+	}
+
+	// For intersection and difference, b is used only for membership tests.
+	var other *Set
+	if fn.Name() != "list_union" {
+		other = new(Set)
+		iter := b.Iterate()
+		defer iter.Done()
+		var x Value
+		for iter.Next(&x) {
+			if err := other.Insert(x); err != nil {
+				return nil, fmt.Errorf("%s: %v", fn.Name(), err)
+			}
+		}
+	}
+
+	var elems []Value
+	seen := new(Set)
+	add := func(iterable Iterable) error {
+		iter := iterable.Iterate()
+		defer iter.Done()
+		var x Value
+		for iter.Next(&x) {
+			if other != nil {
+				found, err := other.Has(x)
+				if err != nil {
+					return err
+				}
+				if found != (fn.Name() == "list_intersection") {
+					continue
+				}
+			}
+			if found, err := seen.Has(x); err != nil {
+				return err
+			} else if !found {
+				seen.Insert(x)
+				elems = append(elems, x)
+			}
+		}
+		return nil
+	}
+	if err := add(a); err != nil {
+		return nil, fmt.Errorf("%s: %v", fn.Name(), err)
+	}
+	if other == nil {
+		if err := add(b); err != nil {
+			return nil, fmt.Errorf("%s: %v", fn.Name(), err)
+		}
+	}
+	return NewList(elems), nil
+}
+
+// memoize(fn, maxsize=0) returns a function that behaves like fn but
+// caches its results, keyed by the arguments of each call.
+// The cache belongs to the calling thread and lasts for its lifetime.
+// If maxsize is positive, the cache holds at most that many results,
+// discarding the oldest first.  The cache holds a frozen copy of each
+// result, since it is shared by all later calls with equal arguments;
+// the result returned by the call that computed it is not frozen.
+// A result that cannot be copied, such as a value of an
+// application-defined type, is not cached.
+func memoize(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, error) {
+	var fn Callable
+	var maxsize int
+	if err := UnpackArgs("memoize", args, kwargs, "fn", &fn, "maxsize?", &maxsize); err != nil {
+		return nil, err
+	}
+	if maxsize < 0 {
+		return nil, fmt.Errorf("memoize: invalid maxsize %d", maxsize)
+	}
+	return NewBuiltin(fn.Name(), func(thread *Thread, wrapper *Builtin, args Tuple, kwargs []Tuple) (Value, error) {
+		// The key is (args, kwargs), copied since the caller may reuse args.
+		kvs := make(Tuple, len(kwargs))
+		for i, kv := range kwargs {
+			kvs[i] = kv
+		}
+		key := Tuple{append(Tuple(nil), args...), kvs}
+
+		cache := thread.memos[wrapper]
+		if cache == nil {
+			cache = new(Dict)
+			if thread.memos == nil {
+				thread.memos = make(map[*Builtin]*Dict)
+			}
+			thread.memos[wrapper] = cache
+		}
+		if result, found, err := cache.Get(key); err != nil {
+			return nil, fmt.Errorf("%s: cannot memoize call with unhashable arguments: %v", fn.Name(), err)
+		} else if found {
+			return result, nil
+		}
+
+		result, err := Call(thread, fn, args, kwargs)
+		if err != nil {
+			return nil, err
+		}
+		cached, err := Copy(result)
+		if err != nil {
+			return result, nil // not cacheable
+		}
+		if maxsize > 0 && cache.Len() >= maxsize {
+			oldest, _ := cache.ht.first()
+			cache.Delete(oldest)
+		}
+		cached.Freeze()
+		if err := cache.Set(key, cached); err != nil {
+			return nil, err
+		}
+		return result, nil
+	}), nil
+}
+
 // See https://bazel.build/versions/master/docs/skylark/lib/globals.html#min
 func minmax(thread *Thread, fn *Builtin, args Tuple, kwargs []Tuple) (Value, error) {
 	if len(args) == 0 {
@@ -782,20 +1110,43 @@ func ord(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, error)
 
 // See https://bazel.build/versions/master/docs/skylark/lib/globals.html#print
 func print(thread *Thread, fn *Builtin, args Tuple, kwargs []Tuple) (Value, error) {
+	// sep and end are treated specially, as in Python 3;
+	// other keyword arguments are printed as name=value.
+	sep, end := " ", "\n"
+	var rest []Tuple
+	for _, pair := range kwargs {
+		switch k := string(pair[0].(String)); k {
+		case "sep", "end":
+			s, ok := AsString(pair[1])
+			if !ok {
+				return nil, fmt.Errorf("print: for parameter %s: got %s, want string", k, pair[1].Type())
+			}
+			if k == "sep" {
+				sep = s
+			} else {
+				end = s
+			}
+		default:
+			rest = append(rest, pair)
+		}
+	}
+
 	var buf bytes.Buffer
 	path := make([]Value, 0, 4)
-	sep := ""
-	for _, v := range args {
-		buf.WriteString(sep)
+	for i, v := range args {
+		if i > 0 {
+			buf.WriteString(sep)
+		}
 		if s, ok := AsString(v); ok {
 			buf.WriteString(s)
 		} else {
 			writeValue(&buf, v, path)
 		}
-		sep = " "
 	}
-	for _, pair := range kwargs {
-		buf.WriteString(sep)
+	for i, pair := range rest {
+		if i > 0 || len(args) > 0 {
+			buf.WriteString(sep)
+		}
 		buf.WriteString(string(pair[0].(String)))
 		buf.WriteString("=")
 		if s, ok := AsString(pair[1]); ok {
@@ -803,13 +1154,13 @@ func print(thread *Thread, fn *Builtin, args Tuple, kwargs []Tuple) (Value, erro
 		} else {
 			writeValue(&buf, pair[1], path)
 		}
-		sep = " "
 	}
+	buf.WriteString(end)
 
 	if thread.Print != nil {
 		thread.Print(thread, buf.String())
 	} else {
-		fmt.Fprintln(os.Stderr, &buf)
+		os.Stderr.Write(buf.Bytes())
 	}
 	return None, nil
 }
@@ -821,34 +1172,131 @@ func range_(thread *Thread, fn *Builtin, args Tuple, kwargs []Tuple) (Value, err
 	if err := UnpackPositionalArgs("range", args, kwargs, 1, &start, &stop, &step); err != nil {
 		return nil, err
 	}
-	list := new(List)
-	switch len(args) {
-	case 1:
+	if len(args) == 1 {
 		// range(stop)
 		start, stop = 0, start
-		fallthrough
-	case 2:
-		// range(start, stop)
-		for i := start; i < stop; i += step {
-			list.elems = append(list.elems, MakeInt(i))
-		}
-	case 3:
-		// range(start, stop, step)
-		if step == 0 {
-			return nil, fmt.Errorf("range: step argument must not be zero")
-		}
-		if step > 0 {
-			for i := start; i < stop; i += step {
-				list.elems = append(list.elems, MakeInt(i))
-			}
-		} else {
-			for i := start; i >= stop; i += step {
-				list.elems = append(list.elems, MakeInt(i))
-			}
+	}
+	if step == 0 {
+		// we were given range(start, stop, 0)
+		return nil, fmt.Errorf("range: step argument must not be zero")
+	}
+	return rangeValue{start: start, stop: stop, step: step, len: rangeLen(start, stop, step)}, nil
+}
+
+// A rangeValue is a comparable, immutable, indexable sequence of integers
+// defined by the three parameters to a range(...) call.
+// Invariant: step != 0.
+type rangeValue struct{ start, stop, step, len int }
+
+var (
+	_ Indexable  = rangeValue{}
+	_ Sequence   = rangeValue{}
+	_ Comparable = rangeValue{}
+)
+
+func (r rangeValue) Len() int          { return r.len }
+func (r rangeValue) Index(i int) Value { return MakeInt(r.start + i*r.step) }
+func (r rangeValue) Iterate() Iterator { return &rangeIterator{r, 0} }
+func (r rangeValue) Freeze()           {} // immutable
+func (r rangeValue) Type() string      { return "range" }
+func (r rangeValue) Truth() Bool       { return r.len > 0 }
+
+// Hash is consistent with equality: ranges that denote
+// the same sequence of integers have the same hash.
+func (r rangeValue) Hash() (uint32, error) {
+	switch r.len {
+	case 0:
+		return Tuple{MakeInt(0)}.Hash()
+	case 1:
+		return Tuple{MakeInt(1), MakeInt(r.start)}.Hash()
+	}
+	return Tuple{MakeInt(r.len), MakeInt(r.start), MakeInt(r.step)}.Hash()
+}
+
+func (r rangeValue) String() string {
+	if r.step != 1 {
+		return fmt.Sprintf("range(%d, %d, %d)", r.start, r.stop, r.step)
+	} else if r.start != 0 {
+		return fmt.Sprintf("range(%d, %d)", r.start, r.stop)
+	} else {
+		return fmt.Sprintf("range(%d)", r.stop)
+	}
+}
+
+func (x rangeValue) CompareSameType(op syntax.Token, y_ Value, depth int) (bool, error) {
+	y := y_.(rangeValue)
+	switch op {
+	case syntax.EQL:
+		return rangeEqual(x, y), nil
+	case syntax.NEQ:
+		return !rangeEqual(x, y), nil
+	default:
+		return false, fmt.Errorf("%s %s %s not implemented", x.Type(), op, y.Type())
+	}
+}
+
+// rangeEqual reports whether x and y denote the same sequence of integers.
+func rangeEqual(x, y rangeValue) bool {
+	if x.len != y.len {
+		return false
+	}
+	switch x.len {
+	case 0:
+		return true
+	case 1:
+		return x.start == y.start
+	}
+	return x.start == y.start && x.step == y.step
+}
+
+// contains reports whether x is an element of the range, in constant time.
+func (r rangeValue) contains(x Int) bool {
+	i, err := AsInt32(x)
+	if err != nil {
+		return false // out of range of any rangeValue
+	}
+	if r.step > 0 {
+		if i < r.start || i >= r.stop {
+			return false
+		}
+	} else {
+		if i > r.start || i <= r.stop {
+			return false
 		}
 	}
-	return list, nil
+	return (i-r.start)%r.step == 0
+}
+
+// rangeLen calculates the length of a range with the provided start, stop, and step.
+// caller must ensure that step is non-zero.
+func rangeLen(start, stop, step int) int {
+	switch {
+	case step > 0:
+		if stop > start {
+			return (stop-1-start)/step + 1
+		}
+	case step < 0:
+		if start > stop {
+			return (start-1-stop)/-step + 1
+		}
+	}
+	return 0
+}
+
+type rangeIterator struct {
+	r rangeValue
+	i int
+}
+
+func (it *rangeIterator) Next(p *Value) bool {
+	if it.i < it.r.len {
+		*p = it.r.Index(it.i)
+		it.i++
+		return true
+	}
+	return false
 }
+func (*rangeIterator) Done() {}
 
 // See https://bazel.build/versions/master/docs/skylark/lib/globals.html#repr
 func repr(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, error) {
@@ -865,19 +1313,14 @@ func reversed(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, er
 	if err := UnpackPositionalArgs("reversed", args, kwargs, 1, &iterable); err != nil {
 		return nil, err
 	}
-	iter := iterable.Iterate()
-	defer iter.Done()
-	var elems []Value
-	if n := Len(args[0]); n >= 0 {
-		elems = make([]Value, 0, n) // preallocate if length known
-	}
-	var x Value
-	for iter.Next(&x) {
-		elems = append(elems, x)
+	seq, ok := iterable.(Indexable)
+	if !ok {
+		return nil, fmt.Errorf("reversed: got %s, want sequence", iterable.Type())
 	}
-	n := len(elems)
-	for i := 0; i < n>>1; i++ {
-		elems[i], elems[n-1-i] = elems[n-1-i], elems[i]
+	n := seq.Len()
+	elems := make([]Value, n)
+	for i := range elems {
+		elems[i] = seq.Index(n - 1 - i)
 	}
 	return NewList(elems), nil
 }
@@ -888,7 +1331,7 @@ func set(thread *Thread, fn *Builtin, args Tuple, kwargs []Tuple) (Value, error)
 	if err := UnpackPositionalArgs("set", args, kwargs, 0, &iterable); err != nil {
 		return nil, err
 	}
-	set := new(Set)
+	set := &Set{sorted: thread.SortedSets}
 	if iterable != nil {
 		iter := iterable.Iterate()
 		defer iter.Done()
@@ -902,14 +1345,32 @@ func set(thread *Thread, fn *Builtin, args Tuple, kwargs []Tuple) (Value, error)
 	return set, nil
 }
 
+// setattr(x, name, value) sets the field of x named name, like x.name = value.
+func setattr(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, error) {
+	var object, value Value
+	var name string
+	if err := UnpackPositionalArgs("setattr", args, kwargs, 3, &object, &name, &value); err != nil {
+		return nil, err
+	}
+	x, ok := object.(HasSetField)
+	if !ok {
+		return nil, fmt.Errorf("setattr: can't assign to .%s field of %s", name, object.Type())
+	}
+	if err := x.SetField(name, value); err != nil {
+		return nil, fmt.Errorf("setattr: %v", err)
+	}
+	return None, nil
+}
+
 // See https://bazel.build/versions/master/docs/skylark/lib/globals.html#sorted
 func sorted(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, error) {
 	var iterable Iterable
-	var cmp Callable
+	var cmp, key Callable
 	var reverse bool
 	if err := UnpackArgs("sorted", args, kwargs,
 		"iterable", &iterable,
 		"cmp?", &cmp,
+		"key?", &key,
 		"reverse?", &reverse,
 	); err != nil {
 		return nil, err
@@ -925,32 +1386,57 @@ func sorted(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, erro
 	for iter.Next(&x) {
 		elems = append(elems, x)
 	}
-	slice := &sortSlice{thread: thread, elems: elems, cmp: cmp}
-	if reverse {
-		sort.Sort(sort.Reverse(slice))
-	} else {
-		sort.Sort(slice)
+
+	// Compute each element's key once, not once per comparison.
+	var keys []Value
+	if key != nil {
+		keys = make([]Value, len(elems))
+		for i, elem := range elems {
+			k, err := Call(thread, key, Tuple{elem}, nil)
+			if err != nil {
+				return nil, err
+			}
+			keys[i] = k
+		}
+	}
+
+	slice := &sortSlice{thread: thread, elems: elems, keys: keys, cmp: cmp, reverse: reverse}
+	sort.Stable(slice) // elements with equal keys retain their order, even if reversed
+	if slice.err != nil {
+		return nil, slice.err
 	}
-	return NewList(slice.elems), slice.err
+	return NewList(slice.elems), nil
 }
 
 type sortSlice struct {
-	thread *Thread
-	elems  []Value
-	cmp    Callable
-	err    error
-	pair   [2]Value
+	thread  *Thread
+	elems   []Value
+	keys    []Value // the sort keys, or nil if there is no key function
+	cmp     Callable
+	reverse bool
+	err     error
+	pair    [2]Value
 }
 
 func (s *sortSlice) Len() int { return len(s.elems) }
 func (s *sortSlice) Less(i, j int) bool {
+	if s.err != nil {
+		return false // abandon the sort after the first error
+	}
 	x, y := s.elems[i], s.elems[j]
+	if s.keys != nil {
+		x, y = s.keys[i], s.keys[j]
+	}
+	if s.reverse {
+		x, y = y, x
+	}
 	if s.cmp != nil {
-		// Strange things will happen if cmp fails, or returns a non-int.
+		// Strange things will happen if cmp returns a non-int.
 		s.pair[0], s.pair[1] = x, y // avoid allocation
 		res, err := Call(s.thread, s.cmp, Tuple(s.pair[:]), nil)
 		if err != nil {
 			s.err = err
+			return false
 		}
 		cmp, ok := res.(Int)
 		return ok && cmp.Sign() < 0
@@ -964,6 +1450,9 @@ func (s *sortSlice) Less(i, j int) bool {
 }
 func (s *sortSlice) Swap(i, j int) {
 	s.elems[i], s.elems[j] = s.elems[j], s.elems[i]
+	if s.keys != nil {
+		s.keys[i], s.keys[j] = s.keys[j], s.keys[i]
+	}
 }
 
 // See https://bazel.build/versions/master/docs/skylark/lib/globals.html#str
@@ -981,6 +1470,74 @@ func str(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, error)
 	return x, nil
 }
 
+// sum(iterable, start=0) returns the sum of start and the elements of iterable.
+func sum(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, error) {
+	var iterable Iterable
+	var start Value = MakeInt(0)
+	if err := UnpackArgs("sum", args, kwargs, "iterable", &iterable, "start?", &start); err != nil {
+		return nil, err
+	}
+	if _, ok := start.(String); ok {
+		return nil, fmt.Errorf("sum: can't sum strings (use ''.join(seq) instead)")
+	}
+	iter := iterable.Iterate()
+	defer iter.Done()
+	result := start
+	var x Value
+	for iter.Next(&x) {
+		var err error
+		result, err = Binary(syntax.PLUS, result, x)
+		if err != nil {
+			return nil, fmt.Errorf("sum: %v", err)
+		}
+	}
+	return result, nil
+}
+
+// timeout(fn, seconds) calls fn() and returns its result, but fails if
+// the call has not completed within the specified number of seconds.
+// The deadline of the call is never later than any deadline already in
+// effect, so an enclosing timeout or Thread.SetDeadline still applies.
+func timeout(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, error) {
+	var fn Callable
+	var seconds Value
+	if err := UnpackPositionalArgs("timeout", args, kwargs, 2, &fn, &seconds); err != nil {
+		return nil, err
+	}
+	secs, ok := AsFloat(seconds)
+	if !ok {
+		return nil, fmt.Errorf("timeout: got %s for seconds, want int or float", seconds.Type())
+	}
+	if !(secs >= 0) {
+		return nil, fmt.Errorf("timeout: invalid duration %s", seconds)
+	}
+	if max := float64(math.MaxInt64 / time.Second); secs > max {
+		secs = max // a longer time.Duration would overflow
+	}
+
+	outer := thread.deadline
+	deadline := time.Now().Add(time.Duration(secs * float64(time.Second)))
+	if !outer.IsZero() && outer.Before(deadline) {
+		deadline = outer // the enclosing deadline is sooner
+	}
+	result, err := callWithDeadline(thread, deadline, fn)
+
+	// A failure due to an enclosing deadline is not reported as ours.
+	if err != nil && deadline != outer && thread.expired == deadline {
+		return nil, fmt.Errorf("timeout: %s did not complete within %s seconds", fn.Name(), seconds)
+	}
+	return result, err
+}
+
+// callWithDeadline calls fn() with the thread's deadline temporarily
+// set to deadline.  The previous deadline is restored even if fn panics.
+func callWithDeadline(thread *Thread, deadline time.Time, fn Callable) (Value, error) {
+	outer := thread.deadline
+	thread.deadline = deadline
+	defer func() { thread.deadline = outer }()
+	return Call(thread, fn, nil, nil)
+}
+
 // See https://bazel.build/versions/master/docs/skylark/lib/globals.html#tuple
 func tuple(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, error) {
 	var iterable Iterable
@@ -994,6 +1551,9 @@ func tuple(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, error
 	defer iter.Done()
 	var elems Tuple
 	if n := Len(iterable); n > 0 {
+		if err := thread.CheckAllocs(int64(n) * valueSize); err != nil {
+			return nil, fmt.Errorf("tuple: %v", err)
+		}
 		elems = make(Tuple, 0, n) // preallocate if length is known
 	}
 	var x Value
@@ -1052,7 +1612,7 @@ func zip(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, error)
 // ---- methods of built-in types ---
 
 // https://docs.python.org/2/library/stdtypes.html#dict.get
-func dict_get(fnname string, recv Value, args Tuple, kwargs []Tuple) (Value, error) {
+func dict_get(thread *Thread, fnname string, recv Value, args Tuple, kwargs []Tuple) (Value, error) {
 	var key, dflt Value
 	if err := UnpackPositionalArgs(fnname, args, kwargs, 1, &key, &dflt); err != nil {
 		return nil, err
@@ -1069,7 +1629,7 @@ func dict_get(fnname string, recv Value, args Tuple, kwargs []Tuple) (Value, err
 }
 
 // https://docs.python.org/2/library/stdtypes.html#dict.clear
-func dict_clear(fnname string, recv Value, args Tuple, kwargs []Tuple) (Value, error) {
+func dict_clear(thread *Thread, fnname string, recv Value, args Tuple, kwargs []Tuple) (Value, error) {
 	if err := UnpackPositionalArgs(fnname, args, kwargs, 0); err != nil {
 		return nil, err
 	}
@@ -1077,7 +1637,7 @@ func dict_clear(fnname string, recv Value, args Tuple, kwargs []Tuple) (Value, e
 }
 
 // https://docs.python.org/2/library/stdtypes.html#dict.items
-func dict_items(fnname string, recv Value, args Tuple, kwargs []Tuple) (Value, error) {
+func dict_items(thread *Thread, fnname string, recv Value, args Tuple, kwargs []Tuple) (Value, error) {
 	if err := UnpackPositionalArgs(fnname, args, kwargs, 0); err != nil {
 		return nil, err
 	}
@@ -1090,7 +1650,7 @@ func dict_items(fnname string, recv Value, args Tuple, kwargs []Tuple) (Value, e
 }
 
 // https://docs.python.org/2/library/stdtypes.html#dict.keys
-func dict_keys(fnname string, recv Value, args Tuple, kwargs []Tuple) (Value, error) {
+func dict_keys(thread *Thread, fnname string, recv Value, args Tuple, kwargs []Tuple) (Value, error) {
 	if err := UnpackPositionalArgs(fnname, args, kwargs, 0); err != nil {
 		return nil, err
 	}
@@ -1098,7 +1658,7 @@ func dict_keys(fnname string, recv Value, args Tuple, kwargs []Tuple) (Value, er
 }
 
 // https://docs.python.org/2/library/stdtypes.html#dict.pop
-func dict_pop(fnname string, recv_ Value, args Tuple, kwargs []Tuple) (Value, error) {
+func dict_pop(thread *Thread, fnname string, recv_ Value, args Tuple, kwargs []Tuple) (Value, error) {
 	recv := recv_.(*Dict)
 	var k, d Value
 	if err := UnpackPositionalArgs(fnname, args, kwargs, 1, &k, &d); err != nil {
@@ -1116,7 +1676,7 @@ func dict_pop(fnname string, recv_ Value, args Tuple, kwargs []Tuple) (Value, er
 }
 
 // https://docs.python.org/2/library/stdtypes.html#dict.popitem
-func dict_popitem(fnname string, recv_ Value, args Tuple, kwargs []Tuple) (Value, error) {
+func dict_popitem(thread *Thread, fnname string, recv_ Value, args Tuple, kwargs []Tuple) (Value, error) {
 	if err := UnpackPositionalArgs(fnname, args, kwargs, 0); err != nil {
 		return nil, err
 	}
@@ -1133,7 +1693,7 @@ func dict_popitem(fnname string, recv_ Value, args Tuple, kwargs []Tuple) (Value
 }
 
 // https://docs.python.org/2/library/stdtypes.html#dict.setdefault
-func dict_setdefault(fnname string, recv Value, args Tuple, kwargs []Tuple) (Value, error) {
+func dict_setdefault(thread *Thread, fnname string, recv Value, args Tuple, kwargs []Tuple) (Value, error) {
 	var key, dflt Value = nil, None
 	if err := UnpackPositionalArgs(fnname, args, kwargs, 1, &key, &dflt); err != nil {
 		return nil, err
@@ -1149,7 +1709,7 @@ func dict_setdefault(fnname string, recv Value, args Tuple, kwargs []Tuple) (Val
 }
 
 // https://docs.python.org/2/library/stdtypes.html#dict.update
-func dict_update(fnname string, recv Value, args Tuple, kwargs []Tuple) (Value, error) {
+func dict_update(thread *Thread, fnname string, recv Value, args Tuple, kwargs []Tuple) (Value, error) {
 	if len(args) > 1 {
 		return nil, fmt.Errorf("update: got %d arguments, want at most 1", len(args))
 	}
@@ -1159,8 +1719,8 @@ func dict_update(fnname string, recv Value, args Tuple, kwargs []Tuple) (Value,
 	return None, nil
 }
 
-// https://docs.python.org/2/library/stdtypes.html#dict.update
-func dict_values(fnname string, recv Value, args Tuple, kwargs []Tuple) (Value, error) {
+// https://docs.python.org/2/library/stdtypes.html#dict.values
+func dict_values(thread *Thread, fnname string, recv Value, args Tuple, kwargs []Tuple) (Value, error) {
 	if err := UnpackPositionalArgs(fnname, args, kwargs, 0); err != nil {
 		return nil, err
 	}
@@ -1173,7 +1733,7 @@ func dict_values(fnname string, recv Value, args Tuple, kwargs []Tuple) (Value,
 }
 
 // https://docs.python.org/2/library/stdtypes.html#list.append
-func list_append(fnname string, recv_ Value, args Tuple, kwargs []Tuple) (Value, error) {
+func list_append(thread *Thread, fnname string, recv_ Value, args Tuple, kwargs []Tuple) (Value, error) {
 	recv := recv_.(*List)
 	var object Value
 	if err := UnpackPositionalArgs(fnname, args, kwargs, 1, &object); err != nil {
@@ -1187,7 +1747,7 @@ func list_append(fnname string, recv_ Value, args Tuple, kwargs []Tuple) (Value,
 }
 
 // https://docs.python.org/2/library/stdtypes.html#list.clear
-func list_clear(fnname string, recv_ Value, args Tuple, kwargs []Tuple) (Value, error) {
+func list_clear(thread *Thread, fnname string, recv_ Value, args Tuple, kwargs []Tuple) (Value, error) {
 	if err := UnpackPositionalArgs(fnname, args, kwargs, 0); err != nil {
 		return nil, err
 	}
@@ -1195,7 +1755,7 @@ func list_clear(fnname string, recv_ Value, args Tuple, kwargs []Tuple) (Value,
 }
 
 // https://docs.python.org/2/library/stdtypes.html#list.extend
-func list_extend(fnname string, recv_ Value, args Tuple, kwargs []Tuple) (Value, error) {
+func list_extend(thread *Thread, fnname string, recv_ Value, args Tuple, kwargs []Tuple) (Value, error) {
 	recv := recv_.(*List)
 	var iterable Iterable
 	if err := UnpackPositionalArgs(fnname, args, kwargs, 1, &iterable); err != nil {
@@ -1204,12 +1764,17 @@ func list_extend(fnname string, recv_ Value, args Tuple, kwargs []Tuple) (Value,
 	if err := recv.checkMutable("extend", true); err != nil {
 		return nil, err
 	}
+	if n := Len(iterable); n > 0 {
+		if err := thread.CheckAllocs(int64(n) * valueSize); err != nil {
+			return nil, fmt.Errorf("%s: %v", fnname, err)
+		}
+	}
 	listExtend(recv, iterable)
 	return None, nil
 }
 
 // https://docs.python.org/2/library/stdtypes.html#list.index
-func list_index(fnname string, recv_ Value, args Tuple, kwargs []Tuple) (Value, error) {
+func list_index(thread *Thread, fnname string, recv_ Value, args Tuple, kwargs []Tuple) (Value, error) {
 	recv := recv_.(*List)
 	var value, start_, end_ Value
 	if err := UnpackPositionalArgs(fnname, args, kwargs, 1, &value, &start_, &end_); err != nil {
@@ -1232,7 +1797,7 @@ func list_index(fnname string, recv_ Value, args Tuple, kwargs []Tuple) (Value,
 }
 
 // https://docs.python.org/2/library/stdtypes.html#list.insert
-func list_insert(fnname string, recv_ Value, args Tuple, kwargs []Tuple) (Value, error) {
+func list_insert(thread *Thread, fnname string, recv_ Value, args Tuple, kwargs []Tuple) (Value, error) {
 	recv := recv_.(*List)
 	var index int
 	var object Value
@@ -1262,7 +1827,7 @@ func list_insert(fnname string, recv_ Value, args Tuple, kwargs []Tuple) (Value,
 }
 
 // https://docs.python.org/2/library/stdtypes.html#list.remove
-func list_remove(fnname string, recv_ Value, args Tuple, kwargs []Tuple) (Value, error) {
+func list_remove(thread *Thread, fnname string, recv_ Value, args Tuple, kwargs []Tuple) (Value, error) {
 	recv := recv_.(*List)
 	var value Value
 	if err := UnpackPositionalArgs(fnname, args, kwargs, 1, &value); err != nil {
@@ -1283,14 +1848,18 @@ func list_remove(fnname string, recv_ Value, args Tuple, kwargs []Tuple) (Value,
 }
 
 // https://docs.python.org/2/library/stdtypes.html#list.pop
-func list_pop(fnname string, recv Value, args Tuple, kwargs []Tuple) (Value, error) {
+func list_pop(thread *Thread, fnname string, recv Value, args Tuple, kwargs []Tuple) (Value, error) {
 	list := recv.(*List)
-	index := list.Len() - 1
-	if err := UnpackPositionalArgs(fnname, args, kwargs, 0, &index); err != nil {
+	orig := list.Len() - 1
+	if err := UnpackPositionalArgs(fnname, args, kwargs, 0, &orig); err != nil {
 		return nil, err
 	}
+	index := orig
+	if index < 0 {
+		index += list.Len()
+	}
 	if index < 0 || index >= list.Len() {
-		return nil, fmt.Errorf("pop: index %d is out of range [0:%d]", index, list.Len())
+		return nil, fmt.Errorf("pop: index %d is out of range [0:%d]", orig, list.Len())
 	}
 	if err := list.checkMutable("pop from", true); err != nil {
 		return nil, err
@@ -1301,7 +1870,7 @@ func list_pop(fnname string, recv Value, args Tuple, kwargs []Tuple) (Value, err
 }
 
 // https://docs.python.org/2/library/stdtypes.html#str.capitalize
-func string_capitalize(fnname string, recv Value, args Tuple, kwargs []Tuple) (Value, error) {
+func string_capitalize(thread *Thread, fnname string, recv Value, args Tuple, kwargs []Tuple) (Value, error) {
 	if err := UnpackPositionalArgs(fnname, args, kwargs, 0); err != nil {
 		return nil, err
 	}
@@ -1309,23 +1878,30 @@ func string_capitalize(fnname string, recv Value, args Tuple, kwargs []Tuple) (V
 }
 
 // string_iterable returns an unspecified iterable value whose iterator yields:
-// - bytes: numeric values of successive bytes
-// - codepoints: numeric values of successive Unicode code points
+// - bytes, elems: numeric values of successive bytes
+// - codepoints, codepoint_ords: numeric values of successive Unicode code points
 // - split_bytes: successive 1-byte substrings
 // - split_codepoints: successive substrings that encode a single Unicode code point.
-func string_iterable(fnname string, recv Value, args Tuple, kwargs []Tuple) (Value, error) {
+func string_iterable(thread *Thread, fnname string, recv Value, args Tuple, kwargs []Tuple) (Value, error) {
 	if err := UnpackPositionalArgs(fnname, args, kwargs, 0); err != nil {
 		return nil, err
 	}
-	return stringIterable{
-		s:          recv.(String),
-		split:      fnname[0] == 's',
-		codepoints: fnname[len(fnname)-2] == 't',
-	}, nil
+	si := stringIterable{s: recv.(String), method: fnname}
+	switch fnname {
+	case "bytes", "elems":
+	case "codepoints", "codepoint_ords":
+		si.codepoints = true
+	case "split_bytes":
+		si.split = true
+	case "split_codepoints":
+		si.split = true
+		si.codepoints = true
+	}
+	return si, nil
 }
 
 // https://docs.python.org/2/library/stdtypes.html#str.count
-func string_count(fnname string, recv_ Value, args Tuple, kwargs []Tuple) (Value, error) {
+func string_count(thread *Thread, fnname string, recv_ Value, args Tuple, kwargs []Tuple) (Value, error) {
 	recv := string(recv_.(String))
 
 	var sub string
@@ -1347,7 +1923,7 @@ func string_count(fnname string, recv_ Value, args Tuple, kwargs []Tuple) (Value
 }
 
 // https://docs.python.org/2/library/stdtypes.html#str.endswith
-func string_endswith(fnname string, recv_ Value, args Tuple, kwargs []Tuple) (Value, error) {
+func string_endswith(thread *Thread, fnname string, recv_ Value, args Tuple, kwargs []Tuple) (Value, error) {
 	recv := string(recv_.(String))
 	var suffix string
 	if err := UnpackPositionalArgs(fnname, args, kwargs, 1, &suffix); err != nil {
@@ -1357,7 +1933,7 @@ func string_endswith(fnname string, recv_ Value, args Tuple, kwargs []Tuple) (Va
 }
 
 // https://docs.python.org/2/library/stdtypes.html#str.isalnum
-func string_isalnum(fnname string, recv_ Value, args Tuple, kwargs []Tuple) (Value, error) {
+func string_isalnum(thread *Thread, fnname string, recv_ Value, args Tuple, kwargs []Tuple) (Value, error) {
 	if err := UnpackPositionalArgs(fnname, args, kwargs, 0); err != nil {
 		return nil, err
 	}
@@ -1371,7 +1947,7 @@ func string_isalnum(fnname string, recv_ Value, args Tuple, kwargs []Tuple) (Val
 }
 
 // https://docs.python.org/2/library/stdtypes.html#str.isalpha
-func string_isalpha(fnname string, recv_ Value, args Tuple, kwargs []Tuple) (Value, error) {
+func string_isalpha(thread *Thread, fnname string, recv_ Value, args Tuple, kwargs []Tuple) (Value, error) {
 	if err := UnpackPositionalArgs(fnname, args, kwargs, 0); err != nil {
 		return nil, err
 	}
@@ -1385,7 +1961,7 @@ func string_isalpha(fnname string, recv_ Value, args Tuple, kwargs []Tuple) (Val
 }
 
 // https://docs.python.org/2/library/stdtypes.html#str.isdigit
-func string_isdigit(fnname string, recv_ Value, args Tuple, kwargs []Tuple) (Value, error) {
+func string_isdigit(thread *Thread, fnname string, recv_ Value, args Tuple, kwargs []Tuple) (Value, error) {
 	if err := UnpackPositionalArgs(fnname, args, kwargs, 0); err != nil {
 		return nil, err
 	}
@@ -1399,7 +1975,7 @@ func string_isdigit(fnname string, recv_ Value, args Tuple, kwargs []Tuple) (Val
 }
 
 // https://docs.python.org/2/library/stdtypes.html#str.islower
-func string_islower(fnname string, recv_ Value, args Tuple, kwargs []Tuple) (Value, error) {
+func string_islower(thread *Thread, fnname string, recv_ Value, args Tuple, kwargs []Tuple) (Value, error) {
 	if err := UnpackPositionalArgs(fnname, args, kwargs, 0); err != nil {
 		return nil, err
 	}
@@ -1418,7 +1994,7 @@ func isCasedString(s string) bool {
 }
 
 // https://docs.python.org/2/library/stdtypes.html#str.isspace
-func string_isspace(fnname string, recv_ Value, args Tuple, kwargs []Tuple) (Value, error) {
+func string_isspace(thread *Thread, fnname string, recv_ Value, args Tuple, kwargs []Tuple) (Value, error) {
 	if err := UnpackPositionalArgs(fnname, args, kwargs, 0); err != nil {
 		return nil, err
 	}
@@ -1432,7 +2008,7 @@ func string_isspace(fnname string, recv_ Value, args Tuple, kwargs []Tuple) (Val
 }
 
 // https://docs.python.org/2/library/stdtypes.html#str.istitle
-func string_istitle(fnname string, recv_ Value, args Tuple, kwargs []Tuple) (Value, error) {
+func string_istitle(thread *Thread, fnname string, recv_ Value, args Tuple, kwargs []Tuple) (Value, error) {
 	if err := UnpackPositionalArgs(fnname, args, kwargs, 0); err != nil {
 		return nil, err
 	}
@@ -1463,7 +2039,7 @@ func string_istitle(fnname string, recv_ Value, args Tuple, kwargs []Tuple) (Val
 }
 
 // https://docs.python.org/2/library/stdtypes.html#str.isupper
-func string_isupper(fnname string, recv_ Value, args Tuple, kwargs []Tuple) (Value, error) {
+func string_isupper(thread *Thread, fnname string, recv_ Value, args Tuple, kwargs []Tuple) (Value, error) {
 	if err := UnpackPositionalArgs(fnname, args, kwargs, 0); err != nil {
 		return nil, err
 	}
@@ -1472,12 +2048,12 @@ func string_isupper(fnname string, recv_ Value, args Tuple, kwargs []Tuple) (Val
 }
 
 // https://docs.python.org/2/library/stdtypes.html#str.find
-func string_find(fnname string, recv Value, args Tuple, kwargs []Tuple) (Value, error) {
+func string_find(thread *Thread, fnname string, recv Value, args Tuple, kwargs []Tuple) (Value, error) {
 	return string_find_impl(fnname, string(recv.(String)), args, kwargs, true, false)
 }
 
 // https://docs.python.org/2/library/stdtypes.html#str.format
-func string_format(fnname string, recv_ Value, args Tuple, kwargs []Tuple) (Value, error) {
+func string_format(thread *Thread, fnname string, recv_ Value, args Tuple, kwargs []Tuple) (Value, error) {
 	format := string(recv_.(String))
 	var auto, manual bool // kinds of positional indexing used
 	path := make([]Value, 0, 4)
@@ -1598,12 +2174,12 @@ func string_format(fnname string, recv_ Value, args Tuple, kwargs []Tuple) (Valu
 }
 
 // https://docs.python.org/2/library/stdtypes.html#str.index
-func string_index(fnname string, recv Value, args Tuple, kwargs []Tuple) (Value, error) {
+func string_index(thread *Thread, fnname string, recv Value, args Tuple, kwargs []Tuple) (Value, error) {
 	return string_find_impl(fnname, string(recv.(String)), args, kwargs, false, false)
 }
 
 // https://docs.python.org/2/library/stdtypes.html#str.join
-func string_join(fnname string, recv_ Value, args Tuple, kwargs []Tuple) (Value, error) {
+func string_join(thread *Thread, fnname string, recv_ Value, args Tuple, kwargs []Tuple) (Value, error) {
 	recv := string(recv_.(String))
 	var iterable Iterable
 	if err := UnpackPositionalArgs(fnname, args, kwargs, 1, &iterable); err != nil {
@@ -1614,20 +2190,25 @@ func string_join(fnname string, recv_ Value, args Tuple, kwargs []Tuple) (Value,
 	var buf bytes.Buffer
 	var x Value
 	for i := 0; iter.Next(&x); i++ {
+		s, ok := AsString(x)
+		if !ok {
+			return nil, fmt.Errorf("in list, want string, got %s", x.Type())
+		}
+		sep := ""
 		if i > 0 {
-			buf.WriteString(recv)
+			sep = recv
 		}
-		if s, ok := AsString(x); !ok {
-			return nil, fmt.Errorf("in list, want string, got %s", x.Type())
-		} else {
-			buf.WriteString(s)
+		if err := thread.CheckAllocs(int64(len(sep) + len(s))); err != nil {
+			return nil, err
 		}
+		buf.WriteString(sep)
+		buf.WriteString(s)
 	}
 	return String(buf.String()), nil
 }
 
 // https://docs.python.org/2/library/stdtypes.html#str.lower
-func string_lower(fnname string, recv Value, args Tuple, kwargs []Tuple) (Value, error) {
+func string_lower(thread *Thread, fnname string, recv Value, args Tuple, kwargs []Tuple) (Value, error) {
 	if err := UnpackPositionalArgs(fnname, args, kwargs, 0); err != nil {
 		return nil, err
 	}
@@ -1635,7 +2216,7 @@ func string_lower(fnname string, recv Value, args Tuple, kwargs []Tuple) (Value,
 }
 
 // https://docs.python.org/2/library/stdtypes.html#str.lstrip
-func string_lstrip(fnname string, recv Value, args Tuple, kwargs []Tuple) (Value, error) {
+func string_lstrip(thread *Thread, fnname string, recv Value, args Tuple, kwargs []Tuple) (Value, error) {
 	if err := UnpackPositionalArgs(fnname, args, kwargs, 0); err != nil {
 		return nil, err
 	}
@@ -1643,7 +2224,7 @@ func string_lstrip(fnname string, recv Value, args Tuple, kwargs []Tuple) (Value
 }
 
 // https://docs.python.org/2/library/stdtypes.html#str.partition
-func string_partition(fnname string, recv_ Value, args Tuple, kwargs []Tuple) (Value, error) {
+func string_partition(thread *Thread, fnname string, recv_ Value, args Tuple, kwargs []Tuple) (Value, error) {
 	recv := string(recv_.(String))
 	var sep string
 	if err := UnpackPositionalArgs(fnname, args, kwargs, 1, &sep); err != nil {
@@ -1672,28 +2253,37 @@ func string_partition(fnname string, recv_ Value, args Tuple, kwargs []Tuple) (V
 }
 
 // https://docs.python.org/2/library/stdtypes.html#str.replace
-func string_replace(fnname string, recv_ Value, args Tuple, kwargs []Tuple) (Value, error) {
+func string_replace(thread *Thread, fnname string, recv_ Value, args Tuple, kwargs []Tuple) (Value, error) {
 	recv := string(recv_.(String))
 	var old, new string
 	count := -1
 	if err := UnpackPositionalArgs(fnname, args, kwargs, 2, &old, &new, &count); err != nil {
 		return nil, err
 	}
+	if len(new) > len(old) {
+		n := strings.Count(recv, old)
+		if count >= 0 && count < n {
+			n = count
+		}
+		if err := thread.CheckAllocs(int64(len(recv)) + int64(n)*int64(len(new)-len(old))); err != nil {
+			return nil, fmt.Errorf("%s: %v", fnname, err)
+		}
+	}
 	return String(strings.Replace(recv, old, new, count)), nil
 }
 
 // https://docs.python.org/2/library/stdtypes.html#str.rfind
-func string_rfind(fnname string, recv Value, args Tuple, kwargs []Tuple) (Value, error) {
+func string_rfind(thread *Thread, fnname string, recv Value, args Tuple, kwargs []Tuple) (Value, error) {
 	return string_find_impl(fnname, string(recv.(String)), args, kwargs, true, true)
 }
 
 // https://docs.python.org/2/library/stdtypes.html#str.rindex
-func string_rindex(fnname string, recv Value, args Tuple, kwargs []Tuple) (Value, error) {
+func string_rindex(thread *Thread, fnname string, recv Value, args Tuple, kwargs []Tuple) (Value, error) {
 	return string_find_impl(fnname, string(recv.(String)), args, kwargs, false, true)
 }
 
 // https://docs.python.org/2/library/stdtypes.html#str.rstrip
-func string_rstrip(fnname string, recv Value, args Tuple, kwargs []Tuple) (Value, error) {
+func string_rstrip(thread *Thread, fnname string, recv Value, args Tuple, kwargs []Tuple) (Value, error) {
 	if err := UnpackPositionalArgs(fnname, args, kwargs, 0); err != nil {
 		return nil, err
 	}
@@ -1701,7 +2291,7 @@ func string_rstrip(fnname string, recv Value, args Tuple, kwargs []Tuple) (Value
 }
 
 // https://docs.python.org/2/library/stdtypes.html#str.startswith
-func string_startswith(fnname string, recv_ Value, args Tuple, kwargs []Tuple) (Value, error) {
+func string_startswith(thread *Thread, fnname string, recv_ Value, args Tuple, kwargs []Tuple) (Value, error) {
 	recv := string(recv_.(String))
 	var prefix string
 	if err := UnpackPositionalArgs(fnname, args, kwargs, 1, &prefix); err != nil {
@@ -1713,7 +2303,7 @@ func string_startswith(fnname string, recv_ Value, args Tuple, kwargs []Tuple) (
 // https://docs.python.org/2/library/stdtypes.html#str.strip
 // https://docs.python.org/2/library/stdtypes.html#str.lstrip
 // https://docs.python.org/2/library/stdtypes.html#str.rstrip
-func string_strip(fnname string, recv_ Value, args Tuple, kwargs []Tuple) (Value, error) {
+func string_strip(thread *Thread, fnname string, recv_ Value, args Tuple, kwargs []Tuple) (Value, error) {
 	var chars string
 	if err := UnpackPositionalArgs(fnname, args, kwargs, 0, &chars); err != nil {
 		return nil, err
@@ -1744,7 +2334,7 @@ func string_strip(fnname string, recv_ Value, args Tuple, kwargs []Tuple) (Value
 }
 
 // https://docs.python.org/2/library/stdtypes.html#str.title
-func string_title(fnname string, recv Value, args Tuple, kwargs []Tuple) (Value, error) {
+func string_title(thread *Thread, fnname string, recv Value, args Tuple, kwargs []Tuple) (Value, error) {
 	if err := UnpackPositionalArgs(fnname, args, kwargs, 0); err != nil {
 		return nil, err
 	}
@@ -1752,7 +2342,7 @@ func string_title(fnname string, recv Value, args Tuple, kwargs []Tuple) (Value,
 }
 
 // https://docs.python.org/2/library/stdtypes.html#str.upper
-func string_upper(fnname string, recv Value, args Tuple, kwargs []Tuple) (Value, error) {
+func string_upper(thread *Thread, fnname string, recv Value, args Tuple, kwargs []Tuple) (Value, error) {
 	if err := UnpackPositionalArgs(fnname, args, kwargs, 0); err != nil {
 		return nil, err
 	}
@@ -1761,7 +2351,7 @@ func string_upper(fnname string, recv Value, args Tuple, kwargs []Tuple) (Value,
 
 // https://docs.python.org/2/library/stdtypes.html#str.split
 // https://docs.python.org/2/library/stdtypes.html#str.rsplit
-func string_split(fnname string, recv_ Value, args Tuple, kwargs []Tuple) (Value, error) {
+func string_split(thread *Thread, fnname string, recv_ Value, args Tuple, kwargs []Tuple) (Value, error) {
 	recv := string(recv_.(String))
 	var sep_ Value
 	maxsplit := -1
@@ -1837,7 +2427,7 @@ func splitspace(s string, max int) []string {
 }
 
 // https://docs.python.org/2/library/stdtypes.html#str.splitlines
-func string_splitlines(fnname string, recv Value, args Tuple, kwargs []Tuple) (Value, error) {
+func string_splitlines(thread *Thread, fnname string, recv Value, args Tuple, kwargs []Tuple) (Value, error) {
 	var keepends bool
 	if err := UnpackPositionalArgs(fnname, args, kwargs, 0, &keepends); err != nil {
 		return nil, err
@@ -1860,19 +2450,102 @@ func string_splitlines(fnname string, recv Value, args Tuple, kwargs []Tuple) (V
 	return NewList(list), nil
 }
 
+// https://docs.python.org/2/library/stdtypes.html#set.add
+func set_add(thread *Thread, fnname string, recv Value, args Tuple, kwargs []Tuple) (Value, error) {
+	var elem Value
+	if err := UnpackPositionalArgs(fnname, args, kwargs, 1, &elem); err != nil {
+		return nil, err
+	}
+	if err := recv.(*Set).Insert(elem); err != nil {
+		return nil, fmt.Errorf("add: %v", err)
+	}
+	return None, nil
+}
+
+// https://docs.python.org/2/library/stdtypes.html#set.clear
+func set_clear(thread *Thread, fnname string, recv Value, args Tuple, kwargs []Tuple) (Value, error) {
+	if err := UnpackPositionalArgs(fnname, args, kwargs, 0); err != nil {
+		return nil, err
+	}
+	return None, recv.(*Set).Clear()
+}
+
+// https://docs.python.org/2/library/stdtypes.html#set.discard
+func set_discard(thread *Thread, fnname string, recv Value, args Tuple, kwargs []Tuple) (Value, error) {
+	var elem Value
+	if err := UnpackPositionalArgs(fnname, args, kwargs, 1, &elem); err != nil {
+		return nil, err
+	}
+	if _, err := recv.(*Set).Delete(elem); err != nil {
+		return nil, fmt.Errorf("discard: %v", err) // set is frozen or element is unhashable
+	}
+	return None, nil
+}
+
+// https://docs.python.org/2/library/stdtypes.html#set.pop
+func set_pop(thread *Thread, fnname string, recv_ Value, args Tuple, kwargs []Tuple) (Value, error) {
+	if err := UnpackPositionalArgs(fnname, args, kwargs, 0); err != nil {
+		return nil, err
+	}
+	recv := recv_.(*Set)
+	k, ok := recv.ht.first()
+	if !ok {
+		return nil, fmt.Errorf("pop: empty set")
+	}
+	if _, err := recv.Delete(k); err != nil {
+		return nil, fmt.Errorf("pop: %v", err) // set is frozen
+	}
+	return k, nil
+}
+
+// https://docs.python.org/2/library/stdtypes.html#set.remove
+func set_remove(thread *Thread, fnname string, recv Value, args Tuple, kwargs []Tuple) (Value, error) {
+	var elem Value
+	if err := UnpackPositionalArgs(fnname, args, kwargs, 1, &elem); err != nil {
+		return nil, err
+	}
+	if found, err := recv.(*Set).Delete(elem); err != nil {
+		return nil, fmt.Errorf("remove: %v", err) // set is frozen or element is unhashable
+	} else if !found {
+		return nil, fmt.Errorf("remove: missing element %s", elem)
+	}
+	return None, nil
+}
+
+// https://docs.python.org/2/library/stdtypes.html#set.difference
+func set_difference(thread *Thread, fnname string, recv Value, args Tuple, kwargs []Tuple) (Value, error) {
+	return setBinaryMethod(fnname, recv, args, kwargs, (*Set).Difference)
+}
+
+// https://docs.python.org/2/library/stdtypes.html#set.intersection
+func set_intersection(thread *Thread, fnname string, recv Value, args Tuple, kwargs []Tuple) (Value, error) {
+	return setBinaryMethod(fnname, recv, args, kwargs, (*Set).Intersection)
+}
+
+// https://docs.python.org/2/library/stdtypes.html#set.symmetric_difference
+func set_symmetric_difference(thread *Thread, fnname string, recv Value, args Tuple, kwargs []Tuple) (Value, error) {
+	return setBinaryMethod(fnname, recv, args, kwargs, (*Set).SymmetricDifference)
+}
+
 // See https://bazel.build/versions/master/docs/skylark/lib/set.html#union.
-func set_union(fnname string, recv Value, args Tuple, kwargs []Tuple) (Value, error) {
+// https://docs.python.org/2/library/stdtypes.html#set.union
+func set_union(thread *Thread, fnname string, recv Value, args Tuple, kwargs []Tuple) (Value, error) {
+	return setBinaryMethod(fnname, recv, args, kwargs, (*Set).Union)
+}
+
+// Common implementation of set_{union,intersection,difference,symmetric_difference}.
+func setBinaryMethod(fnname string, recv Value, args Tuple, kwargs []Tuple, op func(*Set, Iterator) (Value, error)) (Value, error) {
 	var iterable Iterable
-	if err := UnpackPositionalArgs(fnname, args, kwargs, 0, &iterable); err != nil {
+	if err := UnpackPositionalArgs(fnname, args, kwargs, 1, &iterable); err != nil {
 		return nil, err
 	}
 	iter := iterable.Iterate()
 	defer iter.Done()
-	union, err := recv.(*Set).Union(iter)
+	result, err := op(recv.(*Set), iter)
 	if err != nil {
-		return nil, fmt.Errorf("union: %v", err)
+		return nil, fmt.Errorf("%s: %v", fnname, err)
 	}
-	return union, nil
+	return result, nil
 }
 
 // Common implementation of string_{r}{find,index}.
@@ -1914,7 +2587,7 @@ func updateDict(dict *Dict, updates Tuple, kwargs []Tuple) error {
 		switch updates := updates[0].(type) {
 		case NoneType:
 			// no-op
-		case *Dict:
+		case IterableMapping:
 			// Iterate over dict's key/value pairs, not just keys.
 			for _, item := range updates.Items() {
 				if err := dict.Set(item[0], item[1]); err != nil {
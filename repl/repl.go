@@ -0,0 +1,134 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package repl provides a read/eval/print loop for Skylark.
+//
+// The loop reads one statement at a time. If a line does not form a
+// complete statement, for example because it contains an unclosed
+// bracket or string, or is the header of a def, if, or for statement,
+// the loop prompts for continuation lines. A compound statement is
+// terminated by a blank line. If the statement is an expression, its
+// value, unless None, is printed.
+package repl
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/google/skylark"
+	"github.com/google/skylark/syntax"
+)
+
+// REPL executes a read, eval, print loop using the standard input,
+// output, and error streams.
+func REPL(thread *skylark.Thread, predeclared skylark.StringDict) {
+	Run(thread, os.Stdin, os.Stdout, os.Stderr, predeclared)
+}
+
+// Run executes a read, eval, print loop that reads statements from in
+// until end of input. It prints the values of expressions to out, and
+// prompts and errors to errout. Errors do not terminate the loop.
+//
+// Each statement is executed in an environment that initially contains
+// the predeclared names, and accumulates the global variables defined
+// by previous statements of the session.
+func Run(thread *skylark.Thread, in io.Reader, out, errout io.Writer, predeclared skylark.StringDict) {
+	globals := predeclared.Clone()
+
+	sc := bufio.NewScanner(in)
+	for rep(thread, sc, out, errout, globals) {
+	}
+	fmt.Fprintln(errout)
+}
+
+// rep reads, evaluates, and prints one statement.
+// It returns false at end of input.
+func rep(thread *skylark.Thread, sc *bufio.Scanner, out, errout io.Writer, globals skylark.StringDict) bool {
+	var buf bytes.Buffer
+	prompt := ">>> "
+	for {
+		fmt.Fprint(errout, prompt)
+		if !sc.Scan() {
+			if buf.Len() > 0 {
+				execute(thread, buf.Bytes(), out, errout, globals)
+			}
+			return false
+		}
+		line := sc.Text()
+		blank := strings.TrimSpace(line) == ""
+		if buf.Len() == 0 && (blank || strings.HasPrefix(strings.TrimSpace(line), "#")) {
+			continue // blank or comment
+		}
+		buf.WriteString(line)
+		buf.WriteByte('\n')
+		prompt = "... "
+
+		f, err := syntax.Parse("<stdin>", buf.Bytes())
+		if err != nil {
+			if incomplete(err, buf.Bytes()) {
+				continue
+			}
+			printError(errout, err)
+			return true
+		}
+		if !blank && isCompound(f) {
+			continue // read up to a blank line
+		}
+		execute(thread, buf.Bytes(), out, errout, globals)
+		return true
+	}
+}
+
+// incomplete reports whether err is a syntax error caused by
+// reaching the end of src, so that more input might fix it.
+func incomplete(err error, src []byte) bool {
+	if err, ok := err.(syntax.Error); ok {
+		nlines := bytes.Count(src, []byte("\n"))
+		return int(err.Pos.Line) > nlines || strings.Contains(err.Msg, "unexpected EOF")
+	}
+	return false
+}
+
+// isCompound reports whether the file ends with a compound statement,
+// to which more lines could be added.
+func isCompound(f *syntax.File) bool {
+	if len(f.Stmts) == 0 {
+		return false
+	}
+	switch f.Stmts[len(f.Stmts)-1].(type) {
+	case *syntax.DefStmt, *syntax.IfStmt, *syntax.ForStmt:
+		return true
+	}
+	return false
+}
+
+// execute evaluates src, which is either a single expression, whose
+// value is printed, or a sequence of statements.
+func execute(thread *skylark.Thread, src []byte, out, errout io.Writer, globals skylark.StringDict) {
+	if _, err := syntax.ParseExpr("<stdin>", bytes.TrimRight(src, "\n")); err == nil {
+		if v, err := skylark.Eval(thread, "<stdin>", bytes.TrimRight(src, "\n"), globals); err != nil {
+			printError(errout, err)
+		} else if v != skylark.None {
+			fmt.Fprintln(out, v)
+		}
+		return
+	}
+	if err := skylark.ExecREPLChunk(thread, "<stdin>", src, globals); err != nil {
+		printError(errout, err)
+	}
+}
+
+// printError prints err to errout, with a backtrace if it is an
+// execution error.
+func printError(errout io.Writer, err error) {
+	if evalErr, ok := err.(*skylark.EvalError); ok {
+		fmt.Fprintln(errout, evalErr.Backtrace())
+	} else {
+		fmt.Fprintln(errout, err)
+	}
+}
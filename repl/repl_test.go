@@ -0,0 +1,71 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package repl_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/google/skylark"
+	"github.com/google/skylark/repl"
+)
+
+func TestRun(t *testing.T) {
+	const input = `
+# A comment.
+x = 1
+x + 1
+def double(n):
+  if n:
+    return n * 2
+  return 0
+
+double(x)
+[y for y in (1,
+             2)]
+s = """a
+b"""
+s
+print("hello")
+l = []
+l.append(1)
+l
+1 // 0
+x = 1 +* 2
+undefined
+(x, greeting)
+`
+	var out, errout bytes.Buffer
+	thread := &skylark.Thread{
+		Print: func(_ *skylark.Thread, msg string) { out.WriteString(msg) },
+	}
+	predeclared := skylark.StringDict{"greeting": skylark.String("hi")}
+	repl.Run(thread, strings.NewReader(input), &out, &errout, predeclared)
+
+	if got, want := out.String(), `2
+2
+[1, 2]
+"a\nb"
+hello
+[1]
+(1, "hi")
+`; got != want {
+		t.Errorf("output:\n%s\nwant:\n%s", got, want)
+	}
+
+	for _, want := range []string{
+		"Traceback (most recent call last):\n  <stdin>:1:3: in <toplevel>\nError: floored division by zero",
+		"got '*', want primary expression",
+		"<stdin>:1:1: undefined: undefined",
+	} {
+		if !strings.Contains(errout.String(), want) {
+			t.Errorf("error output does not contain %q:\n%s", want, errout.String())
+		}
+	}
+	if _, ok := predeclared["x"]; ok {
+		t.Errorf("Run modified the predeclared environment")
+	}
+}
@@ -69,6 +69,7 @@ package resolve
 import (
 	"fmt"
 	"log"
+	"sort"
 	"strings"
 
 	"github.com/google/skylark/syntax"
@@ -87,10 +88,24 @@ var (
 	AllowFreeze         = false // allow the 'freeze' built-in
 	AllowSet            = false // allow the 'set' built-in
 	AllowGlobalReassign = false // allow reassignment to globals declared in same file (deprecated)
+	AllowOptionalDot    = false // allow optional attribute access x?.f
+	AllowRecursion      = false // allow functions to call themselves
 )
 
+// A ResolveResult holds the outcome of resolving a file, other than errors.
+type ResolveResult struct {
+	// Warnings reports constructs that are legal but questionable,
+	// such as a variable that shadows another of the same name,
+	// a local variable or loaded symbol that is never used, or a
+	// redundant pass statement.  Warnings do not prevent execution.
+	// Names beginning with an underscore are exempt from the
+	// unused-variable checks.
+	Warnings []Warning
+}
+
 // File resolves the specified file.
-func File(file *syntax.File, isPredeclaredGlobal, isBuiltin func(name string) bool) error {
+// The result is non-nil even if the file has errors.
+func File(file *syntax.File, isPredeclaredGlobal, isBuiltin func(name string) bool) (*ResolveResult, error) {
 	r := newResolver(isPredeclaredGlobal, isBuiltin)
 	r.stmts(file.Stmts)
 
@@ -103,10 +118,22 @@ func File(file *syntax.File, isPredeclaredGlobal, isBuiltin func(name string) bo
 
 	file.Locals = r.moduleLocals
 
+	// Shadowing, unused variables, and uses before assignment
+	// can be detected only once all bindings and uses are known.
+	r.checkShadowing()
+	r.checkUnused(file)
+	r.checkUseBeforeAssignment()
+	if !AllowRecursion {
+		r.checkRecursion()
+	}
+	r.resolveCells(r.env)
+	sort.Stable(byPos(r.warnings))
+
+	result := &ResolveResult{Warnings: r.warnings}
 	if len(r.errors) > 0 {
-		return r.errors
+		return result, r.errors
 	}
-	return nil
+	return result, nil
 }
 
 // Expr resolves the specified expression.
@@ -116,6 +143,7 @@ func Expr(expr syntax.Expr, isPredeclaredGlobal, isBuiltin func(name string) boo
 	r.expr(expr)
 	r.env.resolveLocalUses()
 	r.resolveNonLocalUses(r.env) // globals & builtins
+	r.resolveCells(r.env)
 	if len(r.errors) > 0 {
 		return nil, r.errors
 	}
@@ -135,6 +163,24 @@ type Error struct {
 
 func (e Error) Error() string { return e.Pos.String() + ": " + e.Msg }
 
+// A Warning describes the nature and position of a questionable construct
+// reported by the resolver.  Unlike an Error, it does not prevent execution.
+type Warning struct {
+	Pos syntax.Position
+	Msg string
+}
+
+func (w Warning) String() string { return w.Pos.String() + ": " + w.Msg }
+
+type byPos []Warning
+
+func (ws byPos) Len() int      { return len(ws) }
+func (ws byPos) Swap(i, j int) { ws[i], ws[j] = ws[j], ws[i] }
+func (ws byPos) Less(i, j int) bool {
+	x, y := ws[i].Pos, ws[j].Pos
+	return x.Line < y.Line || x.Line == y.Line && x.Col < y.Col
+}
+
 // The Scope of a syntax.Ident indicates what kind of scope it has.
 type Scope uint8
 
@@ -144,6 +190,7 @@ const (
 	Free                   // name is local to some enclosing function
 	Global                 // name is global to module
 	Builtin                // name is universal (e.g. len)
+	Cell                   // name is local to its function, and captured by a nested one
 )
 
 var scopeNames = [...]string{
@@ -152,6 +199,7 @@ var scopeNames = [...]string{
 	Free:      "free",
 	Global:    "global",
 	Builtin:   "builtin",
+	Cell:      "cell",
 }
 
 func (scope Scope) String() string { return scopeNames[scope] }
@@ -162,6 +210,7 @@ func newResolver(isPredeclaredGlobal, isBuiltin func(name string) bool) *resolve
 		isPredeclaredGlobal: isPredeclaredGlobal,
 		isBuiltin:           isBuiltin,
 		globals:             make(map[string]syntax.Position),
+		cells:               make(map[local]bool),
 	}
 }
 
@@ -186,14 +235,41 @@ type resolver struct {
 
 	loops int // number of enclosing for loops
 
-	errors ErrorList
+	// bindings records the first binding of each name in each block,
+	// in order, for the shadowing check.
+	bindings []use
+
+	// reads records each non-binding use of a name, for the
+	// unused-variable and use-before-assignment checks.
+	reads []read
+
+	// order numbers reads and bindings in the order they are resolved,
+	// which is the order of evaluation within a statement: the
+	// right-hand side of an assignment precedes its own binding.
+	order int
+
+	// firstBind records the order of the first binding of each
+	// local variable of a function, for the use-before-assignment check.
+	firstBind map[local]int
+
+	// cells records each local variable captured by a nested function.
+	cells map[local]bool
+
+	// defs records each def statement, for the recursion check.
+	defs []*syntax.DefStmt
+
+	errors   ErrorList
+	warnings []Warning
 }
 
 // container returns the innermost enclosing "container" block:
 // a function (function != nil) or module (function == nil).
 // Container blocks accumulate local variable bindings.
-func (r *resolver) container() *block {
-	for b := r.env; ; b = b.parent {
+func (r *resolver) container() *block { return r.env.container() }
+
+// container returns the innermost container block enclosing b.
+func (b *block) container() *block {
+	for ; ; b = b.parent {
 		if b.function != nil || b.isModule() {
 			return b
 		}
@@ -229,6 +305,10 @@ type block struct {
 	// so that only free and global ones remain.
 	// At the end of each top-level function we compute closures.
 	uses []use
+
+	// localUses records the identifiers of this container
+	// resolved as locals, some of which may later become cells.
+	localUses []*syntax.Ident
 }
 
 type binding struct {
@@ -259,12 +339,28 @@ func (r *resolver) errorf(posn syntax.Position, format string, args ...interface
 	r.errors = append(r.errors, Error{posn, fmt.Sprintf(format, args...)})
 }
 
+func (r *resolver) warnf(posn syntax.Position, format string, args ...interface{}) {
+	r.warnings = append(r.warnings, Warning{posn, fmt.Sprintf(format, args...)})
+}
+
 // A use records an identifier and the environment in which it appears.
 type use struct {
 	id  *syntax.Ident
 	env *block
 }
 
+// A read records a non-binding use of an identifier.
+type read struct {
+	use
+	inLoop bool // within a for loop of the same function
+	order  int  // see resolver.order
+}
+
+func (r *resolver) read(id *syntax.Ident) {
+	r.order++
+	r.reads = append(r.reads, read{use{id, r.env}, r.loops > 0, r.order})
+}
+
 // bind creates a binding for id in the current block,
 // if there is not one already, and reports an error if
 // a global was re-bound and allowRebind is false.
@@ -286,6 +382,7 @@ func (r *resolver) bind(id *syntax.Ident, allowRebind bool) bool {
 		} else {
 			id.Scope = uint8(Global)
 			r.globals[id.Name] = id.NamePos
+			r.bindings = append(r.bindings, use{id, r.env})
 		}
 		return ok
 	}
@@ -300,8 +397,16 @@ func (r *resolver) bind(id *syntax.Ident, allowRebind bool) bool {
 		} else {
 			locals = &r.moduleLocals
 		}
+		if r.env.function != nil { // not a comprehension
+			if r.firstBind == nil {
+				r.firstBind = make(map[local]int)
+			}
+			r.order++
+			r.firstBind[local{r.env, len(*locals)}] = r.order
+		}
 		r.env.bind(id.Name, binding{Local, len(*locals)})
 		*locals = append(*locals, id)
+		r.bindings = append(r.bindings, use{id, r.env})
 	}
 
 	r.use(id)
@@ -353,6 +458,7 @@ func (b *block) resolveLocalUses() {
 		if bind := lookupLocal(use); bind.scope == Local {
 			use.id.Scope = uint8(bind.scope)
 			use.id.Index = bind.index
+			b.localUses = append(b.localUses, use.id)
 		} else {
 			unresolved = append(unresolved, use)
 		}
@@ -362,6 +468,9 @@ func (b *block) resolveLocalUses() {
 
 func (r *resolver) stmts(stmts []syntax.Stmt) {
 	for _, stmt := range stmts {
+		if branch, ok := stmt.(*syntax.BranchStmt); ok && branch.Token == syntax.PASS && len(stmts) > 1 {
+			r.warnf(branch.TokenPos, "redundant pass statement")
+		}
 		r.stmt(stmt)
 	}
 }
@@ -401,6 +510,7 @@ func (r *resolver) stmt(stmt syntax.Stmt) {
 		const allowRebind = false
 		r.bind(stmt.Name, allowRebind)
 		r.function(stmt.Def, stmt.Name.Name, &stmt.Function)
+		r.defs = append(r.defs, stmt)
 
 	case *syntax.ForStmt:
 		if r.container().function == nil {
@@ -413,6 +523,9 @@ func (r *resolver) stmt(stmt syntax.Stmt) {
 		r.stmts(stmt.Body)
 		r.loops--
 
+	case *syntax.DelStmt:
+		r.expr(stmt.Target)
+
 	case *syntax.ReturnStmt:
 		if r.container().function == nil {
 			r.errorf(stmt.Return, "return statement not within a function")
@@ -448,6 +561,9 @@ func (r *resolver) assign(lhs syntax.Expr, isAugmented bool) {
 	case *syntax.Ident:
 		// x = ...
 		allowRebind := isAugmented
+		if isAugmented {
+			r.read(lhs) // x += y reads x before binding it
+		}
 		r.bind(lhs, allowRebind)
 
 	case *syntax.IndexExpr:
@@ -455,6 +571,13 @@ func (r *resolver) assign(lhs syntax.Expr, isAugmented bool) {
 		r.expr(lhs.X)
 		r.expr(lhs.Y)
 
+	case *syntax.SliceExpr:
+		// x[lo:hi:step] = ...
+		if isAugmented {
+			r.errorf(syntax.Start(lhs), "can't use slice expression in augmented assignment")
+		}
+		r.expr(lhs)
+
 	case *syntax.DotExpr:
 		// x.f = ...
 		r.expr(lhs.X)
@@ -493,6 +616,7 @@ func (r *resolver) expr(e syntax.Expr) {
 	switch e := e.(type) {
 	case *syntax.Ident:
 		r.use(e)
+		r.read(e)
 
 	case *syntax.Literal:
 		if !AllowFloat && e.Token == syntax.FLOAT {
@@ -570,10 +694,22 @@ func (r *resolver) expr(e syntax.Expr) {
 		r.expr(e.X)
 		r.expr(e.Y)
 
+	case *syntax.ComparisonChain:
+		for _, x := range e.Operands {
+			r.expr(x)
+		}
+
 	case *syntax.DotExpr:
 		r.expr(e.X)
 		// ignore e.Name
 
+	case *syntax.OptDotExpr:
+		if !AllowOptionalDot {
+			r.errorf(e.Question, doesnt+"support optional attribute access (x?.f)")
+		}
+		r.expr(e.X)
+		// ignore e.Name
+
 	case *syntax.CallExpr:
 		r.expr(e.Fn)
 		seenVarargs := false
@@ -686,7 +822,10 @@ func (r *resolver) function(pos syntax.Position, name string, function *syntax.F
 	}
 	function.HasVarargs = seenVarargs
 	function.HasKwargs = seenKwargs
+	loops := r.loops
+	r.loops = 0 // loops of the enclosing function do not contain the body
 	r.stmts(function.Body)
+	r.loops = loops
 
 	// Resolve all uses of this function's local vars,
 	// and keep just the remaining uses of free/global vars.
@@ -747,9 +886,16 @@ func (r *resolver) lookupLexical(id *syntax.Ident, env *block) (bind binding) {
 		bind = r.lookupLexical(id, env.parent)
 		if env.function != nil && (bind.scope == Local || bind.scope == Free) {
 			// Found in parent block, which belongs to enclosing function.
+			// A local variable captured in this way becomes a cell,
+			// shared by the enclosing function and the closure.
+			scope := bind.scope
+			if scope == Local {
+				r.cells[local{env.parent.container(), bind.index}] = true
+				scope = Cell
+			}
 			id := &syntax.Ident{
 				Name:  id.Name,
-				Scope: uint8(bind.scope),
+				Scope: uint8(scope),
 				Index: bind.index,
 			}
 			bind.scope = Free
@@ -767,3 +913,159 @@ func (r *resolver) lookupLexical(id *syntax.Ident, env *block) (bind binding) {
 	}
 	return bind
 }
+
+// resolveCells changes the scope of each use of a local variable
+// captured by a nested function, within block b and its children,
+// from Local to Cell.
+func (r *resolver) resolveCells(b *block) {
+	for _, child := range b.children {
+		r.resolveCells(child)
+	}
+	for _, id := range b.localUses {
+		if r.cells[local{b, id.Index}] {
+			id.Scope = uint8(Cell)
+		}
+	}
+}
+
+// checkRecursion reports an error for each call within the body of a
+// function to the function itself by name. Indirect recursion, which
+// may depend on the path taken through each function, is detected
+// only dynamically, by the evaluator.
+func (r *resolver) checkRecursion() {
+	for _, def := range r.defs {
+		name := def.Name.Name
+		var visit func(n syntax.Node) bool
+		visit = func(n syntax.Node) bool {
+			switch n := n.(type) {
+			case *syntax.DefStmt, *syntax.LambdaExpr:
+				return false // a nested function is checked separately
+			case *syntax.CallExpr:
+				// The name refers to the function unless it is
+				// shadowed by a local of the function body.
+				if id, ok := n.Fn.(*syntax.Ident); ok && id.Name == name &&
+					(id.Scope == uint8(Global) || id.Scope == uint8(Free)) {
+					r.errorf(id.NamePos, "function %s calls itself", name)
+				}
+			}
+			return true
+		}
+		for _, stmt := range def.Function.Body {
+			syntax.Walk(stmt, visit)
+		}
+	}
+}
+
+// checkShadowing reports a warning for each variable that has the same
+// name as a local variable of an enclosing function, a global, or a
+// built-in, and thus hides it.
+func (r *resolver) checkShadowing() {
+	for _, b := range r.bindings {
+		name := b.id.Name
+		if !b.env.isModule() {
+			if pos, ok := r.enclosingLocal(b.env.parent, name); ok {
+				r.warnf(b.id.NamePos, "%s shadows local variable declared at %s", name, pos)
+				continue
+			}
+			if pos, ok := r.globals[name]; ok {
+				r.warnf(b.id.NamePos, "%s shadows global declared at %s", name, pos)
+				continue
+			}
+		}
+		if r.isPredeclaredGlobal(name) {
+			r.warnf(b.id.NamePos, "%s shadows predeclared global", name)
+		} else if r.isBuiltin(name) {
+			r.warnf(b.id.NamePos, "%s shadows built-in", name)
+		}
+	}
+}
+
+// enclosingLocal reports whether name is a local variable of block env
+// or one of its non-module ancestors, and if so, where it was declared.
+func (r *resolver) enclosingLocal(env *block, name string) (syntax.Position, bool) {
+	for ; !env.isModule(); env = env.parent {
+		if bind, ok := env.bindings[name]; ok && bind.scope == Local {
+			locals := r.moduleLocals
+			if fn := env.container().function; fn != nil {
+				locals = fn.Locals
+			}
+			return locals[bind.index].NamePos, true
+		}
+	}
+	return syntax.Position{}, false
+}
+
+// A local identifies a local variable by its container block and index.
+type local struct {
+	container *block
+	index     int
+}
+
+// checkUnused reports a warning for each local variable that is
+// assigned but never read, and for each loaded symbol that is never
+// used.  Function parameters and names beginning with an underscore
+// are exempt.
+func (r *resolver) checkUnused(file *syntax.File) {
+	usedLocals := make(map[local]bool)
+	usedGlobals := make(map[string]bool)
+	for _, u := range r.reads {
+		id, b := u.id, u.env.container()
+		switch Scope(id.Scope) {
+		case Free:
+			// Follow the chain of free variables to the
+			// enclosing function that defines it.
+			for Scope(id.Scope) == Free {
+				id = b.function.FreeVars[id.Index]
+				b = b.parent.container()
+			}
+			usedLocals[local{b, id.Index}] = true
+		case Local:
+			usedLocals[local{b, id.Index}] = true
+		case Global:
+			usedGlobals[id.Name] = true
+		}
+	}
+
+	for _, bind := range r.bindings {
+		id := bind.id
+		if bind.env.isModule() || strings.HasPrefix(id.Name, "_") {
+			continue
+		}
+		b := bind.env.container()
+		if b.function != nil && id.Index < len(b.function.Params) {
+			continue // parameters are bound first
+		}
+		if !usedLocals[local{b, id.Index}] {
+			r.warnf(id.NamePos, "local variable %s is assigned but never used", id.Name)
+		}
+	}
+
+	for _, stmt := range file.Stmts {
+		if load, ok := stmt.(*syntax.LoadStmt); ok {
+			for _, id := range load.To {
+				if !strings.HasPrefix(id.Name, "_") && !usedGlobals[id.Name] {
+					r.warnf(id.NamePos, "loaded symbol %s is never used", id.Name)
+				}
+			}
+		}
+	}
+}
+
+// checkUseBeforeAssignment reports an error for each use of a local
+// variable of a function that precedes, in order of evaluation within
+// the function body, every assignment to it.  So the use of x in
+// "x = x + 1" is reported if it is the first assignment to x.
+// A use within a loop is exempt, since a later iteration may follow
+// an assignment; so are uses by nested functions, which may be called
+// after the assignment.
+func (r *resolver) checkUseBeforeAssignment() {
+	for _, rd := range r.reads {
+		if Scope(rd.id.Scope) != Local || rd.inLoop {
+			continue
+		}
+		first, ok := r.firstBind[local{rd.env.container(), rd.id.Index}]
+		if ok && rd.order < first {
+			r.errorf(rd.id.NamePos, "local variable %s referenced before assignment", rd.id.Name)
+		}
+	}
+}
@@ -5,6 +5,7 @@
 package resolve_test
 
 import (
+	"fmt"
 	"strings"
 	"testing"
 
@@ -30,8 +31,10 @@ func TestResolve(t *testing.T) {
 		resolve.AllowFreeze = option(chunk.Source, "freeze")
 		resolve.AllowSet = option(chunk.Source, "set")
 		resolve.AllowGlobalReassign = option(chunk.Source, "global_reassign")
+		resolve.AllowOptionalDot = option(chunk.Source, "optdot")
+		resolve.AllowRecursion = option(chunk.Source, "recursion")
 
-		if err := resolve.File(f, isPredeclaredGlobal, isBuiltin); err != nil {
+		if _, err := resolve.File(f, isPredeclaredGlobal, isBuiltin); err != nil {
 			for _, err := range err.(resolve.ErrorList) {
 				chunk.GotError(int(err.Pos.Line), err.Msg)
 			}
@@ -40,6 +43,68 @@ func TestResolve(t *testing.T) {
 	}
 }
 
+func TestWarnings(t *testing.T) {
+	defer func(nestedDef, lambda bool) {
+		resolve.AllowNestedDef, resolve.AllowLambda = nestedDef, lambda
+	}(resolve.AllowNestedDef, resolve.AllowLambda)
+	resolve.AllowNestedDef = true
+	resolve.AllowLambda = true
+	for _, test := range []struct {
+		src  string
+		want string // warnings, separated by "; "
+	}{
+		{"def f(x):\n  return x\n", ""},
+		{"x = 1\ndef f(x):\n  return x\n",
+			"2:7: x shadows global declared at foo.sky:1:1"},
+		{"def f():\n  y = 1\n  def g():\n    y = 2\n    return y\n  return g, y\n",
+			"4:5: y shadows local variable declared at foo.sky:2:3"},
+		{"def f(x):\n  return [x for x in x]\n",
+			"2:17: x shadows local variable declared at foo.sky:1:7"},
+		{"def f():\n  return lambda Bfoo: Bfoo\n",
+			"2:17: Bfoo shadows built-in"},
+		{"G = 1\nBlen = 2\n",
+			"1:1: G shadows predeclared global; 2:1: Blen shadows built-in"},
+		{"def f():\n  pass\n", ""},
+		{"def f():\n  x = 1\n  pass\n  return x\n",
+			"3:3: redundant pass statement"},
+		{"def f(x):\n  if x:\n    pass\n    pass\n",
+			"3:5: redundant pass statement; 4:5: redundant pass statement"},
+		{"def f(x):\n  pass\n  return y\n", // errors do not suppress warnings
+			"2:3: redundant pass statement"},
+		// unused variables
+		{"def f(x, y):\n  z = x\n  _w = 1\n",
+			"2:3: local variable z is assigned but never used"},
+		{"def f():\n  a, b = 1, 2\n  return b\n",
+			"2:3: local variable a is assigned but never used"},
+		{"def f():\n  n = 0\n  n += 1\n", ""}, // augmented assignment reads n
+		{"def f(l):\n  for x in l:\n    pass\n  for _ in l:\n    pass\n",
+			"2:7: local variable x is assigned but never used"},
+		{"def f():\n  y = 1\n  return lambda: lambda: y\n", ""}, // use of free variable
+		{"def f():\n  def g():\n    pass\n  y = [1 for i in ()]\n  return y\n",
+			"2:7: local variable g is assigned but never used; 4:14: local variable i is assigned but never used"},
+		{"x = [1 for i in ()]\n", "1:12: local variable i is assigned but never used"},
+		{"x = 1\n", ""}, // globals are exported
+		{`load("m", "a", "b", c="d", _e="e")` + "\ndef f():\n  return b\n",
+			"1:12: loaded symbol a is never used; 1:21: loaded symbol c is never used"},
+		{`load("m", "a")` + "\ndef f(a):\n  return a\n", // parameter a shadows loaded a
+			"1:12: loaded symbol a is never used; 2:7: a shadows global declared at foo.sky:1:12"},
+	} {
+		f, err := syntax.Parse("foo.sky", test.src)
+		if err != nil {
+			t.Errorf("%s: %v", test.src, err)
+			continue
+		}
+		result, _ := resolve.File(f, isPredeclaredGlobal, isBuiltin)
+		var got []string
+		for _, w := range result.Warnings {
+			got = append(got, fmt.Sprintf("%d:%d: %s", w.Pos.Line, w.Pos.Col, w.Msg))
+		}
+		if got := strings.Join(got, "; "); got != test.want {
+			t.Errorf("%q: got warnings <<%s>>, want <<%s>>", test.src, got, test.want)
+		}
+	}
+}
+
 func option(chunk, name string) bool {
 	return strings.Contains(chunk, "option:"+name)
 }
@@ -50,7 +115,7 @@ func TestDefVarargsAndKwargsSet(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	if err := resolve.File(file, isPredeclaredGlobal, isBuiltin); err != nil {
+	if _, err := resolve.File(file, isPredeclaredGlobal, isBuiltin); err != nil {
 		t.Fatal(err)
 	}
 	fn := file.Stmts[0].(*syntax.DefStmt)
@@ -69,7 +134,7 @@ func TestLambdaVarargsAndKwargsSet(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	if err := resolve.File(file, isPredeclaredGlobal, isBuiltin); err != nil {
+	if _, err := resolve.File(file, isPredeclaredGlobal, isBuiltin); err != nil {
 		t.Fatal(err)
 	}
 	lam := file.Stmts[0].(*syntax.AssignStmt).RHS.(*syntax.LambdaExpr)
@@ -81,6 +146,104 @@ func TestLambdaVarargsAndKwargsSet(t *testing.T) {
 	}
 }
 
+func TestExpr(t *testing.T) {
+	isPredeclared := func(name string) bool { return name == "x" }
+	isUniverse := func(name string) bool { return name == "len" }
+
+	expr, err := syntax.ParseExpr("foo.sky", "x + len([y for y in 'ab'])")
+	if err != nil {
+		t.Fatal(err)
+	}
+	locals, err := resolve.Expr(expr, isPredeclared, isUniverse)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The comprehension variable y is local to the expression.
+	if len(locals) != 1 || locals[0].Name != "y" {
+		t.Errorf("got locals %v, want [y]", locals)
+	}
+	var got []string
+	syntax.Walk(expr, func(n syntax.Node) bool {
+		if id, ok := n.(*syntax.Ident); ok {
+			got = append(got, fmt.Sprintf("%s:%s", id.Name, resolve.Scope(id.Scope)))
+		}
+		return true
+	})
+	if want := "[x:global len:builtin y:local y:local]"; fmt.Sprint(got) != want {
+		t.Errorf("got scopes %v, want %s", got, want)
+	}
+
+	// Free variables must be predeclared.
+	expr, err = syntax.ParseExpr("foo.sky", "x + z")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := resolve.Expr(expr, isPredeclared, isUniverse); err == nil || !strings.Contains(err.Error(), "undefined: z") {
+		t.Errorf("resolve.Expr(x + z) returned error %v, want undefined: z", err)
+	}
+}
+
+func TestBranchErrors(t *testing.T) {
+	const src = `
+return 1
+def f():
+  for x in []:
+    pass
+  if f:
+    break
+`
+	f, err := syntax.Parse("foo.sky", src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = resolve.File(f, isPredeclaredGlobal, isBuiltin)
+	errs, ok := err.(resolve.ErrorList)
+	if !ok {
+		t.Fatalf("resolve.File returned %v, want ErrorList", err)
+	}
+	var got []string
+	for _, err := range errs {
+		got = append(got, err.Error())
+	}
+	const want = "[foo.sky:2:1: return statement not within a function foo.sky:7:5: break not in a loop]"
+	if fmt.Sprint(got) != want {
+		t.Errorf("got errors %v, want %s", got, want)
+	}
+}
+
+func TestScopes(t *testing.T) {
+	resolve.AllowNestedDef = true
+	resolve.AllowLambda = true
+	const src = `
+G = 1
+def f(a, b):
+  c = a
+  def g():
+    return b + G
+  return lambda: g() + Blen(c)
+`
+	f, err := syntax.Parse("foo.sky", src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := resolve.File(f, isPredeclaredGlobal, isBuiltin); err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	syntax.Walk(f, func(n syntax.Node) bool {
+		if id, ok := n.(*syntax.Ident); ok {
+			got = append(got, fmt.Sprintf("%s:%s", id.Name, resolve.Scope(id.Scope)))
+		}
+		return true
+	})
+	// Locals captured by a nested function (b, c, g) are cells
+	// in the enclosing function, and free within the nested one.
+	const want = "[G:global f:global a:local b:cell a:local c:cell g:cell b:free G:global g:free Blen:builtin c:free]"
+	if fmt.Sprint(got) != want {
+		t.Errorf("got scopes\n%v, want\n%s", got, want)
+	}
+}
+
 func isPredeclaredGlobal(name string) bool { return strings.HasPrefix(name, "G") }
 func isBuiltin(name string) bool {
 	return strings.HasPrefix(name, "B") || name == "float"
@@ -0,0 +1,575 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package skylarkjson defines the Skylark 'json' module,
+// an optional language extension for encoding values as JSON.
+package skylarkjson
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"math/big"
+	"sort"
+	"strconv"
+	"unicode/utf16"
+	"unicode/utf8"
+
+	"github.com/google/skylark"
+	"github.com/google/skylark/skylarkstruct"
+)
+
+// Module is the 'json' module, a struct with these functions:
+//
+// 	encode(x)		# returns the JSON encoding of x
+// 	encode_canonical(x)	# returns the canonical JSON encoding of x
+// 	decode(s)		# returns the Skylark value denoted by JSON s
+//
+// An application can add 'json' to the Skylark environment like so:
+//
+// 	globals := skylark.StringDict{
+// 		"json":  skylarkjson.Module,
+// 	}
+//
+var Module = skylarkstruct.FromStringDict(skylark.String("json"), skylark.StringDict{
+	"encode":           skylark.NewBuiltin("json.encode", encode),
+	"encode_canonical": skylark.NewBuiltin("json.encode_canonical", encode),
+	"decode":           skylark.NewBuiltin("json.decode", decode),
+})
+
+// encode implements json.encode and json.encode_canonical.
+//
+// None, bools, ints, floats, strings, lists, tuples, dicts with
+// string keys, and structs may be encoded; other values, such as
+// functions and sets, cannot. The encoding contains no insignificant
+// whitespace.
+//
+// Ints are encoded as JSON numbers in full precision, even if they
+// cannot be represented exactly as a float64. Some decoders may
+// round such numbers; an application that needs to exchange large
+// integers with such a decoder should encode them as strings.
+//
+// The canonical encoding lists the keys of each dict in ascending
+// order, so that equal values have identical encodings regardless
+// of the order in which their keys were inserted.
+func encode(thread *skylark.Thread, fn *skylark.Builtin, args skylark.Tuple, kwargs []skylark.Tuple) (skylark.Value, error) {
+	var x skylark.Value
+	if err := skylark.UnpackPositionalArgs(fn.Name(), args, kwargs, 1, &x); err != nil {
+		return nil, err
+	}
+	e := encoder{canonical: fn.Name() == "json.encode_canonical"}
+	if err := e.encode(x); err != nil {
+		return nil, fmt.Errorf("%s: %v", fn.Name(), err)
+	}
+	return skylark.String(e.out.String()), nil
+}
+
+type encoder struct {
+	out       bytes.Buffer
+	canonical bool
+	path      []skylark.Value // the lists and dicts being encoded, to detect cycles
+}
+
+func (e *encoder) encode(x skylark.Value) error {
+	switch x := x.(type) {
+	case skylark.NoneType:
+		e.out.WriteString("null")
+
+	case skylark.Bool:
+		if x {
+			e.out.WriteString("true")
+		} else {
+			e.out.WriteString("false")
+		}
+
+	case skylark.Int:
+		e.out.WriteString(x.String())
+
+	case skylark.Float:
+		return e.encodeFloat(float64(x))
+
+	case skylark.String:
+		return e.encodeString(string(x))
+
+	case *skylark.List, skylark.Tuple:
+		if list, ok := x.(*skylark.List); ok {
+			if err := e.push(list); err != nil {
+				return err
+			}
+			defer e.pop()
+		}
+		e.out.WriteByte('[')
+		iter := skylark.Iterate(x)
+		defer iter.Done()
+		var elem skylark.Value
+		for i := 0; iter.Next(&elem); i++ {
+			if i > 0 {
+				e.out.WriteByte(',')
+			}
+			if err := e.encode(elem); err != nil {
+				return err
+			}
+		}
+		e.out.WriteByte(']')
+
+	case *skylark.Dict:
+		if err := e.push(x); err != nil {
+			return err
+		}
+		defer e.pop()
+		items := x.Items()
+		for _, item := range items {
+			if _, ok := item[0].(skylark.String); !ok {
+				return fmt.Errorf("dict has %s key, want string", item[0].Type())
+			}
+		}
+		if e.canonical {
+			sort.Sort(byKey(items))
+		}
+		e.out.WriteByte('{')
+		for i, item := range items {
+			if i > 0 {
+				e.out.WriteByte(',')
+			}
+			if err := e.encodeMember(string(item[0].(skylark.String)), item[1]); err != nil {
+				return err
+			}
+		}
+		e.out.WriteByte('}')
+
+	case *skylarkstruct.Struct:
+		// Field names are already sorted.
+		e.out.WriteByte('{')
+		for i, name := range x.AttrNames() {
+			if i > 0 {
+				e.out.WriteByte(',')
+			}
+			v, err := x.Attr(name)
+			if err != nil {
+				return err
+			}
+			if err := e.encodeMember(name, v); err != nil {
+				return err
+			}
+		}
+		e.out.WriteByte('}')
+
+	default:
+		return fmt.Errorf("cannot encode %s as JSON", x.Type())
+	}
+	return nil
+}
+
+func (e *encoder) encodeMember(name string, v skylark.Value) error {
+	if err := e.encodeString(name); err != nil {
+		return err
+	}
+	e.out.WriteByte(':')
+	return e.encode(v)
+}
+
+// encodeFloat writes a finite float in its shortest form.
+// A float with an integer value is written as an integer,
+// so that it has the same encoding as an int equal to it.
+func (e *encoder) encodeFloat(f float64) error {
+	switch {
+	case math.IsInf(f, 0) || math.IsNaN(f):
+		return fmt.Errorf("cannot encode %s as JSON", skylark.Float(f))
+	case f == 0:
+		e.out.WriteByte('0') // including -0
+	case f == math.Trunc(f):
+		i, _ := big.NewFloat(f).Int(nil) // exact
+		e.out.WriteString(i.String())
+	default:
+		e.out.WriteString(strconv.FormatFloat(f, 'g', -1, 64))
+	}
+	return nil
+}
+
+// encodeString writes a quoted string. Only the quotation mark,
+// the backslash, and control characters are escaped; other
+// characters are written literally as UTF-8.
+func (e *encoder) encodeString(s string) error {
+	if !utf8.ValidString(s) {
+		return fmt.Errorf("cannot encode invalid UTF-8 string %q as JSON", s)
+	}
+	e.out.WriteByte('"')
+	for _, r := range s {
+		switch r {
+		case '"':
+			e.out.WriteString(`\"`)
+		case '\\':
+			e.out.WriteString(`\\`)
+		case '\b':
+			e.out.WriteString(`\b`)
+		case '\f':
+			e.out.WriteString(`\f`)
+		case '\n':
+			e.out.WriteString(`\n`)
+		case '\r':
+			e.out.WriteString(`\r`)
+		case '\t':
+			e.out.WriteString(`\t`)
+		default:
+			if r < 0x20 {
+				fmt.Fprintf(&e.out, `\u%04x`, r)
+			} else {
+				e.out.WriteRune(r)
+			}
+		}
+	}
+	e.out.WriteByte('"')
+	return nil
+}
+
+func (e *encoder) push(x skylark.Value) error {
+	for _, y := range e.path {
+		if x == y {
+			return fmt.Errorf("cannot encode cyclic %s as JSON", x.Type())
+		}
+	}
+	e.path = append(e.path, x)
+	return nil
+}
+
+func (e *encoder) pop() { e.path = e.path[:len(e.path)-1] }
+
+// byKey orders dict items by their string keys.
+type byKey []skylark.Tuple
+
+func (a byKey) Len() int           { return len(a) }
+func (a byKey) Less(i, j int) bool { return a[i][0].(skylark.String) < a[j][0].(skylark.String) }
+func (a byKey) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+
+// decode implements json.decode.
+//
+// A JSON object becomes a dict whose keys are in the order in which
+// they appear in the input; if a key appears more than once, the last
+// value wins. An array becomes a list, and null, true, and false
+// become None, True, and False. A number without a fraction or
+// exponent becomes an int, of any size; other numbers become floats.
+func decode(thread *skylark.Thread, fn *skylark.Builtin, args skylark.Tuple, kwargs []skylark.Tuple) (skylark.Value, error) {
+	var s string
+	if err := skylark.UnpackPositionalArgs(fn.Name(), args, kwargs, 1, &s); err != nil {
+		return nil, err
+	}
+	d := decoder{s: s}
+	x, err := d.decode()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", fn.Name(), err)
+	}
+	return x, nil
+}
+
+// maxDecodeDepth is the maximum nesting depth of arrays and objects.
+const maxDecodeDepth = 1000
+
+type decoder struct {
+	s     string
+	i     int // byte offset of next input
+	depth int
+}
+
+// A decodeError reports malformed JSON at a byte offset of the input.
+type decodeError struct {
+	offset int
+	msg    string
+}
+
+func (e *decodeError) Error() string { return fmt.Sprintf("at offset %d, %s", e.offset, e.msg) }
+
+func (d *decoder) errorf(offset int, format string, args ...interface{}) error {
+	return &decodeError{offset, fmt.Sprintf(format, args...)}
+}
+
+// decode decodes a complete input.
+func (d *decoder) decode() (skylark.Value, error) {
+	x, err := d.value()
+	if err != nil {
+		return nil, err
+	}
+	if d.skipSpace() {
+		return nil, d.errorf(d.i, "unexpected character %s after value", d.char())
+	}
+	return x, nil
+}
+
+// skipSpace skips whitespace and reports whether input remains.
+func (d *decoder) skipSpace() bool {
+	for d.i < len(d.s) {
+		switch d.s[d.i] {
+		case ' ', '\t', '\n', '\r':
+			d.i++
+		default:
+			return true
+		}
+	}
+	return false
+}
+
+// char returns a description of the next input character.
+func (d *decoder) char() string {
+	if d.i >= len(d.s) {
+		return "end of input"
+	}
+	r, _ := utf8.DecodeRuneInString(d.s[d.i:])
+	return strconv.QuoteRune(r)
+}
+
+func (d *decoder) value() (skylark.Value, error) {
+	if !d.skipSpace() {
+		return nil, d.errorf(d.i, "unexpected end of input")
+	}
+	switch c := d.s[d.i]; {
+	case c == '"':
+		s, err := d.string()
+		if err != nil {
+			return nil, err
+		}
+		return skylark.String(s), nil
+
+	case c == '-' || '0' <= c && c <= '9':
+		return d.number()
+
+	case c == '[':
+		if err := d.push(); err != nil {
+			return nil, err
+		}
+		d.i++
+		list := new(skylark.List)
+		if d.skipSpace() && d.s[d.i] == ']' {
+			d.i++
+			d.depth--
+			return list, nil
+		}
+		for {
+			elem, err := d.value()
+			if err != nil {
+				return nil, err
+			}
+			list.Append(elem)
+			if !d.skipSpace() {
+				return nil, d.errorf(d.i, "unexpected end of input in array")
+			}
+			switch d.s[d.i] {
+			case ',':
+				d.i++
+			case ']':
+				d.i++
+				d.depth--
+				return list, nil
+			default:
+				return nil, d.errorf(d.i, "got %s, want ',' or ']'", d.char())
+			}
+		}
+
+	case c == '{':
+		if err := d.push(); err != nil {
+			return nil, err
+		}
+		d.i++
+		dict := new(skylark.Dict)
+		if d.skipSpace() && d.s[d.i] == '}' {
+			d.i++
+			d.depth--
+			return dict, nil
+		}
+		for {
+			if !d.skipSpace() {
+				return nil, d.errorf(d.i, "unexpected end of input in object")
+			}
+			if d.s[d.i] != '"' {
+				return nil, d.errorf(d.i, "got %s, want string for object key", d.char())
+			}
+			k, err := d.string()
+			if err != nil {
+				return nil, err
+			}
+			if !d.skipSpace() || d.s[d.i] != ':' {
+				return nil, d.errorf(d.i, "got %s, want ':' after object key", d.char())
+			}
+			d.i++
+			v, err := d.value()
+			if err != nil {
+				return nil, err
+			}
+			dict.Set(skylark.String(k), v) // can't fail
+			if !d.skipSpace() {
+				return nil, d.errorf(d.i, "unexpected end of input in object")
+			}
+			switch d.s[d.i] {
+			case ',':
+				d.i++
+			case '}':
+				d.i++
+				d.depth--
+				return dict, nil
+			default:
+				return nil, d.errorf(d.i, "got %s, want ',' or '}'", d.char())
+			}
+		}
+	}
+
+	for _, lit := range [...]struct {
+		name string
+		v    skylark.Value
+	}{
+		{"null", skylark.None},
+		{"true", skylark.True},
+		{"false", skylark.False},
+	} {
+		if len(d.s)-d.i >= len(lit.name) && d.s[d.i:d.i+len(lit.name)] == lit.name {
+			d.i += len(lit.name)
+			return lit.v, nil
+		}
+	}
+	return nil, d.errorf(d.i, "unexpected character %s", d.char())
+}
+
+func (d *decoder) push() error {
+	d.depth++
+	if d.depth > maxDecodeDepth {
+		return d.errorf(d.i, "nesting too deep")
+	}
+	return nil
+}
+
+// number decodes a JSON number.
+func (d *decoder) number() (skylark.Value, error) {
+	start := d.i
+	digits := func() int {
+		n := 0
+		for d.i < len(d.s) && '0' <= d.s[d.i] && d.s[d.i] <= '9' {
+			d.i++
+			n++
+		}
+		return n
+	}
+	if d.s[d.i] == '-' {
+		d.i++
+	}
+	intStart := d.i
+	if digits() == 0 {
+		return nil, d.errorf(d.i, "got %s, want digit in number", d.char())
+	}
+	if d.s[intStart] == '0' && d.i-intStart > 1 {
+		return nil, d.errorf(intStart, "number has leading zero")
+	}
+	isFloat := false
+	if d.i < len(d.s) && d.s[d.i] == '.' {
+		isFloat = true
+		d.i++
+		if digits() == 0 {
+			return nil, d.errorf(d.i, "got %s, want digit after decimal point", d.char())
+		}
+	}
+	if d.i < len(d.s) && (d.s[d.i] == 'e' || d.s[d.i] == 'E') {
+		isFloat = true
+		d.i++
+		if d.i < len(d.s) && (d.s[d.i] == '+' || d.s[d.i] == '-') {
+			d.i++
+		}
+		if digits() == 0 {
+			return nil, d.errorf(d.i, "got %s, want digit in exponent", d.char())
+		}
+	}
+	text := d.s[start:d.i]
+	if isFloat {
+		f, err := strconv.ParseFloat(text, 64)
+		if err != nil {
+			// out of range
+			return nil, d.errorf(start, "invalid number %s", text)
+		}
+		return skylark.Float(f), nil
+	}
+	i, _ := new(big.Int).SetString(text, 10) // can't fail
+	return skylark.MakeBigInt(i), nil
+}
+
+// string decodes a JSON string literal.
+func (d *decoder) string() (string, error) {
+	start := d.i
+	d.i++ // '"'
+	var buf bytes.Buffer
+	for {
+		if d.i >= len(d.s) {
+			return "", d.errorf(start, "unterminated string")
+		}
+		c := d.s[d.i]
+		switch {
+		case c == '"':
+			d.i++
+			return buf.String(), nil
+
+		case c < 0x20:
+			return "", d.errorf(d.i, "control character %s in string", d.char())
+
+		case c == '\\':
+			if d.i+1 >= len(d.s) {
+				return "", d.errorf(start, "unterminated string")
+			}
+			esc := d.s[d.i+1]
+			d.i += 2
+			switch esc {
+			case '"', '\\', '/':
+				buf.WriteByte(esc)
+			case 'b':
+				buf.WriteByte('\b')
+			case 'f':
+				buf.WriteByte('\f')
+			case 'n':
+				buf.WriteByte('\n')
+			case 'r':
+				buf.WriteByte('\r')
+			case 't':
+				buf.WriteByte('\t')
+			case 'u':
+				r, err := d.hex4()
+				if err != nil {
+					return "", err
+				}
+				if utf16.IsSurrogate(r) {
+					// A surrogate pair: \uD83D\uDE00.
+					r2 := utf8.RuneError
+					if len(d.s)-d.i >= 2 && d.s[d.i:d.i+2] == `\u` {
+						save := d.i
+						d.i += 2
+						if r2, err = d.hex4(); err != nil {
+							return "", err
+						}
+						if r = utf16.DecodeRune(r, r2); r == utf8.RuneError {
+							d.i = save // not a pair; decode the second separately
+						}
+					} else {
+						r = utf8.RuneError
+					}
+				}
+				buf.WriteRune(r)
+			default:
+				return "", d.errorf(d.i-2, "invalid escape sequence \\%c in string", esc)
+			}
+
+		default:
+			r, size := utf8.DecodeRuneInString(d.s[d.i:])
+			if r == utf8.RuneError && size == 1 {
+				return "", d.errorf(d.i, "invalid UTF-8 in string")
+			}
+			buf.WriteString(d.s[d.i : d.i+size])
+			d.i += size
+		}
+	}
+}
+
+// hex4 decodes the four hex digits of a \uXXXX escape.
+func (d *decoder) hex4() (rune, error) {
+	if len(d.s)-d.i < 4 {
+		return 0, d.errorf(d.i, "incomplete \\u escape in string")
+	}
+	n, err := strconv.ParseUint(d.s[d.i:d.i+4], 16, 16)
+	if err != nil {
+		return 0, d.errorf(d.i, "invalid \\u escape in string")
+	}
+	d.i += 4
+	return rune(n), nil
+}
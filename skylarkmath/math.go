@@ -0,0 +1,193 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package skylarkmath defines the Skylark 'math' module,
+// an optional language extension for floating-point computation.
+// It is useful only if resolve.AllowFloat is enabled.
+package skylarkmath
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/google/skylark"
+	"github.com/google/skylark/skylarkstruct"
+)
+
+// Module is the 'math' module, a struct with these constants and functions:
+//
+// 	pi			# the ratio of a circle's circumference to its diameter
+// 	e			# the base of natural logarithms
+// 	ceil(x)			# the least int greater than or equal to x
+// 	floor(x)		# the greatest int less than or equal to x
+// 	fabs(x)			# the absolute value of x, as a float
+// 	sqrt(x)			# the square root of x
+// 	pow(x, y)		# x raised to the power y
+// 	exp(x)			# e raised to the power x
+// 	log(x, base=e)		# the logarithm of x to the given base
+// 	sin(x), cos(x), tan(x)	# trigonometric functions of x radians
+// 	asin(x), acos(x), atan(x), atan2(y, x)	# inverse trigonometric functions
+// 	hypot(x, y)		# the Euclidean norm, sqrt(x*x + y*y)
+// 	degrees(x), radians(x)	# angle conversions
+//
+// Each function accepts ints as well as floats, converting them to float.
+// Except for ceil and floor, which return ints, each returns a float.
+// A function fails if its argument is outside its domain, as in sqrt(-1),
+// or if its result is too large to represent, as in exp(1000).
+//
+// An application can add 'math' to the Skylark environment like so:
+//
+// 	globals := skylark.StringDict{
+// 		"math":  skylarkmath.Module,
+// 	}
+//
+var Module = skylarkstruct.FromStringDict(skylark.String("math"), skylark.StringDict{
+	"pi": skylark.Float(math.Pi),
+	"e":  skylark.Float(math.E),
+
+	"ceil":  skylark.NewBuiltin("math.ceil", ceil),
+	"floor": skylark.NewBuiltin("math.floor", floor),
+	"log":   skylark.NewBuiltin("math.log", log),
+
+	"fabs":    unary("fabs", math.Abs),
+	"sqrt":    unary("sqrt", math.Sqrt),
+	"exp":     unary("exp", math.Exp),
+	"sin":     unary("sin", math.Sin),
+	"cos":     unary("cos", math.Cos),
+	"tan":     unary("tan", math.Tan),
+	"asin":    unary("asin", math.Asin),
+	"acos":    unary("acos", math.Acos),
+	"atan":    unary("atan", math.Atan),
+	"degrees": unary("degrees", func(x float64) float64 { return x * 180 / math.Pi }),
+	"radians": unary("radians", func(x float64) float64 { return x * math.Pi / 180 }),
+
+	"pow":   binary("pow", math.Pow),
+	"atan2": binary("atan2", math.Atan2),
+	"hypot": binary("hypot", math.Hypot),
+})
+
+// unary returns a built-in function math.name that applies f to a number.
+func unary(name string, f func(float64) float64) *skylark.Builtin {
+	return skylark.NewBuiltin("math."+name, func(thread *skylark.Thread, fn *skylark.Builtin, args skylark.Tuple, kwargs []skylark.Tuple) (skylark.Value, error) {
+		var x skylark.Value
+		if err := skylark.UnpackPositionalArgs(fn.Name(), args, kwargs, 1, &x); err != nil {
+			return nil, err
+		}
+		fx, err := toFloat(fn, x)
+		if err != nil {
+			return nil, err
+		}
+		return check(fn, f(fx), fx)
+	})
+}
+
+// binary returns a built-in function math.name that applies f to two numbers.
+func binary(name string, f func(float64, float64) float64) *skylark.Builtin {
+	return skylark.NewBuiltin("math."+name, func(thread *skylark.Thread, fn *skylark.Builtin, args skylark.Tuple, kwargs []skylark.Tuple) (skylark.Value, error) {
+		var x, y skylark.Value
+		if err := skylark.UnpackPositionalArgs(fn.Name(), args, kwargs, 2, &x, &y); err != nil {
+			return nil, err
+		}
+		fx, err := toFloat(fn, x)
+		if err != nil {
+			return nil, err
+		}
+		fy, err := toFloat(fn, y)
+		if err != nil {
+			return nil, err
+		}
+		return check(fn, f(fx, fy), fx, fy)
+	})
+}
+
+func ceil(thread *skylark.Thread, fn *skylark.Builtin, args skylark.Tuple, kwargs []skylark.Tuple) (skylark.Value, error) {
+	return round(fn, args, kwargs, math.Ceil)
+}
+
+func floor(thread *skylark.Thread, fn *skylark.Builtin, args skylark.Tuple, kwargs []skylark.Tuple) (skylark.Value, error) {
+	return round(fn, args, kwargs, math.Floor)
+}
+
+// round implements ceil and floor, which return ints.
+func round(fn *skylark.Builtin, args skylark.Tuple, kwargs []skylark.Tuple, f func(float64) float64) (skylark.Value, error) {
+	var x skylark.Value
+	if err := skylark.UnpackPositionalArgs(fn.Name(), args, kwargs, 1, &x); err != nil {
+		return nil, err
+	}
+	switch x := x.(type) {
+	case skylark.Int:
+		return x, nil // exact, even if too large for a float
+	case skylark.Float:
+		i, err := skylark.ConvertToInt(skylark.Float(f(float64(x))))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", fn.Name(), err)
+		}
+		return i, nil
+	}
+	return nil, fmt.Errorf("%s: got %s, want int or float", fn.Name(), x.Type())
+}
+
+func log(thread *skylark.Thread, fn *skylark.Builtin, args skylark.Tuple, kwargs []skylark.Tuple) (skylark.Value, error) {
+	var x, base skylark.Value
+	if err := skylark.UnpackArgs(fn.Name(), args, kwargs, "x", &x, "base?", &base); err != nil {
+		return nil, err
+	}
+	fx, err := toFloat(fn, x)
+	if err != nil {
+		return nil, err
+	}
+	if base == nil {
+		return check(fn, math.Log(fx), fx)
+	}
+	fbase, err := toFloat(fn, base)
+	if err != nil {
+		return nil, err
+	}
+	if fbase == 1 {
+		return nil, fmt.Errorf("%s: math domain error", fn.Name()) // division by zero
+	}
+	return check(fn, math.Log(fx)/math.Log(fbase), fx, fbase)
+}
+
+// toFloat converts an int or float argument to a float64.
+func toFloat(fn *skylark.Builtin, x skylark.Value) (float64, error) {
+	switch x.(type) {
+	case skylark.Int, skylark.Float:
+		f, _ := skylark.AsFloat(x)
+		return f, nil
+	}
+	return 0, fmt.Errorf("%s: got %s, want int or float", fn.Name(), x.Type())
+}
+
+// check returns the result z of applying fn to the arguments args,
+// or an error if z is a NaN or infinity not due to a NaN or infinite argument.
+func check(fn *skylark.Builtin, z float64, args ...float64) (skylark.Value, error) {
+	if math.IsNaN(z) || math.IsInf(z, 0) {
+		for _, arg := range args {
+			if math.IsNaN(arg) || math.IsInf(arg, 0) {
+				return skylark.Float(z), nil // garbage in, garbage out
+			}
+		}
+		if math.IsNaN(z) {
+			return nil, fmt.Errorf("%s: math domain error", fn.Name())
+		}
+		if isPole(fn, args) {
+			return nil, fmt.Errorf("%s: math domain error", fn.Name())
+		}
+		return nil, fmt.Errorf("%s: math range error", fn.Name())
+	}
+	return skylark.Float(z), nil
+}
+
+// isPole reports whether an infinite result of fn is due to an argument
+// at a singularity of the function, such as log(0), rather than overflow.
+func isPole(fn *skylark.Builtin, args []float64) bool {
+	switch fn.Name() {
+	case "math.log":
+		return args[0] == 0
+	case "math.pow":
+		return args[0] == 0 && args[1] < 0
+	}
+	return false
+}
@@ -6,8 +6,7 @@
 // an optional language extension.
 package skylarkstruct
 
-// TODO(adonovan): This package is implicitly covered by other
-// packages' tests, but it should really have some of its own.
+// This package is tested by testdata/struct.sky in the skylark package.
 
 // TODO(adonovan): the deprecated struct methods "to_json" and
 // "to_proto" do not appear in AttrNames, and hence dir(struct), since
@@ -18,7 +17,9 @@ package skylarkstruct
 import (
 	"bytes"
 	"fmt"
+	"math"
 	"sort"
+	"strconv"
 
 	"github.com/google/skylark"
 	"github.com/google/skylark/syntax"
@@ -125,7 +126,11 @@ func (s *Struct) ToStringDict(d skylark.StringDict) {
 
 func (s *Struct) String() string {
 	var buf bytes.Buffer
-	buf.WriteString(s.constructor.String())
+	if name, ok := s.constructor.(skylark.String); ok {
+		buf.WriteString(string(name)) // struct(...), not "struct"(...)
+	} else {
+		buf.WriteString(s.constructor.String())
+	}
 	buf.WriteByte('(')
 	for i, e := range s.entries {
 		if i > 0 {
@@ -195,6 +200,8 @@ func (x *Struct) Binary(op syntax.Token, y skylark.Value, side skylark.Side) (sk
 // Attr returns the value of the specified field,
 // or deprecated method if the name is "to_json" or "to_proto"
 // and the struct has no field of that name.
+// It returns (nil, nil) if there is no such field,
+// so that hasattr and getattr behave as expected.
 func (s *Struct) Attr(name string) (skylark.Value, error) {
 	// Binary search the entries.
 	// This implementation is a specialization of
@@ -218,16 +225,20 @@ func (s *Struct) Attr(name string) (skylark.Value, error) {
 	case "to_json", "to_proto":
 		return skylark.NewBuiltin(name, func(thread *skylark.Thread, fn *skylark.Builtin, args skylark.Tuple, kwargs []skylark.Tuple) (skylark.Value, error) {
 			var buf bytes.Buffer
+			var err error
 			if name == "to_json" {
-				writeJSON(&buf, s)
+				err = writeJSON(&buf, s)
 			} else {
-				writeTextProto(&buf, s)
+				err = writeTextProto(&buf, s)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", name, err)
 			}
 			return skylark.String(buf.String()), nil
 		}), nil
 	}
 
-	return nil, fmt.Errorf("%v has no .%s attribute", s.constructor, name)
+	return nil, nil // no such field
 }
 
 func writeTextProto(out *bytes.Buffer, v skylark.Value) error {
@@ -235,9 +246,22 @@ func writeTextProto(out *bytes.Buffer, v skylark.Value) error {
 }
 
 // writeJSON writes the JSON representation of a Skylark value to out.
-// TODO(adonovan): there may be a nice feature for core skylark.Value here,
-// but the current feature is incomplete and underspecified.
+// It supports None, bools, ints, finite floats, strings, lists, tuples,
+// dicts with string keys, and structs. Ints are written in full
+// precision, even if they cannot be represented exactly as a float64.
+// See also the skylarkjson package.
 func writeJSON(out *bytes.Buffer, v skylark.Value) error {
+	return writeJSONDepth(out, v, 0)
+}
+
+// maxJSONDepth bounds the nesting of values converted by to_json,
+// which might otherwise recurse forever on a cyclic list or dict.
+const maxJSONDepth = 1000
+
+func writeJSONDepth(out *bytes.Buffer, v skylark.Value, depth int) error {
+	if depth > maxJSONDepth {
+		return fmt.Errorf("cannot convert %s to JSON: nesting too deep (cyclic?)", v.Type())
+	}
 	// TODO(adonovan): improve error error messages to show the path
 	// through the object graph.
 	switch v := v.(type) {
@@ -246,48 +270,85 @@ func writeJSON(out *bytes.Buffer, v skylark.Value) error {
 	case skylark.Bool:
 		fmt.Fprintf(out, "%t", v)
 	case skylark.Int:
-		// TODO(adonovan): test large numbers.
 		out.WriteString(v.String())
 	case skylark.Float:
-		// TODO(adonovan): test.
-		fmt.Fprintf(out, "%g", v)
+		f := float64(v)
+		if math.IsInf(f, 0) || math.IsNaN(f) {
+			return fmt.Errorf("cannot convert %s to JSON", v)
+		}
+		out.WriteString(strconv.FormatFloat(f, 'g', -1, 64))
 	case skylark.String:
-		// TODO(adonovan): test with all bytes.
-		// I think JSON can represent only UTF-16 encoded Unicode.
-		fmt.Fprintf(out, "%q", string(v))
+		writeJSONString(out, string(v))
 	case skylark.Indexable: // Tuple, List
 		out.WriteByte('[')
 		for i, n := 0, skylark.Len(v); i < n; i++ {
 			if i > 0 {
 				out.WriteString(", ")
 			}
-			if err := writeJSON(out, v.Index(i)); err != nil {
+			if err := writeJSONDepth(out, v.Index(i), depth+1); err != nil {
 				return err
 			}
 		}
 		out.WriteByte(']')
-	case *Struct:
+	case *skylark.Dict:
 		out.WriteByte('{')
-		for i, e := range v.entries {
+		for i, item := range v.Items() {
+			k, ok := item[0].(skylark.String)
+			if !ok {
+				return fmt.Errorf("cannot convert dict with %s key to JSON", item[0].Type())
+			}
 			if i > 0 {
 				out.WriteString(", ")
 			}
-			if err := writeJSON(out, skylark.String(e.name)); err != nil {
+			writeJSONString(out, string(k))
+			out.WriteString(": ")
+			if err := writeJSONDepth(out, item[1], depth+1); err != nil {
 				return err
 			}
+		}
+		out.WriteByte('}')
+	case *Struct:
+		out.WriteByte('{')
+		for i, e := range v.entries {
+			if i > 0 {
+				out.WriteString(", ")
+			}
+			writeJSONString(out, e.name)
 			out.WriteString(": ")
-			if err := writeJSON(out, e.value); err != nil {
+			if err := writeJSONDepth(out, e.value, depth+1); err != nil {
 				return err
 			}
 		}
 		out.WriteByte('}')
 	default:
-		// function, builtin, set, dict, and all user-defined types.
+		// function, builtin, set, and all user-defined types.
 		return fmt.Errorf("cannot convert %s to JSON", v.Type())
 	}
 	return nil
 }
 
+// writeJSONString writes s as a JSON string literal.
+// Invalid UTF-8 bytes are replaced by U+FFFD.
+func writeJSONString(out *bytes.Buffer, s string) {
+	out.WriteByte('"')
+	for _, r := range s {
+		switch {
+		case r == '"' || r == '\\':
+			out.WriteByte('\\')
+			out.WriteRune(r)
+		case r == '\n':
+			out.WriteString(`\n`)
+		case r == '\t':
+			out.WriteString(`\t`)
+		case r < 0x20:
+			fmt.Fprintf(out, `\u%04x`, r)
+		default:
+			out.WriteRune(r)
+		}
+	}
+	out.WriteByte('"')
+}
+
 func (s *Struct) Len() int { return len(s.entries) }
 
 // AttrNames returns a new sorted list of the struct fields.
@@ -318,7 +379,7 @@ func structsEqual(x, y *Struct, depth int) (bool, error) {
 	}
 
 	if eq, err := skylark.Equal(x.constructor, y.constructor); err != nil {
-		return false, fmt.Errorf("error comparing struct constructors: %v",
+		return false, fmt.Errorf("error comparing struct constructors %v and %v: %v",
 			x.constructor, y.constructor, err)
 	} else if !eq {
 		return false, nil
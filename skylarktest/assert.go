@@ -0,0 +1,121 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package skylarktest
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/google/skylark"
+	"github.com/google/skylark/skylarkstruct"
+	"github.com/google/skylark/syntax"
+)
+
+// Assert is an 'assert' module for Skylark test scripts run outside a
+// Go test, such as by a command-line tool. It is a struct with these
+// functions:
+//
+// 	eq(x, y)		# fails unless x == y
+// 	ne(x, y)		# fails unless x != y
+// 	true(cond, msg)		# fails unless cond is true; msg is optional
+// 	lt(x, y)		# fails unless x < y
+// 	contains(x, y)		# fails unless y in x
+// 	fails(f, pattern)	# fails unless f() fails with an error matching pattern
+//
+// Unlike the functions of the module loaded by LoadAssertModule, which
+// report errors to a Go test and continue execution, these functions
+// fail like any other built-in, so the resulting EvalError halts
+// execution and its backtrace indicates the position of the failed
+// assertion. An application can add 'assert' to the environment like so:
+//
+// 	globals := skylark.StringDict{
+// 		"assert":  skylarktest.Assert,
+// 	}
+//
+var Assert = skylarkstruct.FromStringDict(skylark.String("assert"), skylark.StringDict{
+	"contains": skylark.NewBuiltin("assert.contains", assertContains),
+	"eq":       skylark.NewBuiltin("assert.eq", assertCompare),
+	"fails":    skylark.NewBuiltin("assert.fails", assertFails),
+	"lt":       skylark.NewBuiltin("assert.lt", assertCompare),
+	"ne":       skylark.NewBuiltin("assert.ne", assertCompare),
+	"true":     skylark.NewBuiltin("assert.true", assertTrue),
+})
+
+// assertCompare implements assert.eq, assert.ne, and assert.lt.
+func assertCompare(thread *skylark.Thread, fn *skylark.Builtin, args skylark.Tuple, kwargs []skylark.Tuple) (skylark.Value, error) {
+	var x, y skylark.Value
+	if err := skylark.UnpackPositionalArgs(fn.Name(), args, kwargs, 2, &x, &y); err != nil {
+		return nil, err
+	}
+	var op syntax.Token
+	var format string
+	switch fn.Name() {
+	case "assert.eq":
+		op, format = syntax.EQL, "%s != %s"
+	case "assert.ne":
+		op, format = syntax.NEQ, "%s == %s"
+	case "assert.lt":
+		op, format = syntax.LT, "%s is not less than %s"
+	}
+	ok, err := skylark.Compare(op, x, y)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", fn.Name(), err)
+	}
+	if !ok {
+		return nil, fmt.Errorf(format, x, y)
+	}
+	return skylark.None, nil
+}
+
+// assert.true(cond, msg="assertion failed")
+func assertTrue(thread *skylark.Thread, fn *skylark.Builtin, args skylark.Tuple, kwargs []skylark.Tuple) (skylark.Value, error) {
+	var cond skylark.Value
+	msg := "assertion failed"
+	if err := skylark.UnpackPositionalArgs(fn.Name(), args, kwargs, 1, &cond, &msg); err != nil {
+		return nil, err
+	}
+	if !cond.Truth() {
+		return nil, fmt.Errorf("%s", msg)
+	}
+	return skylark.None, nil
+}
+
+// assert.contains(x, y)
+func assertContains(thread *skylark.Thread, fn *skylark.Builtin, args skylark.Tuple, kwargs []skylark.Tuple) (skylark.Value, error) {
+	var x, y skylark.Value
+	if err := skylark.UnpackPositionalArgs(fn.Name(), args, kwargs, 2, &x, &y); err != nil {
+		return nil, err
+	}
+	ok, err := skylark.Binary(syntax.IN, y, x)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", fn.Name(), err)
+	}
+	if !ok.Truth() {
+		return nil, fmt.Errorf("%s does not contain %s", x, y)
+	}
+	return skylark.None, nil
+}
+
+// assert.fails(f, pattern) calls f() and fails unless it fails
+// with an error whose message matches the regular expression.
+func assertFails(thread *skylark.Thread, fn *skylark.Builtin, args skylark.Tuple, kwargs []skylark.Tuple) (skylark.Value, error) {
+	var f skylark.Callable
+	var pattern string
+	if err := skylark.UnpackPositionalArgs(fn.Name(), args, kwargs, 2, &f, &pattern); err != nil {
+		return nil, err
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", fn.Name(), err)
+	}
+	_, err = f.Call(thread, nil, nil)
+	if err == nil {
+		return nil, fmt.Errorf("evaluation succeeded unexpectedly (want error matching %q)", pattern)
+	}
+	if !re.MatchString(err.Error()) {
+		return nil, fmt.Errorf("regular expression (%s) did not match error (%s)", pattern, err)
+	}
+	return skylark.None, nil
+}
@@ -0,0 +1,78 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package skylarktest
+
+import (
+	"fmt"
+
+	"github.com/google/skylark"
+	"github.com/google/skylark/internal/chunkedfile"
+	"github.com/google/skylark/resolve"
+	"github.com/google/skylark/syntax"
+)
+
+// ParseChunks reads a "chunked" test file and checks that executing
+// each chunk reports exactly the errors it expects, on the expected
+// lines. It reports any discrepancy to r.
+//
+// A chunked file consists of chunks of Skylark source separated by
+// lines containing only "---". Each chunk is parsed, resolved, and
+// executed in turn, in a copy of the predeclared environment, using the
+// specified thread. A line containing "###" is an expectation that
+// executing the chunk reports an error on that line: the text following
+// the hashes is a Go string literal denoting a regular expression that
+// must match the error message.
+//
+//	x = 1 / 0 ### "division by zero"
+//	---
+//	x = 1
+//	print(x + "") ### "unknown binary op: int \\+ string"
+//	---
+//	def f():
+//	  return y ### "undefined: y"
+//
+// A syntax error stops parsing, so a chunk may expect at most one;
+// a chunk may expect several errors from the resolver. An execution
+// error is attributed to the innermost call on the stack within the
+// chunk, and also stops execution.
+func ParseChunks(r Reporter, thread *skylark.Thread, filename string, predeclared skylark.StringDict) {
+	report := errorfReporter{r}
+	for _, chunk := range chunkedfile.Read(filename, report) {
+		globals := predeclared.Clone()
+		err := skylark.ExecFile(thread, filename, chunk.Source, globals)
+		switch err := err.(type) {
+		case nil:
+			// success
+		case syntax.Error:
+			chunk.GotError(int(err.Pos.Line), err.Msg)
+		case resolve.ErrorList:
+			for _, err := range err {
+				chunk.GotError(int(err.Pos.Line), err.Msg)
+			}
+		case *skylark.EvalError:
+			found := false
+			for _, fr := range err.Stack() { // innermost first
+				if posn := fr.Position(); posn.Filename() == filename {
+					chunk.GotError(int(posn.Line), err.Error())
+					found = true
+					break
+				}
+			}
+			if !found {
+				r.Error(err.Backtrace())
+			}
+		default:
+			r.Error(err)
+		}
+		chunk.Done()
+	}
+}
+
+// errorfReporter adapts a Reporter to the chunkedfile.Reporter interface.
+type errorfReporter struct{ r Reporter }
+
+func (r errorfReporter) Errorf(format string, args ...interface{}) {
+	r.r.Error(fmt.Sprintf(format, args...))
+}
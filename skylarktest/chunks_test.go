@@ -0,0 +1,67 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package skylarktest_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/google/skylark"
+	"github.com/google/skylark/skylarktest"
+)
+
+func TestParseChunks(t *testing.T) {
+	for _, file := range []string{
+		"testdata/static.sky",
+		"testdata/dynamic.sky",
+	} {
+		filename := skylarktest.DataFile("skylark/skylarktest", file)
+		skylarktest.ParseChunks(t, new(skylark.Thread), filename, nil)
+	}
+}
+
+// A recorder records the errors reported to it.
+type recorder []string
+
+func (r *recorder) Error(args ...interface{}) { *r = append(*r, fmt.Sprint(args...)) }
+
+func TestParseChunksMismatch(t *testing.T) {
+	f, err := ioutil.TempFile("", "chunks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	const src = `x = 1 ### "oops"
+---
+y = 1 // 0 ### "oops"
+---
+z = 1
+z += ""
+`
+	if _, err := f.WriteString(src); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	var r recorder
+	skylarktest.ParseChunks(&r, new(skylark.Thread), f.Name(), nil)
+	got := strings.Join(r, "\n")
+	for _, want := range []string{
+		`:1: expected error matching "oops"`,
+		`:3: error "floored division by zero" does not match pattern "oops"`,
+		`:6: unexpected error: unknown binary op: int \+ string`,
+	} {
+		if !regexp.MustCompile(want).MatchString(got) {
+			t.Errorf("reported errors do not match %q; got:\n%s", want, got)
+		}
+	}
+	if len(r) != 3 {
+		t.Errorf("got %d errors, want 3", len(r))
+	}
+}
@@ -10,6 +10,12 @@
 //
 // The assert.error function, which reports errors to the current Go
 // testing.T, requires that clients call SetTest(thread, t) before use.
+//
+// Test scripts that run outside a Go test may instead use the Assert
+// module, whose functions fail like ordinary built-ins.
+//
+// ParseChunks checks that the errors reported by executing each chunk
+// of a test file occur on the lines annotated with "###" comments.
 package skylarktest
 
 import (
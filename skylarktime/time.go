@@ -0,0 +1,372 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package skylarktime defines the Skylark 'time' module and the
+// 'time' and 'duration' data types, an optional language extension
+// for reasoning about timestamps.
+package skylarktime
+
+import (
+	"fmt"
+	"math"
+	"math/big"
+	"time"
+
+	"github.com/google/skylark"
+	"github.com/google/skylark/skylarkstruct"
+	"github.com/google/skylark/syntax"
+)
+
+// Module is the 'time' module, a struct with these functions and constants:
+//
+// 	now()				# the current time, as a time
+// 	from_timestamp(sec, nsec=0)	# the UTC time sec seconds and nsec nanoseconds after the Unix epoch
+// 	parse_time(x, format=RFC3339)	# parses string x using a Go time layout
+// 	parse_duration(d)		# parses a duration string such as "1h30m"
+// 	nanosecond, microsecond, millisecond, second, minute, hour	# durations
+//
+// A time has the fields year, month, day, hour, minute, second,
+// nanosecond, unix, and unix_nano, and a format(layout) method that
+// formats it using a Go time layout. A duration has the fields hours,
+// minutes, and seconds (floats) and nanoseconds (an int).
+//
+// The arithmetic operators apply to times and durations:
+//
+// 	time - time		# duration
+// 	time ± duration		# time
+// 	duration ± duration	# duration
+// 	duration * int		# duration
+// 	duration // int		# duration
+// 	duration / duration	# float
+// 	duration // duration	# int
+//
+// Times and durations may be compared using ==, <, and so on.
+//
+// An application can add 'time' to the Skylark environment like so:
+//
+// 	globals := skylark.StringDict{
+// 		"time":  skylarktime.Module,
+// 	}
+//
+// By default, time.now reports the current time of the host.
+// An application may use SetNow to provide a different clock,
+// for example to make a program's behavior deterministic.
+var Module = skylarkstruct.FromStringDict(skylark.String("time"), skylark.StringDict{
+	"now":            skylark.NewBuiltin("time.now", now),
+	"from_timestamp": skylark.NewBuiltin("time.from_timestamp", fromTimestamp),
+	"parse_time":     skylark.NewBuiltin("time.parse_time", parseTime),
+	"parse_duration": skylark.NewBuiltin("time.parse_duration", parseDuration),
+
+	"nanosecond":  Duration(time.Nanosecond),
+	"microsecond": Duration(time.Microsecond),
+	"millisecond": Duration(time.Millisecond),
+	"second":      Duration(time.Second),
+	"minute":      Duration(time.Minute),
+	"hour":        Duration(time.Hour),
+})
+
+const nowKey = "skylarktime.now"
+
+// SetNow sets the function that the time.now built-in calls to obtain
+// the current time when executed by the specified thread.
+// If now is nil, time.now reports the current time of the host.
+func SetNow(thread *skylark.Thread, now func() time.Time) {
+	thread.SetLocal(nowKey, now)
+}
+
+func now(thread *skylark.Thread, fn *skylark.Builtin, args skylark.Tuple, kwargs []skylark.Tuple) (skylark.Value, error) {
+	if err := skylark.UnpackPositionalArgs(fn.Name(), args, kwargs, 0); err != nil {
+		return nil, err
+	}
+	if now, ok := thread.Local(nowKey).(func() time.Time); ok && now != nil {
+		return Time(now()), nil
+	}
+	return Time(time.Now()), nil
+}
+
+func fromTimestamp(thread *skylark.Thread, fn *skylark.Builtin, args skylark.Tuple, kwargs []skylark.Tuple) (skylark.Value, error) {
+	var sec, nsec skylark.Value = nil, skylark.MakeInt(0)
+	if err := skylark.UnpackArgs(fn.Name(), args, kwargs, "sec", &sec, "nsec?", &nsec); err != nil {
+		return nil, err
+	}
+	s, err := toInt64(fn, sec)
+	if err != nil {
+		return nil, err
+	}
+	ns, err := toInt64(fn, nsec)
+	if err != nil {
+		return nil, err
+	}
+	return Time(time.Unix(s, ns).UTC()), nil
+}
+
+func parseTime(thread *skylark.Thread, fn *skylark.Builtin, args skylark.Tuple, kwargs []skylark.Tuple) (skylark.Value, error) {
+	var x string
+	format := time.RFC3339
+	if err := skylark.UnpackArgs(fn.Name(), args, kwargs, "x", &x, "format?", &format); err != nil {
+		return nil, err
+	}
+	t, err := time.Parse(format, x)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", fn.Name(), err)
+	}
+	return Time(t), nil
+}
+
+func parseDuration(thread *skylark.Thread, fn *skylark.Builtin, args skylark.Tuple, kwargs []skylark.Tuple) (skylark.Value, error) {
+	var s string
+	if err := skylark.UnpackPositionalArgs(fn.Name(), args, kwargs, 1, &s); err != nil {
+		return nil, err
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", fn.Name(), err)
+	}
+	return Duration(d), nil
+}
+
+// toInt64 converts an int argument to an int64.
+func toInt64(fn *skylark.Builtin, x skylark.Value) (int64, error) {
+	i, ok := x.(skylark.Int)
+	if !ok {
+		return 0, fmt.Errorf("%s: got %s, want int", fn.Name(), x.Type())
+	}
+	n, ok := i.Int64()
+	if !ok {
+		return 0, fmt.Errorf("%s: int %s out of range", fn.Name(), i)
+	}
+	return n, nil
+}
+
+// Time is a Skylark value that represents an instant in time.
+// Its string form is its RFC 3339 encoding.
+type Time time.Time
+
+var (
+	_ skylark.HasAttrs   = Time{}
+	_ skylark.HasBinary  = Time{}
+	_ skylark.Comparable = Time{}
+)
+
+func (t Time) String() string        { return time.Time(t).Format(time.RFC3339Nano) }
+func (t Time) Type() string          { return "time" }
+func (t Time) Freeze()               {} // immutable
+func (t Time) Truth() skylark.Bool   { return skylark.Bool(!time.Time(t).IsZero()) }
+func (t Time) Hash() (uint32, error) { return hashInt64(time.Time(t).UnixNano()), nil }
+
+func (t Time) CompareSameType(op syntax.Token, y skylark.Value, depth int) (bool, error) {
+	x, u := time.Time(t), time.Time(y.(Time))
+	cmp := 0
+	if x.Before(u) {
+		cmp = -1
+	} else if x.After(u) {
+		cmp = +1
+	}
+	return threeway(op, cmp), nil
+}
+
+func (t Time) Binary(op syntax.Token, y skylark.Value, side skylark.Side) (skylark.Value, error) {
+	x := time.Time(t)
+	switch y := y.(type) {
+	case Time:
+		if op == syntax.MINUS && side == skylark.Left {
+			// Sub saturates; report overflow instead.
+			z := x.Sub(time.Time(y))
+			if !time.Time(y).Add(z).Equal(x) {
+				return nil, fmt.Errorf("duration overflow")
+			}
+			return Duration(z), nil
+		}
+	case Duration:
+		switch {
+		case op == syntax.PLUS:
+			return Time(x.Add(time.Duration(y))), nil
+		case op == syntax.MINUS && side == skylark.Left:
+			return Time(x.Add(-time.Duration(y))), nil
+		}
+	}
+	return nil, nil // unhandled
+}
+
+var timeAttrNames = []string{"day", "format", "hour", "minute", "month", "nanosecond", "second", "unix", "unix_nano", "year"}
+
+func (t Time) AttrNames() []string { return timeAttrNames }
+
+func (t Time) Attr(name string) (skylark.Value, error) {
+	x := time.Time(t)
+	switch name {
+	case "year":
+		return skylark.MakeInt(x.Year()), nil
+	case "month":
+		return skylark.MakeInt(int(x.Month())), nil
+	case "day":
+		return skylark.MakeInt(x.Day()), nil
+	case "hour":
+		return skylark.MakeInt(x.Hour()), nil
+	case "minute":
+		return skylark.MakeInt(x.Minute()), nil
+	case "second":
+		return skylark.MakeInt(x.Second()), nil
+	case "nanosecond":
+		return skylark.MakeInt(x.Nanosecond()), nil
+	case "unix":
+		return skylark.MakeInt64(x.Unix()), nil
+	case "unix_nano":
+		return skylark.MakeInt64(x.UnixNano()), nil
+	case "format":
+		return skylark.NewBuiltin("format", func(thread *skylark.Thread, fn *skylark.Builtin, args skylark.Tuple, kwargs []skylark.Tuple) (skylark.Value, error) {
+			var layout string
+			if err := skylark.UnpackPositionalArgs("format", args, kwargs, 1, &layout); err != nil {
+				return nil, err
+			}
+			return skylark.String(x.Format(layout)), nil
+		}), nil
+	}
+	return nil, nil // no such attribute
+}
+
+// Duration is a Skylark value that represents the elapsed time
+// between two instants. Its string form is that of time.Duration,
+// for example "1h30m0s".
+type Duration time.Duration
+
+var (
+	_ skylark.HasAttrs   = Duration(0)
+	_ skylark.HasBinary  = Duration(0)
+	_ skylark.Comparable = Duration(0)
+)
+
+func (d Duration) String() string        { return time.Duration(d).String() }
+func (d Duration) Type() string          { return "duration" }
+func (d Duration) Freeze()               {} // immutable
+func (d Duration) Truth() skylark.Bool   { return d != 0 }
+func (d Duration) Hash() (uint32, error) { return hashInt64(int64(d)), nil }
+
+func (d Duration) CompareSameType(op syntax.Token, y skylark.Value, depth int) (bool, error) {
+	x, e := d, y.(Duration)
+	cmp := 0
+	if x < e {
+		cmp = -1
+	} else if x > e {
+		cmp = +1
+	}
+	return threeway(op, cmp), nil
+}
+
+func (d Duration) Binary(op syntax.Token, y skylark.Value, side skylark.Side) (skylark.Value, error) {
+	switch y := y.(type) {
+	case Duration:
+		x := d
+		if side == skylark.Right {
+			x, y = y, x
+		}
+		switch op {
+		case syntax.PLUS:
+			if z := x + y; (z > x) == (y > 0) {
+				return z, nil
+			}
+			return nil, fmt.Errorf("duration overflow")
+		case syntax.MINUS:
+			if z := x - y; (z < x) == (y > 0) {
+				return z, nil
+			}
+			return nil, fmt.Errorf("duration overflow")
+		case syntax.SLASH:
+			if y == 0 {
+				return nil, fmt.Errorf("division by zero")
+			}
+			return skylark.Float(float64(x) / float64(y)), nil
+		case syntax.SLASHSLASH:
+			if y == 0 {
+				return nil, fmt.Errorf("division by zero")
+			}
+			if x == math.MinInt64 && y == -1 {
+				// The quotient, 1<<63, does not fit in an int64.
+				return skylark.MakeBigInt(new(big.Int).Lsh(big.NewInt(1), 63)), nil
+			}
+			return skylark.MakeInt64(floorDiv(int64(x), int64(y))), nil
+		}
+
+	case skylark.Int:
+		n, ok := y.Int64()
+		switch {
+		case op == syntax.STAR:
+			if !ok || n != 0 && (int64(d)*n/n != int64(d) || n == -1 && d == math.MinInt64) {
+				return nil, fmt.Errorf("duration overflow")
+			}
+			return d * Duration(n), nil
+		case op == syntax.SLASHSLASH && side == skylark.Left:
+			if !ok {
+				// |d| < |n|, so the quotient rounds to 0, or to -1
+				// if d and n have opposite signs.
+				if d != 0 && (d < 0) != (y.Sign() < 0) {
+					return Duration(-1), nil
+				}
+				return Duration(0), nil
+			}
+			if n == 0 {
+				return nil, fmt.Errorf("division by zero")
+			}
+			if n == -1 && d == math.MinInt64 {
+				return nil, fmt.Errorf("duration overflow")
+			}
+			return Duration(floorDiv(int64(d), n)), nil
+		}
+
+	case Time:
+		if op == syntax.PLUS {
+			return y.Binary(op, d, !side)
+		}
+	}
+	return nil, nil // unhandled
+}
+
+var durationAttrNames = []string{"hours", "minutes", "nanoseconds", "seconds"}
+
+func (d Duration) AttrNames() []string { return durationAttrNames }
+
+func (d Duration) Attr(name string) (skylark.Value, error) {
+	switch name {
+	case "hours":
+		return skylark.Float(time.Duration(d).Hours()), nil
+	case "minutes":
+		return skylark.Float(time.Duration(d).Minutes()), nil
+	case "seconds":
+		return skylark.Float(time.Duration(d).Seconds()), nil
+	case "nanoseconds":
+		return skylark.MakeInt64(int64(d)), nil
+	}
+	return nil, nil // no such attribute
+}
+
+// floorDiv returns x // y, rounding towards minus infinity.
+func floorDiv(x, y int64) int64 {
+	q := x / y
+	if (x%y != 0) && ((x < 0) != (y < 0)) {
+		q--
+	}
+	return q
+}
+
+func hashInt64(x int64) uint32 { return uint32(x) ^ uint32(x>>32) }
+
+// threeway interprets a three-way comparison value cmp (-1, 0, +1)
+// as a boolean comparison (e.g. x < y).
+func threeway(op syntax.Token, cmp int) bool {
+	switch op {
+	case syntax.EQL:
+		return cmp == 0
+	case syntax.NEQ:
+		return cmp != 0
+	case syntax.LE:
+		return cmp <= 0
+	case syntax.LT:
+		return cmp < 0
+	case syntax.GE:
+		return cmp >= 0
+	case syntax.GT:
+		return cmp > 0
+	}
+	panic(op)
+}
@@ -0,0 +1,219 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package syntax
+
+// Equal reports whether two syntax trees are structurally equal.
+// It ignores positions, the raw text of literals, the path of a File,
+// and all information recorded by the resolver, so that, for example,
+// a tree is equal to the tree obtained by formatting and re-parsing it.
+//
+// Literals are compared by value, so "a" is equal to 'a' and 0x10 to 16.
+func Equal(x, y Node) bool {
+	if x == nil || y == nil {
+		return x == nil && y == nil
+	}
+
+	switch x := x.(type) {
+	case *File:
+		y, ok := y.(*File)
+		return ok && equalStmts(x.Stmts, y.Stmts)
+
+	case *ExprStmt:
+		y, ok := y.(*ExprStmt)
+		return ok && Equal(x.X, y.X)
+
+	case *BranchStmt:
+		y, ok := y.(*BranchStmt)
+		return ok && x.Token == y.Token
+
+	case *IfStmt:
+		y, ok := y.(*IfStmt)
+		return ok &&
+			Equal(x.Cond, y.Cond) &&
+			equalStmts(x.True, y.True) &&
+			equalStmts(x.False, y.False)
+
+	case *AssignStmt:
+		y, ok := y.(*AssignStmt)
+		return ok &&
+			x.Op == y.Op &&
+			Equal(x.LHS, y.LHS) &&
+			Equal(x.RHS, y.RHS)
+
+	case *DefStmt:
+		y, ok := y.(*DefStmt)
+		return ok &&
+			Equal(x.Name, y.Name) &&
+			equalFunctions(&x.Function, &y.Function)
+
+	case *ForStmt:
+		y, ok := y.(*ForStmt)
+		return ok &&
+			Equal(x.Vars, y.Vars) &&
+			Equal(x.X, y.X) &&
+			equalStmts(x.Body, y.Body)
+
+	case *DelStmt:
+		y, ok := y.(*DelStmt)
+		return ok && Equal(x.Target, y.Target)
+
+	case *ReturnStmt:
+		y, ok := y.(*ReturnStmt)
+		return ok && Equal(x.Result, y.Result)
+
+	case *LoadStmt:
+		y, ok := y.(*LoadStmt)
+		if !ok ||
+			!Equal(x.Module, y.Module) ||
+			len(x.From) != len(y.From) ||
+			len(x.To) != len(y.To) {
+			return false
+		}
+		for i := range x.From {
+			if !Equal(x.From[i], y.From[i]) {
+				return false
+			}
+		}
+		for i := range x.To {
+			if !Equal(x.To[i], y.To[i]) {
+				return false
+			}
+		}
+		return true
+
+	case *Ident:
+		y, ok := y.(*Ident)
+		return ok && x.Name == y.Name
+
+	case *Literal:
+		y, ok := y.(*Literal)
+		return ok && x.Token == y.Token && x.Value == y.Value
+
+	case *ListExpr:
+		y, ok := y.(*ListExpr)
+		return ok && equalExprs(x.List, y.List)
+
+	case *CondExpr:
+		y, ok := y.(*CondExpr)
+		return ok &&
+			Equal(x.Cond, y.Cond) &&
+			Equal(x.True, y.True) &&
+			Equal(x.False, y.False)
+
+	case *IndexExpr:
+		y, ok := y.(*IndexExpr)
+		return ok && Equal(x.X, y.X) && Equal(x.Y, y.Y)
+
+	case *DictEntry:
+		y, ok := y.(*DictEntry)
+		return ok && Equal(x.Key, y.Key) && Equal(x.Value, y.Value)
+
+	case *SliceExpr:
+		y, ok := y.(*SliceExpr)
+		return ok &&
+			Equal(x.X, y.X) &&
+			Equal(x.Lo, y.Lo) &&
+			Equal(x.Hi, y.Hi) &&
+			Equal(x.Step, y.Step)
+
+	case *Comprehension:
+		y, ok := y.(*Comprehension)
+		if !ok ||
+			x.Curly != y.Curly ||
+			!Equal(x.Body, y.Body) ||
+			len(x.Clauses) != len(y.Clauses) {
+			return false
+		}
+		for i := range x.Clauses {
+			if !Equal(x.Clauses[i], y.Clauses[i]) {
+				return false
+			}
+		}
+		return true
+
+	case *ForClause:
+		y, ok := y.(*ForClause)
+		return ok && Equal(x.Vars, y.Vars) && Equal(x.X, y.X)
+
+	case *IfClause:
+		y, ok := y.(*IfClause)
+		return ok && Equal(x.Cond, y.Cond)
+
+	case *DotExpr:
+		y, ok := y.(*DotExpr)
+		return ok && Equal(x.X, y.X) && Equal(x.Name, y.Name)
+
+	case *OptDotExpr:
+		y, ok := y.(*OptDotExpr)
+		return ok && Equal(x.X, y.X) && Equal(x.Name, y.Name)
+
+	case *CallExpr:
+		y, ok := y.(*CallExpr)
+		return ok && Equal(x.Fn, y.Fn) && equalExprs(x.Args, y.Args)
+
+	case *DictExpr:
+		y, ok := y.(*DictExpr)
+		return ok && equalExprs(x.List, y.List)
+
+	case *UnaryExpr:
+		y, ok := y.(*UnaryExpr)
+		return ok && x.Op == y.Op && Equal(x.X, y.X)
+
+	case *BinaryExpr:
+		y, ok := y.(*BinaryExpr)
+		return ok && x.Op == y.Op && Equal(x.X, y.X) && Equal(x.Y, y.Y)
+
+	case *ComparisonChain:
+		y, ok := y.(*ComparisonChain)
+		if !ok || len(x.Ops) != len(y.Ops) {
+			return false
+		}
+		for i := range x.Ops {
+			if x.Ops[i] != y.Ops[i] {
+				return false
+			}
+		}
+		return equalExprs(x.Operands, y.Operands)
+
+	case *LambdaExpr:
+		y, ok := y.(*LambdaExpr)
+		return ok && equalFunctions(&x.Function, &y.Function)
+
+	case *TupleExpr:
+		y, ok := y.(*TupleExpr)
+		return ok && equalExprs(x.List, y.List)
+
+	default:
+		panic(x)
+	}
+}
+
+func equalExprs(x, y []Expr) bool {
+	if len(x) != len(y) {
+		return false
+	}
+	for i := range x {
+		if !Equal(x[i], y[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func equalStmts(x, y []Stmt) bool {
+	if len(x) != len(y) {
+		return false
+	}
+	for i := range x {
+		if !Equal(x[i], y[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func equalFunctions(x, y *Function) bool {
+	return equalExprs(x.Params, y.Params) && equalStmts(x.Body, y.Body)
+}
@@ -0,0 +1,230 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package syntax
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// MarshalJSON returns a JSON encoding of the syntax tree of file f,
+// for use by tools written in other languages.
+//
+// Each node is encoded as a JSON object whose "kind" field holds the
+// name of its Go type (e.g. "BinaryExpr"), whose "start" and "end"
+// fields hold the node's Span as objects with "line" and "col" fields,
+// and whose other fields hold the node's children and attributes,
+// named after the corresponding Go struct fields but in lower case.
+// Tokens such as operators are encoded as strings ("+", "not in").
+// Absent optional children are encoded as null. Information recorded
+// by the resolver is not encoded.
+//
+// The encoding is stable: object keys appear in sorted order, so the
+// encodings of two trees may be compared textually.
+func MarshalJSON(f *File) ([]byte, error) {
+	return json.Marshal(jsonNode(f))
+}
+
+type jsonObject map[string]interface{}
+
+func jsonPos(pos Position) jsonObject {
+	return jsonObject{"line": pos.Line, "col": pos.Col}
+}
+
+// jsonNode returns the JSON-encodable representation of node n.
+func jsonNode(n Node) interface{} {
+	if n == nil {
+		return nil
+	}
+
+	var obj jsonObject
+	switch n := n.(type) {
+	case *File:
+		obj = jsonObject{"kind": "File", "path": n.Path, "stmts": jsonStmts(n.Stmts)}
+
+	case *ExprStmt:
+		obj = jsonObject{"kind": "ExprStmt", "x": jsonNode(n.X)}
+
+	case *BranchStmt:
+		obj = jsonObject{"kind": "BranchStmt", "token": n.Token.String()}
+
+	case *IfStmt:
+		obj = jsonObject{
+			"kind":  "IfStmt",
+			"cond":  jsonNode(n.Cond),
+			"true":  jsonStmts(n.True),
+			"false": jsonStmts(n.False),
+		}
+
+	case *AssignStmt:
+		obj = jsonObject{
+			"kind": "AssignStmt",
+			"op":   n.Op.String(),
+			"lhs":  jsonNode(n.LHS),
+			"rhs":  jsonNode(n.RHS),
+		}
+
+	case *DefStmt:
+		obj = jsonFunction("DefStmt", &n.Function)
+		obj["name"] = jsonNode(n.Name)
+
+	case *ForStmt:
+		obj = jsonObject{
+			"kind": "ForStmt",
+			"vars": jsonNode(n.Vars),
+			"x":    jsonNode(n.X),
+			"body": jsonStmts(n.Body),
+		}
+
+	case *DelStmt:
+		obj = jsonObject{"kind": "DelStmt", "target": jsonNode(n.Target)}
+
+	case *ReturnStmt:
+		obj = jsonObject{"kind": "ReturnStmt", "result": jsonNode(n.Result)}
+
+	case *LoadStmt:
+		from := make([]interface{}, len(n.From))
+		for i, id := range n.From {
+			from[i] = jsonNode(id)
+		}
+		to := make([]interface{}, len(n.To))
+		for i, id := range n.To {
+			to[i] = jsonNode(id)
+		}
+		obj = jsonObject{
+			"kind":   "LoadStmt",
+			"module": jsonNode(n.Module),
+			"from":   from,
+			"to":     to,
+		}
+
+	case *Ident:
+		obj = jsonObject{"kind": "Ident", "name": n.Name}
+
+	case *Literal:
+		obj = jsonObject{
+			"kind":  "Literal",
+			"token": n.Token.String(),
+			"raw":   n.Raw,
+			"value": n.Value,
+		}
+
+	case *ListExpr:
+		obj = jsonObject{"kind": "ListExpr", "list": jsonExprs(n.List)}
+
+	case *CondExpr:
+		obj = jsonObject{
+			"kind":  "CondExpr",
+			"cond":  jsonNode(n.Cond),
+			"true":  jsonNode(n.True),
+			"false": jsonNode(n.False),
+		}
+
+	case *IndexExpr:
+		obj = jsonObject{"kind": "IndexExpr", "x": jsonNode(n.X), "y": jsonNode(n.Y)}
+
+	case *DictEntry:
+		obj = jsonObject{"kind": "DictEntry", "key": jsonNode(n.Key), "value": jsonNode(n.Value)}
+
+	case *SliceExpr:
+		obj = jsonObject{
+			"kind": "SliceExpr",
+			"x":    jsonNode(n.X),
+			"lo":   jsonNode(n.Lo),
+			"hi":   jsonNode(n.Hi),
+			"step": jsonNode(n.Step),
+		}
+
+	case *Comprehension:
+		clauses := make([]interface{}, len(n.Clauses))
+		for i, clause := range n.Clauses {
+			clauses[i] = jsonNode(clause)
+		}
+		obj = jsonObject{
+			"kind":    "Comprehension",
+			"curly":   n.Curly,
+			"body":    jsonNode(n.Body),
+			"clauses": clauses,
+		}
+
+	case *ForClause:
+		obj = jsonObject{"kind": "ForClause", "vars": jsonNode(n.Vars), "x": jsonNode(n.X)}
+
+	case *IfClause:
+		obj = jsonObject{"kind": "IfClause", "cond": jsonNode(n.Cond)}
+
+	case *DotExpr:
+		obj = jsonObject{"kind": "DotExpr", "x": jsonNode(n.X), "name": jsonNode(n.Name)}
+
+	case *OptDotExpr:
+		obj = jsonObject{"kind": "OptDotExpr", "x": jsonNode(n.X), "name": jsonNode(n.Name)}
+
+	case *CallExpr:
+		obj = jsonObject{"kind": "CallExpr", "fn": jsonNode(n.Fn), "args": jsonExprs(n.Args)}
+
+	case *DictExpr:
+		obj = jsonObject{"kind": "DictExpr", "list": jsonExprs(n.List)}
+
+	case *UnaryExpr:
+		obj = jsonObject{"kind": "UnaryExpr", "op": n.Op.String(), "x": jsonNode(n.X)}
+
+	case *BinaryExpr:
+		obj = jsonObject{
+			"kind": "BinaryExpr",
+			"x":    jsonNode(n.X),
+			"op":   n.Op.String(),
+			"y":    jsonNode(n.Y),
+		}
+
+	case *ComparisonChain:
+		ops := make([]interface{}, len(n.Ops))
+		for i, op := range n.Ops {
+			ops[i] = op.String()
+		}
+		obj = jsonObject{
+			"kind":     "ComparisonChain",
+			"operands": jsonExprs(n.Operands),
+			"ops":      ops,
+		}
+
+	case *LambdaExpr:
+		obj = jsonFunction("LambdaExpr", &n.Function)
+
+	case *TupleExpr:
+		obj = jsonObject{"kind": "TupleExpr", "list": jsonExprs(n.List)}
+
+	default:
+		panic(fmt.Sprintf("unexpected node %T", n))
+	}
+
+	start, end := n.Span()
+	obj["start"] = jsonPos(start)
+	obj["end"] = jsonPos(end)
+	return obj
+}
+
+func jsonExprs(list []Expr) []interface{} {
+	res := make([]interface{}, len(list))
+	for i, x := range list {
+		res[i] = jsonNode(x)
+	}
+	return res
+}
+
+func jsonStmts(list []Stmt) []interface{} {
+	res := make([]interface{}, len(list))
+	for i, stmt := range list {
+		res[i] = jsonNode(stmt)
+	}
+	return res
+}
+
+func jsonFunction(kind string, fn *Function) jsonObject {
+	return jsonObject{
+		"kind":   kind,
+		"params": jsonExprs(fn.Params),
+		"body":   jsonStmts(fn.Body),
+	}
+}
@@ -11,11 +11,55 @@ package syntax
 // package.  Verify that error positions are correct using the
 // chunkedfile mechanism.
 
-import "log"
+import (
+	"log"
+	"strings"
+)
 
 // Enable this flag to print the token stream and log.Fatal on the first error.
 const debug = false
 
+// DefaultMaxNestDepth is the maximum nesting depth of expressions
+// and statement blocks used when ParseOptions.MaxNestDepth is zero.
+const DefaultMaxNestDepth = 200
+
+// ParseOptions specifies options that affect parsing.
+type ParseOptions struct {
+	// MaxNestDepth limits the nesting of parenthesized expressions,
+	// list and dict expressions, calls, subscripts, lambdas,
+	// conditional expressions, unary and ** operators, and indented
+	// statement blocks, and the length of chains of other binary
+	// operators such as a + b + c, each operator of which nests the
+	// expression to its left. This protects the recursive-descent
+	// parser, and later passes over the syntax tree, from exhausting
+	// their stacks on pathological input.
+	// Zero means DefaultMaxNestDepth.
+	MaxNestDepth int
+
+	// AllowChainedComparisons permits a chain of comparisons such
+	// as a < b < c, which is parsed as a ComparisonChain.
+	// By default, comparison operators do not associate, and a
+	// chain is a syntax error.
+	AllowChainedComparisons bool
+
+	// AllowDel permits the statement del x[k], which removes
+	// an element from a dict or list, parsed as a DelStmt.
+	// By default, del is a reserved word.
+	AllowDel bool
+}
+
+func (opts ParseOptions) newParser(filename string, src interface{}) (*parser, error) {
+	in, err := newScanner(filename, src)
+	if err != nil {
+		return nil, err
+	}
+	maxDepth := opts.MaxNestDepth
+	if maxDepth == 0 {
+		maxDepth = DefaultMaxNestDepth
+	}
+	return &parser{in: in, maxDepth: maxDepth, chain: opts.AllowChainedComparisons, del: opts.AllowDel}, nil
+}
+
 // Parse parses the input data and returns the corresponding parse tree.
 //
 // If src != nil, ParseFile parses the source from src and the filename
@@ -24,11 +68,16 @@ const debug = false
 // []byte, or io.Reader.
 // If src == nil, ParseFile parses the file specified by filename.
 func Parse(filename string, src interface{}) (f *File, err error) {
-	in, err := newScanner(filename, src)
+	return ParseOptions{}.Parse(filename, src)
+}
+
+// Parse is like the package-level Parse function,
+// but uses the specified options.
+func (opts ParseOptions) Parse(filename string, src interface{}) (f *File, err error) {
+	p, err := opts.newParser(filename, src)
 	if err != nil {
 		return nil, err
 	}
-	p := parser{in: in}
 	defer p.in.recover(&err)
 
 	p.nextToken() // read first lookahead token
@@ -42,11 +91,16 @@ func Parse(filename string, src interface{}) (f *File, err error) {
 // ParseExpr parses a Skylark expression.
 // See Parse for explanation of parameters.
 func ParseExpr(filename string, src interface{}) (expr Expr, err error) {
-	in, err := newScanner(filename, src)
+	return ParseOptions{}.ParseExpr(filename, src)
+}
+
+// ParseExpr is like the package-level ParseExpr function,
+// but uses the specified options.
+func (opts ParseOptions) ParseExpr(filename string, src interface{}) (expr Expr, err error) {
+	p, err := opts.newParser(filename, src)
 	if err != nil {
 		return nil, err
 	}
-	p := parser{in: in}
 	defer p.in.recover(&err)
 
 	p.nextToken() // read first lookahead token
@@ -60,9 +114,13 @@ func ParseExpr(filename string, src interface{}) (expr Expr, err error) {
 }
 
 type parser struct {
-	in     *scanner
-	tok    Token
-	tokval tokenValue
+	in       *scanner
+	tok      Token
+	tokval   tokenValue
+	depth    int // current nesting of expressions and blocks
+	maxDepth int
+	chain    bool // allow chained comparisons
+	del      bool // allow del statements
 }
 
 // nextToken advances the scanner and returns the position of the
@@ -212,6 +270,7 @@ func (p *parser) parseSimpleStmt(stmts []Stmt) []Stmt {
 
 // small_stmt = RETURN expr?
 //            | PASS | BREAK | CONTINUE
+//            | DEL primary_expr '[' expr ']'                        // if AllowDel
 //            | expr ('=' | '+=' | '-=' | '*=' | '/=' | '%=') expr   // assign
 //            | expr
 func (p *parser) parseSmallStmt() Stmt {
@@ -229,6 +288,19 @@ func (p *parser) parseSmallStmt() Stmt {
 		tok := p.tok
 		pos := p.nextToken() // consume it
 		return &BranchStmt{Token: tok, TokenPos: pos}
+
+	case DEL:
+		pos := p.nextToken() // consume DEL
+		if !p.del {
+			p.in.errorf(pos, "del statement not supported")
+		}
+		x := p.parseExpr(false)
+		target, ok := x.(*IndexExpr)
+		if !ok {
+			start, _ := x.Span()
+			p.in.errorf(start, "del target must be an index expression x[k]")
+		}
+		return &DelStmt{Del: pos, Target: target}
 	}
 
 	// Assignment
@@ -276,7 +348,7 @@ func (p *parser) convertCallToLoad(call *CallExpr, loadPos Position) *LoadStmt {
 			// load("module", "id")
 			// To name is same as original.
 			id := &Ident{
-				NamePos: lit.TokenPos.add(`"`),
+				NamePos: stringValuePos(lit),
 				Name:    lit.Value.(string),
 			}
 			to[i] = id
@@ -287,7 +359,7 @@ func (p *parser) convertCallToLoad(call *CallExpr, loadPos Position) *LoadStmt {
 			// Symbol is locally renamed.
 			if lit, ok := binary.Y.(*Literal); ok && lit.Token == STRING {
 				id := &Ident{
-					NamePos: lit.TokenPos.add(`"`),
+					NamePos: stringValuePos(lit),
 					Name:    lit.Value.(string),
 				}
 				to[i] = binary.X.(*Ident)
@@ -309,11 +381,30 @@ func (p *parser) convertCallToLoad(call *CallExpr, loadPos Position) *LoadStmt {
 
 }
 
+// stringValuePos returns the position of the first character
+// of the value of a string literal, after any prefix and quotes.
+func stringValuePos(lit *Literal) Position {
+	i := strings.IndexAny(lit.Raw, `"'`)
+	if i < 0 {
+		return lit.TokenPos // can't happen
+	}
+	n := 1
+	if q := lit.Raw[i : i+1]; len(lit.Raw)-i >= 6 && strings.HasPrefix(lit.Raw[i:], q+q+q) {
+		n = 3 // triple-quoted
+	}
+	return lit.TokenPos.add(lit.Raw[:i+n])
+}
+
 // suite is typically what follows a COLON (e.g. after DEF or FOR).
 // suite = simple_stmt | NEWLINE INDENT stmt+ OUTDENT
 func (p *parser) parseSuite() []Stmt {
 	if p.tok == NEWLINE {
 		p.nextToken() // consume NEWLINE
+		p.depth++
+		if p.depth > p.maxDepth {
+			p.in.error(p.in.pos, "statement nesting too deep")
+		}
+		defer p.unnest()
 		p.consume(INDENT)
 		var stmts []Stmt
 		for p.tok != OUTDENT && p.tok != EOF {
@@ -462,6 +553,8 @@ func (p *parser) parseTest() Expr {
 			params = p.parseParams()
 		}
 		p.consume(COLON)
+		p.nest()
+		defer p.unnest()
 		body := p.parseTest()
 		return &LambdaExpr{
 			Lambda: lambda,
@@ -483,6 +576,8 @@ func (p *parser) parseTest() Expr {
 			p.in.error(ifpos, "conditional expression without else clause")
 		}
 		elsepos := p.nextToken()
+		p.nest()
+		defer p.unnest()
 		else_ := p.parseTest()
 		return &CondExpr{If: ifpos, Cond: cond, True: x, ElsePos: elsepos, False: else_}
 	}
@@ -492,7 +587,7 @@ func (p *parser) parseTest() Expr {
 
 func (p *parser) parseTestPrec(prec int) Expr {
 	if prec >= len(preclevels) {
-		return p.parsePrimaryWithSuffix()
+		return p.parsePower()
 	}
 
 	// expr = NOT expr
@@ -513,13 +608,19 @@ func (p *parser) parseTestPrec(prec int) Expr {
 // Uses precedence climbing; see http://www.engr.mun.ca/~theo/Misc/exp_parsing.htm#climbing.
 func (p *parser) parseBinopExpr(prec int) Expr {
 	x := p.parseTestPrec(prec + 1)
+	nested := 0 // number of BinaryExprs on the left spine of x
+	defer func() {
+		for ; nested > 0; nested-- {
+			p.unnest()
+		}
+	}()
 	for first := true; ; first = false {
 		if p.tok == NOT {
 			p.nextToken() // consume NOT
 			// In this context, NOT must be followed by IN.
 			// Replace NOT IN by a single NOT_IN token.
 			if p.tok != IN {
-				p.in.errorf(p.in.pos, "got %#v, want in", p.tok)
+				p.in.errorf(p.in.pos, "got %#v, want %#v", p.tok, IN)
 			}
 			p.tok = NOT_IN
 		}
@@ -530,8 +631,9 @@ func (p *parser) parseBinopExpr(prec int) Expr {
 			return x
 		}
 
-		// Comparisons are non-associative.
-		if !first && opprec == int(precedence[EQL]) {
+		// Comparisons are non-associative unless chaining is enabled.
+		chain := !first && opprec == int(precedence[EQL])
+		if chain && !p.chain {
 			p.in.errorf(p.in.pos, "%s does not associate with %s (use parens)",
 				x.(*BinaryExpr).Op, p.tok)
 		}
@@ -539,16 +641,41 @@ func (p *parser) parseBinopExpr(prec int) Expr {
 		op := p.tok
 		pos := p.nextToken()
 		y := p.parseTestPrec(opprec + 1)
-		x = makeBinaryExpr(op, pos, x, y)
+		if chain {
+			x = appendComparison(x, pos, op, y)
+		} else {
+			p.nest()
+			nested++
+			x = &BinaryExpr{OpPos: pos, Op: op, X: x, Y: y}
+		}
 	}
 }
 
-// precedence maps each operator to its precedence (0-7), or -1 for other tokens.
+// appendComparison extends the comparison x, which is either a
+// BinaryExpr or a ComparisonChain, by the comparison "op y".
+func appendComparison(x Expr, pos Position, op Token, y Expr) *ComparisonChain {
+	c, ok := x.(*ComparisonChain)
+	if !ok {
+		b := x.(*BinaryExpr)
+		c = &ComparisonChain{
+			Operands: []Expr{b.X, b.Y},
+			OpPos:    []Position{b.OpPos},
+			Ops:      []Token{b.Op},
+		}
+	}
+	c.Operands = append(c.Operands, y)
+	c.OpPos = append(c.OpPos, pos)
+	c.Ops = append(c.Ops, op)
+	return c
+}
+
+// precedence maps each operator to its precedence (0-8), or -1 for other tokens.
 var precedence [maxToken]int8
 
 // preclevels groups operators of equal precedence.
 // Comparisons are nonassociative; other binary operators associate to the left.
-// Unary MINUS and PLUS have higher precedence so are handled in parsePrimary.
+// Unary MINUS, PLUS, and TILDE have higher precedence so are handled in parsePrimary,
+// and ** has higher precedence still so is handled in parsePower.
 // See http://docs.python.org/2/reference/expressions.html#operator-precedence
 var preclevels = [...][]Token{
 	{OR},  // or
@@ -556,7 +683,9 @@ var preclevels = [...][]Token{
 	{NOT}, // not (unary)
 	{EQL, NEQ, LT, GT, LE, GE, IN, NOT_IN}, // == != < > <= >= in not in
 	{PIPE},                             // |
+	{CIRCUMFLEX},                       // ^
 	{AMP},                              // &
+	{LTLT, GTGT},                       // << >>
 	{MINUS, PLUS},                      // -
 	{STAR, PERCENT, SLASH, SLASHSLASH}, // * % / //
 }
@@ -573,26 +702,27 @@ func init() {
 	}
 }
 
-func makeBinaryExpr(op Token, pos Position, x, y Expr) Expr {
-	// Concatenate literal strings during parsing.
-	if op == PLUS {
-		if x, ok := x.(*Literal); ok && x.Token == STRING {
-			if y, ok := y.(*Literal); ok && y.Token == STRING {
-				// The Span of this synthetic node will be wrong.
-				return &Literal{
-					Token:    STRING,
-					TokenPos: x.TokenPos,
-					Raw:      x.Raw + " + " + y.Raw, // ugh
-					Value:    x.Value.(string) + y.Value.(string),
-				}
-			}
-		}
+// power = primary_with_suffix ('**' power)?
+//
+// The right operand of ** may be preceded by unary operators
+// (which parsePrimary handles), so 2 ** -1 is legal.
+// ** associates to the right, and binds more tightly than
+// unary minus on its left, so -2 ** 2 is -(2 ** 2).
+func (p *parser) parsePower() Expr {
+	x := p.parsePrimaryWithSuffix()
+	if p.tok != STARSTAR {
+		return x
 	}
-	return &BinaryExpr{OpPos: pos, Op: op, X: x, Y: y}
+	pos := p.nextToken()
+	p.nest()
+	defer p.unnest()
+	y := p.parsePower()
+	return &BinaryExpr{OpPos: pos, Op: STARSTAR, X: x, Y: y}
 }
 
 // primary_with_suffix = primary
 //                     | primary '.' IDENT
+//                     | primary '?' '.' IDENT
 //                     | primary slice_suffix
 //                     | primary call_suffix
 func (p *parser) parsePrimaryWithSuffix() Expr {
@@ -603,10 +733,19 @@ func (p *parser) parsePrimaryWithSuffix() Expr {
 			dot := p.nextToken()
 			id := p.parseIdent()
 			x = &DotExpr{Dot: dot, X: x, Name: id}
+		case QUESTION:
+			question := p.nextToken()
+			p.consume(DOT)
+			id := p.parseIdent()
+			x = &OptDotExpr{Question: question, X: x, Name: id}
 		case LBRACK:
+			p.nest()
 			x = p.parseSliceSuffix(x)
+			p.unnest()
 		case LPAREN:
+			p.nest()
 			x = p.parseCallSuffix(x)
+			p.unnest()
 		default:
 			return x
 		}
@@ -729,14 +868,32 @@ func (p *parser) parseArgs() []Expr {
 	return args
 }
 
+// nest increments the expression nesting depth,
+// reporting an error if it exceeds the limit.
+// Each call must be paired with a call to unnest.
+func (p *parser) nest() {
+	p.depth++
+	if p.depth > p.maxDepth {
+		p.in.error(p.in.pos, "expression nesting too deep")
+	}
+}
+
+func (p *parser) unnest() { p.depth-- }
+
 //  primary = IDENT
 //          | INT | FLOAT
 //          | STRING
 //          | '[' ...                    // list literal or comprehension
 //          | '{' ...                    // dict literal or comprehension
 //          | '(' ...                    // tuple or parenthesized expression
-//          | ('-'|'+') primary_with_suffix
+//          | ('-'|'+'|'~') power
 func (p *parser) parsePrimary() Expr {
+	switch p.tok {
+	case LBRACK, LBRACE, LPAREN, MINUS, PLUS, TILDE:
+		p.nest()
+		defer p.unnest()
+	}
+
 	switch p.tok {
 	case IDENT:
 		return p.parseIdent()
@@ -773,11 +930,11 @@ func (p *parser) parsePrimary() Expr {
 		p.consume(RPAREN)
 		return e
 
-	case MINUS, PLUS:
-		// unary minus/plus:
+	case MINUS, PLUS, TILDE:
+		// unary minus/plus/bitwise complement:
 		tok := p.tok
 		pos := p.nextToken()
-		x := p.parsePrimaryWithSuffix()
+		x := p.parsePower()
 		return &UnaryExpr{
 			OpPos: pos,
 			Op:    tok,
@@ -881,7 +1038,7 @@ func (p *parser) parseComprehensionSuffix(lbrace Position, body Expr, endBrace T
 			cond := p.parseTest()
 			clauses = append(clauses, &IfClause{If: pos, Cond: cond})
 		} else {
-			p.in.errorf(p.in.pos, "got %#v, want '%s', for, or if", p.tok, endBrace)
+			p.in.errorf(p.in.pos, "got %#v, want %#v, %#v, or %#v", p.tok, endBrace, FOR, IF)
 		}
 	}
 	rbrace := p.nextToken()
@@ -6,7 +6,9 @@ package syntax_test
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"reflect"
 	"strings"
 	"testing"
@@ -32,6 +34,10 @@ func TestExprParseTrees(t *testing.T) {
 			`(CallExpr Fn=(DotExpr X=(IndexExpr X=x Y=i) Name=f) Args=(42))`},
 		{`x.f()`,
 			`(CallExpr Fn=(DotExpr X=x Name=f))`},
+		{`x?.f`,
+			`(OptDotExpr X=x Name=f)`},
+		{`x?.f?.g.h()`,
+			`(CallExpr Fn=(DotExpr X=(OptDotExpr X=(OptDotExpr X=x Name=f) Name=g) Name=h))`},
 		{`x+y*z`,
 			`(BinaryExpr X=x Op=+ Y=(BinaryExpr X=y Op=* Y=z))`},
 		{`x%y-z`,
@@ -83,13 +89,15 @@ func TestExprParseTrees(t *testing.T) {
 		{`-1 + +2`,
 			`(BinaryExpr X=(UnaryExpr Op=- X=1) Op=+ Y=(UnaryExpr Op=+ X=2))`},
 		{`"foo" + "bar"`,
-			`"foobar"`}, // concatenated
+			`(BinaryExpr X="foo" Op=+ Y="bar")`}, // not folded
 		{`-1 * 2`, // prec(unary -) > prec(binary *)
 			`(BinaryExpr X=(UnaryExpr Op=- X=1) Op=* Y=2)`},
 		{`-x[i]`, // prec(unary -) < prec(x[i])
 			`(UnaryExpr Op=- X=(IndexExpr X=x Y=i))`},
 		{`a | b & c | d`, // prec(|) < prec(&)
 			`(BinaryExpr X=(BinaryExpr X=a Op=| Y=(BinaryExpr X=b Op=& Y=c)) Op=| Y=d)`},
+		{`a | b ^ c & d`, // prec(|) < prec(^) < prec(&)
+			`(BinaryExpr X=a Op=| Y=(BinaryExpr X=b Op=^ Y=(BinaryExpr X=c Op=& Y=d)))`},
 		{`a or b and c or d`,
 			`(BinaryExpr X=(BinaryExpr X=a Op=or Y=(BinaryExpr X=b Op=and Y=c)) Op=or Y=d)`},
 		{`a and b or c and d`,
@@ -102,6 +110,26 @@ func TestExprParseTrees(t *testing.T) {
 			`(CondExpr Cond=b True=a False=c)`},
 		{`a and not b`,
 			`(BinaryExpr X=a Op=and Y=(UnaryExpr Op=not X=b))`},
+		{`~a`,
+			`(UnaryExpr Op=~ X=a)`},
+		{`~-a.b ** c`,
+			`(UnaryExpr Op=~ X=(UnaryExpr Op=- X=(BinaryExpr X=(DotExpr X=a Name=b) Op=** Y=c)))`},
+		{`~a & b`,
+			`(BinaryExpr X=(UnaryExpr Op=~ X=a) Op=& Y=b)`},
+		{`a << b >> c`,
+			`(BinaryExpr X=(BinaryExpr X=a Op=<< Y=b) Op=>> Y=c)`},
+		{`a & b << c + d`,
+			`(BinaryExpr X=a Op=& Y=(BinaryExpr X=b Op=<< Y=(BinaryExpr X=c Op=+ Y=d)))`},
+		{`a < b << c`,
+			`(BinaryExpr X=a Op=< Y=(BinaryExpr X=b Op=<< Y=c))`},
+		{`a ** b ** c`,
+			`(BinaryExpr X=a Op=** Y=(BinaryExpr X=b Op=** Y=c))`},
+		{`-a ** -b`,
+			`(UnaryExpr Op=- X=(BinaryExpr X=a Op=** Y=(UnaryExpr Op=- X=b)))`},
+		{`a * b ** c.d`,
+			`(BinaryExpr X=a Op=* Y=(BinaryExpr X=b Op=** Y=(DotExpr X=c Name=d)))`},
+		{`f(a ** 2, **b)`,
+			`(CallExpr Fn=f Args=((BinaryExpr X=a Op=** Y=2) (UnaryExpr Op=** X=b)))`},
 	} {
 		e, err := syntax.ParseExpr("foo.sky", test.input)
 		if err != nil {
@@ -114,6 +142,76 @@ func TestExprParseTrees(t *testing.T) {
 	}
 }
 
+func TestChainedComparisons(t *testing.T) {
+	opts := syntax.ParseOptions{AllowChainedComparisons: true}
+	for _, test := range []struct {
+		input, want string
+	}{
+		{`a < b`,
+			`(BinaryExpr X=a Op=< Y=b)`},
+		{`a < b <= c`,
+			`(ComparisonChain Operands=(a b c) Ops=(< <=))`},
+		{`a == b + 1 != c in d not in e`,
+			`(ComparisonChain Operands=(a (BinaryExpr X=b Op=+ Y=1) c d e) Ops=(== != in not in))`},
+		{`a < b < c and d < e`,
+			`(BinaryExpr X=(ComparisonChain Operands=(a b c) Ops=(< <)) Op=and Y=(BinaryExpr X=d Op=< Y=e))`},
+		{`not a < b < c`,
+			`(UnaryExpr Op=not X=(ComparisonChain Operands=(a b c) Ops=(< <)))`},
+		{`(a < b) < c`,
+			`(BinaryExpr X=(BinaryExpr X=a Op=< Y=b) Op=< Y=c)`},
+	} {
+		e, err := opts.ParseExpr("foo.sky", test.input)
+		if err != nil {
+			t.Errorf("parse `%s` failed: %v", test.input, stripPos(err))
+			continue
+		}
+		if got := treeString(e); test.want != got {
+			t.Errorf("parse `%s` = %s, want %s", test.input, got, test.want)
+		}
+	}
+
+	// By default, a chain is an error.
+	_, err := syntax.ParseExpr("foo.sky", "a < b <= c")
+	if want := "foo.sky:1:9: < does not associate with <= (use parens)"; err == nil || err.Error() != want {
+		t.Errorf("ParseExpr: got error %v, want %s", err, want)
+	}
+}
+
+func TestDelStmt(t *testing.T) {
+	opts := syntax.ParseOptions{AllowDel: true}
+	for _, test := range []struct {
+		input, want string
+	}{
+		{`del x[1]`,
+			`(DelStmt Target=(IndexExpr X=x Y=1))`},
+		{`del x.f[k][0]`,
+			`(DelStmt Target=(IndexExpr X=(IndexExpr X=(DotExpr X=x Name=f) Y=k) Y=0))`},
+		{`del x`,
+			`del target must be an index expression x[k]`},
+		{`del x[1:2]`,
+			`del target must be an index expression x[k]`},
+		{`del x[1], y[2]`,
+			`del target must be an index expression x[k]`},
+	} {
+		var got string
+		f, err := opts.Parse("foo.sky", test.input)
+		if err != nil {
+			got = stripPos(err)
+		} else {
+			got = treeString(f.Stmts[0])
+		}
+		if test.want != got {
+			t.Errorf("parse `%s` = %s, want %s", test.input, got, test.want)
+		}
+	}
+
+	// By default, del is a syntax error.
+	_, err := syntax.Parse("foo.sky", "del x[1]")
+	if want := "foo.sky:1:1: del statement not supported"; err == nil || err.Error() != want {
+		t.Errorf("Parse: got error %v, want %s", err, want)
+	}
+}
+
 func TestStmtParseTrees(t *testing.T) {
 	for _, test := range []struct {
 		input, want string
@@ -260,7 +358,7 @@ func treeString(n syntax.Node) string {
 
 func writeTree(out *bytes.Buffer, x reflect.Value) {
 	switch x.Kind() {
-	case reflect.String, reflect.Int, reflect.Bool:
+	case reflect.String, reflect.Int, reflect.Int8, reflect.Bool:
 		fmt.Fprintf(out, "%v", x.Interface())
 	case reflect.Ptr, reflect.Interface:
 		if elem := x.Elem(); elem.Kind() == 0 {
@@ -284,7 +382,8 @@ func writeTree(out *bytes.Buffer, x reflect.Value) {
 		fmt.Fprintf(out, "(%s", strings.TrimPrefix(x.Type().String(), "syntax."))
 		for i, n := 0, x.NumField(); i < n; i++ {
 			f := x.Field(i)
-			if f.Type() == reflect.TypeOf(syntax.Position{}) {
+			if f.Type() == reflect.TypeOf(syntax.Position{}) ||
+				f.Type() == reflect.TypeOf([]syntax.Position(nil)) {
 				continue // skip positions
 			}
 			name := x.Type().Field(i).Name
@@ -396,3 +495,200 @@ File
 		t.Errorf("got %s, want %s", got, want)
 	}
 }
+
+func TestEqual(t *testing.T) {
+	for _, test := range []struct {
+		x, y string
+		want bool
+	}{
+		// Positions, spacing, and literal spellings are ignored.
+		{"x = f(1, *a)\n", "x=f( 1 ,*a )\n", true},
+		{"def f(a, b=1):\n  return [a, b]\n", "def f(a,b = 1):\n\n    return [a,\n      b]\n", true},
+		{`x = "a"`, `x = 'a'`, true},
+		{`x = 0x10`, `x = 16`, true},
+		{`x = "a" + "b"`, `x = "ab"`, false}, // not concatenated by parser
+		{`x = {k: v for k, v in y if v}`, `x = {k:v for (k, v) in y if v}`, true},
+		{"if x:\n  pass\nelif y:\n  pass\n", "if x:\n  pass\nelse:\n  if y:\n    pass\n", true},
+		// Changed operands or operators are significant.
+		{`x = f(1, *a)`, `x = f(1, *b)`, false},
+		{`x = f(1, *a)`, `x = f(1, **a)`, false},
+		{`x = a + "b"`, `x = "ab"`, false},
+		{`x = a + b`, `x = a - b`, false},
+		{`x = 1`, `x = 1.0`, false},
+		{`x = [1]`, `x = (1,)`, false},
+		{`x = [y for y in z]`, `x = {y: y for y in z}`, false},
+		{`x += 1`, `x = 1`, false},
+		{"x = 1\n", "x = 1\ny = 2\n", false},
+	} {
+		x, err := syntax.Parse("x.sky", test.x)
+		if err != nil {
+			t.Fatal(err)
+		}
+		y, err := syntax.Parse("y.sky", test.y)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := syntax.Equal(x, y); got != test.want {
+			t.Errorf("Equal(%q, %q) = %t, want %t", test.x, test.y, got, test.want)
+		}
+	}
+}
+
+func TestMaxNestDepth(t *testing.T) {
+	// Pathological input yields an error, not a stack overflow.
+	for _, src := range []string{
+		strings.Repeat("(", 10000),
+		strings.Repeat("[", 10000),
+		strings.Repeat("-", 10000) + "1",
+		"x = " + strings.Repeat("{1: ", 10000),
+		strings.Repeat("f(", 10000),
+		strings.Repeat("a[", 10000),
+		strings.Repeat("lambda: ", 10000) + "0",
+		strings.Repeat("2 ** ", 10000) + "2",
+		strings.Repeat("x if y else ", 10000) + "z",
+		strings.Repeat("1 + ", 10000) + "1",
+		strings.Repeat("a or ", 10000) + "b",
+	} {
+		_, err := syntax.Parse("foo.sky", src)
+		if err == nil || !strings.Contains(err.Error(), "expression nesting too deep") {
+			t.Errorf("parsing %.10s...: got error %v, want nesting error", src, err)
+		}
+	}
+
+	// Nesting up to the limit is permitted.
+	opts := syntax.ParseOptions{MaxNestDepth: 3}
+	if _, err := opts.ParseExpr("foo.sky", "[(-x)]"); err != nil {
+		t.Errorf("ParseExpr: unexpected error: %v", err)
+	}
+	_, err := opts.ParseExpr("foo.sky", "[(-(x))]")
+	if want := "foo.sky:1:5: expression nesting too deep"; err == nil || err.Error() != want {
+		t.Errorf("ParseExpr: got error %v, want %s", err, want)
+	}
+	for _, src := range []string{"f(g(h(x)))", "a[b[c[0]]]", "lambda: lambda: lambda: 0", "a + b - c * d"} {
+		if _, err := opts.ParseExpr("foo.sky", src); err != nil {
+			t.Errorf("ParseExpr(%s): unexpected error: %v", src, err)
+		}
+	}
+	for _, src := range []string{"f(g(h(i(x))))", "a[b[c[d[0]]]]", "lambda: lambda: lambda: lambda: 0", "a + b + c + d + e"} {
+		if _, err := opts.ParseExpr("foo.sky", src); err == nil || !strings.Contains(err.Error(), "expression nesting too deep") {
+			t.Errorf("ParseExpr(%s): got error %v, want nesting error", src, err)
+		}
+	}
+
+	// Deeply nested statement blocks are rejected too.
+	var buf bytes.Buffer
+	for i := 0; i < 1000; i++ {
+		fmt.Fprintf(&buf, "%sif x:\n", strings.Repeat(" ", i))
+	}
+	fmt.Fprintf(&buf, "%spass\n", strings.Repeat(" ", 1000))
+	if _, err := syntax.Parse("foo.sky", buf.String()); err == nil || !strings.Contains(err.Error(), "statement nesting too deep") {
+		t.Errorf("parsing nested blocks: got error %v, want nesting error", err)
+	}
+}
+
+func TestSpan(t *testing.T) {
+	// The parser does not fold concatenations of string literals,
+	// so each operand, and the whole expression, has its true span.
+	e, err := syntax.ParseExpr("foo.sky", `"a" + 'b' + "c"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	span := func(n syntax.Node) string {
+		start, end := n.Span()
+		return fmt.Sprintf("%d:%d-%d:%d", start.Line, start.Col, end.Line, end.Col)
+	}
+	outer, ok := e.(*syntax.BinaryExpr)
+	if !ok {
+		t.Fatalf("got %T, want *syntax.BinaryExpr", e)
+	}
+	inner := outer.X.(*syntax.BinaryExpr)
+	for _, test := range []struct {
+		name string
+		n    syntax.Node
+		want string
+	}{
+		{"whole", outer, "1:1-1:16"},
+		{`"a" + 'b'`, inner, "1:1-1:10"},
+		{`"a"`, inner.X, "1:1-1:4"},
+		{`'b'`, inner.Y, "1:7-1:10"},
+		{`"c"`, outer.Y, "1:13-1:16"},
+	} {
+		if got := span(test.n); got != test.want {
+			t.Errorf("span of %s = %s, want %s", test.name, got, test.want)
+		}
+	}
+}
+
+// BenchmarkParse measures parsing of a large file formed
+// by repeating the contents of a typical one.
+func BenchmarkParse(b *testing.B) {
+	filename := skylarktest.DataFile("skylark/syntax", "testdata/def.bzl")
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		b.Fatal(err)
+	}
+	data = bytes.Repeat(append(data, '\n'), 100)
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if _, err := syntax.Parse(filename, data); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestMarshalJSON(t *testing.T) {
+	const src = `load("lib.sky", "f")
+
+def g(x, *args):
+    if x:
+        return f(x)[1:]
+    return [y for y in args if y]
+
+z = -g(1) + 2.5
+`
+	f, err := syntax.Parse("test.sky", src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := syntax.MarshalJSON(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got bytes.Buffer
+	if err := json.Indent(&got, data, "", "\t"); err != nil {
+		t.Fatal(err)
+	}
+	got.WriteByte('\n')
+
+	golden := skylarktest.DataFile("skylark/syntax", "testdata/json.golden")
+	want, err := ioutil.ReadFile(golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.String() != string(want) {
+		t.Errorf("MarshalJSON output does not match %s; got:\n%s", golden, got.String())
+	}
+}
+
+func TestLoadSymbolPositions(t *testing.T) {
+	const src = `# Commentaire: café, naïve, 日本語
+load("módulo.sky", "a", r"b", '''c''', d="dé")
+`
+	f, err := syntax.Parse("load.sky", src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	load := f.Stmts[0].(*syntax.LoadStmt)
+	var got []string
+	for i := range load.From {
+		to, from := load.To[i], load.From[i]
+		got = append(got, fmt.Sprintf("%s=%s@%d:%d", to.Name, from.Name, from.NamePos.Line, from.NamePos.Col))
+	}
+	// Columns count runes, not bytes.
+	want := "a=a@2:21 b=b@2:27 c=c@2:34 d=dé@2:43"
+	if s := strings.Join(got, " "); s != want {
+		t.Errorf("got %s, want %s", s, want)
+	}
+}
@@ -7,6 +7,7 @@ package syntax
 // A lexical scanner for Skylark.
 
 import (
+	"bytes"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -34,6 +35,8 @@ const (
 	FLOAT  // 1.23e45
 	STRING // "foo" or 'foo' or '''foo''' or r'foo' or r"foo"
 
+	COMMENT // # foo (reported only by Scanner)
+
 	// Punctuation
 	PLUS          // +
 	MINUS         // -
@@ -43,7 +46,12 @@ const (
 	PERCENT       // %
 	AMP           // &
 	PIPE          // |
+	CIRCUMFLEX    // ^
+	LTLT          // <<
+	GTGT          // >>
+	TILDE         // ~
 	DOT           // .
+	QUESTION      // ?
 	COMMA         // ,
 	EQ            // =
 	SEMI          // ;
@@ -73,6 +81,7 @@ const (
 	BREAK
 	CONTINUE
 	DEF
+	DEL
 	ELIF
 	ELSE
 	FOR
@@ -88,12 +97,17 @@ const (
 	maxToken
 )
 
+// String returns the source text of a punctuation or keyword token,
+// such as "+" or "for", or a description of any other token,
+// such as "identifier" or "newline".
 func (tok Token) String() string { return tokenNames[tok] }
 
-// GoString is like String but quotes punctuation tokens.
+// GoString is like String but quotes punctuation and keyword tokens,
+// so that they read naturally in a sentence such as
+// "got 'for', want identifier".
 // Use Sprintf("%#v", tok) when constructing error messages.
 func (tok Token) GoString() string {
-	if tok >= PLUS && tok <= STARSTAR {
+	if tok >= PLUS && tok <= STARSTAR || tok >= AND && tok <= RETURN {
 		return "'" + tokenNames[tok] + "'"
 	}
 	return tokenNames[tok]
@@ -109,6 +123,7 @@ var tokenNames = [...]string{
 	INT:           "int literal",
 	FLOAT:         "float literal",
 	STRING:        "string literal",
+	COMMENT:       "comment",
 	PLUS:          "+",
 	MINUS:         "-",
 	STAR:          "*",
@@ -117,7 +132,12 @@ var tokenNames = [...]string{
 	PERCENT:       "%",
 	AMP:           "&",
 	PIPE:          "|",
+	CIRCUMFLEX:    "^",
+	LTLT:          "<<",
+	GTGT:          ">>",
+	TILDE:         "~",
 	DOT:           ".",
+	QUESTION:      "?",
 	COMMA:         ",",
 	EQ:            "=",
 	SEMI:          ";",
@@ -127,7 +147,7 @@ var tokenNames = [...]string{
 	LBRACK:        "[",
 	RBRACK:        "]",
 	LBRACE:        "{",
-	RBRACE:        "]",
+	RBRACE:        "}",
 	LT:            "<",
 	GT:            ">",
 	GE:            ">=",
@@ -145,6 +165,7 @@ var tokenNames = [...]string{
 	BREAK:         "break",
 	CONTINUE:      "continue",
 	DEF:           "def",
+	DEL:           "del",
 	ELIF:          "elif",
 	ELSE:          "else",
 	FOR:           "for",
@@ -193,16 +214,62 @@ func (p Position) String() string {
 	return fmt.Sprintf("%s:%d:%d", p.Filename(), p.Line, p.Col)
 }
 
+// Excerpt returns the line of src containing p, followed by a line
+// with a caret (^) under the column of p. Tabs before the column are
+// preserved so that the caret lines up when the lines are printed.
+// It returns the empty string if src has no such line.
+func (p Position) Excerpt(src []byte) string {
+	if p.Line < 1 {
+		return ""
+	}
+	line := src
+	for i := int32(1); i < p.Line; i++ {
+		nl := bytes.IndexByte(line, '\n')
+		if nl < 0 {
+			return ""
+		}
+		line = line[nl+1:]
+	}
+	if nl := bytes.IndexByte(line, '\n'); nl >= 0 {
+		line = line[:nl]
+	}
+	line = bytes.TrimSuffix(line, []byte("\r"))
+
+	var buf bytes.Buffer
+	buf.Write(line)
+	buf.WriteByte('\n')
+	col := int32(1)
+	for _, r := range string(line) {
+		if col >= p.Col {
+			break
+		}
+		if r == '\t' {
+			buf.WriteByte('\t')
+		} else {
+			buf.WriteByte(' ')
+		}
+		col++
+	}
+	for ; col < p.Col; col++ {
+		buf.WriteByte(' ') // column is beyond end of line
+	}
+	buf.WriteByte('^')
+	return buf.String()
+}
+
 // An scanner represents a single input file being parsed.
 type scanner struct {
-	complete  []byte   // entire input
-	rest      []byte   // rest of input
-	token     []byte   // token being scanned
-	pos       Position // current input position
-	depth     int      // nesting of [ ] { } ( )
-	indentstk []int    // stack of indentation levels
-	dents     int      // number of saved INDENT (>0) or OUTDENT (<0) tokens to return
-	lineStart bool     // after NEWLINE; convert spaces to indentation tokens
+	complete  []byte            // entire input
+	rest      []byte            // rest of input
+	token     []byte            // token being scanned
+	pos       Position          // current input position
+	depth     int               // nesting of [ ] { } ( )
+	indentstk []int             // stack of indentation levels
+	dents     int               // number of saved INDENT (>0) or OUTDENT (<0) tokens to return
+	lineStart bool              // after NEWLINE; convert spaces to indentation tokens
+	comments  bool              // report comments as COMMENT tokens
+	blankLine bool              // previous token was a COMMENT on an otherwise blank line
+	strings   map[string]string // interned identifiers and string literal values
 }
 
 func newScanner(filename string, src interface{}) (*scanner, error) {
@@ -216,9 +283,23 @@ func newScanner(filename string, src interface{}) (*scanner, error) {
 		pos:       Position{file: &filename, Line: 1, Col: 1},
 		indentstk: make([]int, 1, 10), // []int{0} + spare capacity
 		lineStart: true,
+		strings:   make(map[string]string),
 	}, nil
 }
 
+// intern returns a string equal to b, sharing storage with all
+// previous results equal to it from the same scanner.
+// Large files contain many duplicate identifiers and strings,
+// so interning saves both allocation and space in the syntax tree.
+func (sc *scanner) intern(b []byte) string {
+	if s, ok := sc.strings[string(b)]; ok { // no allocation
+		return s
+	}
+	s := string(b)
+	sc.strings[s] = s
+	return s
+}
+
 func readSource(filename string, src interface{}) (data []byte, err error) {
 	switch src := src.(type) {
 	case string:
@@ -238,6 +319,63 @@ func readSource(filename string, src interface{}) (data []byte, err error) {
 	return data, nil
 }
 
+// A Scanner breaks a Skylark file into a stream of tokens,
+// for use by tools such as syntax highlighters that need
+// the tokens themselves rather than a syntax tree.
+//
+// Unlike the parser, a Scanner reports comments, as COMMENT tokens.
+// Its stream also contains the NEWLINE, INDENT, and OUTDENT tokens
+// that delimit statements and blocks, but not the spaces between
+// tokens, whose extent may be computed from the positions and raw
+// text of adjacent tokens.
+type Scanner struct {
+	sc  *scanner
+	err error
+}
+
+// NewScanner returns a Scanner for the named file.
+// See Parse for the interpretation of src.
+func NewScanner(filename string, src interface{}) (*Scanner, error) {
+	sc, err := newScanner(filename, src)
+	if err != nil {
+		return nil, err
+	}
+	sc.comments = true
+	return &Scanner{sc: sc}, nil
+}
+
+// A TokenValue holds the text and, for literals,
+// the value of a token returned by Scanner.Scan.
+type TokenValue struct {
+	Raw    string  // raw text of token
+	Int    int64   // decoded value of INT token
+	Float  float64 // decoded value of FLOAT token
+	String string  // decoded value of STRING token
+}
+
+// Scan returns the next token, its value, and its start position.
+// At the end of the input, it returns EOF.
+// If the input is malformed, it returns ILLEGAL, and the
+// error is subsequently available from Err;
+// all later calls return ILLEGAL too.
+func (s *Scanner) Scan() (tok Token, val TokenValue, pos Position) {
+	if s.err != nil {
+		return ILLEGAL, val, s.sc.pos
+	}
+	var v tokenValue
+	func() {
+		defer s.sc.recover(&s.err)
+		tok = s.sc.nextToken(&v)
+	}()
+	if s.err != nil {
+		return ILLEGAL, val, s.err.(Error).Pos
+	}
+	return tok, TokenValue{Raw: v.raw, Int: v.int, Float: v.float, String: v.string}, v.pos
+}
+
+// Err returns the error, if any, encountered by Scan.
+func (s *Scanner) Err() error { return s.err }
+
 // An Error describes the nature and position of a scanner or parser error.
 type Error struct {
 	Pos Position
@@ -246,6 +384,16 @@ type Error struct {
 
 func (e Error) Error() string { return e.Pos.String() + ": " + e.Msg }
 
+// CaretString returns the error message followed by the offending
+// line of src, the source of the file in which the error occurred,
+// and a caret marking the position of the error.
+func (e Error) CaretString(src []byte) string {
+	if excerpt := e.Pos.Excerpt(src); excerpt != "" {
+		return e.Error() + "\n" + excerpt
+	}
+	return e.Error()
+}
+
 // errorf is called to report an error.
 // errorf does not return: it panics.
 func (sc *scanner) error(pos Position, s string) {
@@ -290,11 +438,16 @@ func (sc *scanner) peekRune() rune {
 	if b := sc.rest[0]; b < utf8.RuneSelf {
 		if b == '\r' {
 			return '\n'
+		} else if b == 0 {
+			sc.error(sc.pos, "illegal NUL byte in input")
 		}
 		return rune(b)
 	}
 
-	r, _ := utf8.DecodeRune(sc.rest)
+	r, size := utf8.DecodeRune(sc.rest)
+	if r == utf8.RuneError && size == 1 {
+		sc.error(sc.pos, "invalid UTF-8 encoding")
+	}
 	return r
 }
 
@@ -314,6 +467,8 @@ func (sc *scanner) readRune() rune {
 				sc.rest = sc.rest[1:]
 			}
 			r = '\n'
+		} else if r == 0 {
+			sc.error(sc.pos, "illegal NUL byte in input")
 		}
 		if r == '\n' {
 			sc.pos.Line++
@@ -325,6 +480,9 @@ func (sc *scanner) readRune() rune {
 	}
 
 	r, size := utf8.DecodeRune(sc.rest)
+	if r == utf8.RuneError && size == 1 {
+		sc.error(sc.pos, "invalid UTF-8 encoding")
+	}
 	sc.rest = sc.rest[size:]
 	sc.pos.Col++
 	return r
@@ -390,8 +548,9 @@ start:
 	var c rune
 
 	// Deal with leading spaces and indentation.
-	blank := false
-	savedLineStart := sc.lineStart
+	blank := sc.blankLine
+	savedLineStart := sc.lineStart || sc.blankLine
+	sc.blankLine = false
 	if sc.lineStart {
 		sc.lineStart = false
 		col := 0
@@ -458,11 +617,19 @@ start:
 
 	// comment
 	if c == '#' {
+		if sc.comments {
+			sc.startToken(val)
+		}
 		// Consume up to (but not including) newline.
 		for c != 0 && c != '\n' {
 			sc.readRune()
 			c = sc.peekRune()
 		}
+		if sc.comments {
+			sc.endToken(val)
+			sc.blankLine = blank
+			return COMMENT
+		}
 	}
 
 	// newline
@@ -536,11 +703,16 @@ start:
 			return sc.scanString(val, c)
 		}
 
+		// Python's formatted string literals are a common mistake.
+		if (c == 'f' || c == 'F') && len(sc.rest) > 1 && (sc.rest[1] == '"' || sc.rest[1] == '\'') {
+			sc.error(sc.pos, "f-strings are not supported in Skylark; use .format()")
+		}
+
 		for isIdent(c) {
 			sc.readRune()
 			c = sc.peekRune()
 		}
-		sc.endToken(val)
+		val.raw = sc.intern(sc.token[:len(sc.token)-len(sc.rest)])
 		if k, ok := keywordToken[val.raw]; ok {
 			return k
 		}
@@ -593,6 +765,13 @@ start:
 	switch c {
 	case '=', '<', '>', '!', '+', '-', '%', '/': // possibly followed by '='
 		sc.readRune()
+		if (c == '<' || c == '>') && sc.peekRune() == c {
+			sc.readRune()
+			if c == '<' {
+				return LTLT
+			}
+			return GTGT
+		}
 		if sc.peekRune() == '=' {
 			sc.readRune()
 			switch c {
@@ -643,7 +822,7 @@ start:
 		}
 		panic("unreachable")
 
-	case ':', ';', '|', '&': // single-char tokens (except comma)
+	case ':', ';', '|', '&', '^', '?', '~': // single-char tokens (except comma)
 		sc.readRune()
 		switch c {
 		case ':':
@@ -654,6 +833,12 @@ start:
 			return PIPE
 		case '&':
 			return AMP
+		case '^':
+			return CIRCUMFLEX
+		case '?':
+			return QUESTION
+		case '~':
+			return TILDE
 		}
 		panic("unreachable")
 
@@ -712,6 +897,11 @@ func (sc *scanner) scanString(val *tokenValue, quote rune) Token {
 	if err != nil {
 		sc.error(sc.pos, err.Error())
 	}
+	if interned, ok := sc.strings[s]; ok {
+		s = interned
+	} else {
+		sc.strings[s] = s
+	}
 	val.string = s
 	return STRING
 }
@@ -722,6 +912,9 @@ func (sc *scanner) scanNumber(val *tokenValue, c rune) Token {
 	// - integer literals of >64 bits of precision
 	// - 123L or 123l long suffix
 	// - traditional octal: 0755
+	//
+	// As in Python 3, single underscores may separate digits,
+	// or follow the prefix of a hex, octal, or binary literal.
 
 	fraction, exponent := false, false
 
@@ -735,7 +928,7 @@ func (sc *scanner) scanNumber(val *tokenValue, c rune) Token {
 		}
 		fraction = true
 	} else if c == '0' {
-		// hex, octal, or float
+		// hex, octal, binary, or float
 		sc.readRune()
 		c = sc.peekRune()
 
@@ -744,58 +937,36 @@ func (sc *scanner) scanNumber(val *tokenValue, c rune) Token {
 		} else if c == 'x' || c == 'X' {
 			// hex
 			sc.readRune()
-			c = sc.peekRune()
-			if !isxdigit(c) {
-				sc.error(sc.pos, "invalid hex literal")
-			}
-			for isxdigit(c) {
-				sc.readRune()
-				c = sc.peekRune()
-			}
+			c = sc.scanDigits(isxdigit, true, "hex")
 		} else if c == 'o' || c == 'O' {
 			// octal
 			sc.readRune()
-			c = sc.peekRune()
-			if !isodigit(c) {
-				sc.error(sc.pos, "invalid octal literal")
-			}
-			for isodigit(c) {
-				sc.readRune()
-				c = sc.peekRune()
-			}
+			c = sc.scanDigits(isodigit, true, "octal")
+		} else if c == 'b' || c == 'B' {
+			// binary
+			sc.readRune()
+			c = sc.scanDigits(isbdigit, true, "binary")
 		} else {
 			// float (or obsolete octal "0755")
-			allzeros, octal := true, true
-			for isdigit(c) {
-				if c != '0' {
-					allzeros = false
-				}
-				if c > '7' {
-					octal = false
+			if isdigit(c) || c == '_' {
+				if c == '_' {
+					sc.readRune()
 				}
-				sc.readRune()
-				c = sc.peekRune()
+				c = sc.scanDigits(isdigit, false, "int")
 			}
+			// An obsolete octal literal such as 0755 is still
+			// accepted, and converted as octal below, until the
+			// Java implementation supports the 0o755 form.
+			// TODO(adonovan): then reject it, suggesting 0o755.
 			if c == '.' {
 				fraction = true
 			} else if c == 'e' || c == 'E' {
 				exponent = true
-			} else if octal && !allzeros {
-				// We must support old octal until the Java
-				// implementation groks the new one.
-				// TODO(adonovan): reenable the check.
-				if false {
-					sc.endToken(val)
-					sc.errorf(sc.pos, "obsolete form of octal literal; use 0o%s", val.raw[1:])
-				}
 			}
 		}
 	} else {
 		// decimal
-		for isdigit(c) {
-			sc.readRune()
-			c = sc.peekRune()
-		}
+		c = sc.scanDigits(isdigit, false, "int")
 
 		if c == '.' {
 			fraction = true
@@ -805,12 +976,13 @@ func (sc *scanner) scanNumber(val *tokenValue, c rune) Token {
 	}
 
 	if fraction {
-		sc.readRune() // consume '.'
-		c = sc.peekRune()
-		for isdigit(c) {
+		if c == '.' { // (already consumed if leading)
 			sc.readRune()
 			c = sc.peekRune()
 		}
+		if isdigit(c) {
+			c = sc.scanDigits(isdigit, false, "float")
+		}
 
 		if c == 'e' || c == 'E' {
 			exponent = true
@@ -823,29 +995,31 @@ func (sc *scanner) scanNumber(val *tokenValue, c rune) Token {
 		if c == '+' || c == '-' {
 			sc.readRune()
 			c = sc.peekRune()
-			if !isdigit(c) {
-				sc.error(sc.pos, "invalid float literal")
-			}
 		}
-		for isdigit(c) {
-			sc.readRune()
-			c = sc.peekRune()
+		if !isdigit(c) {
+			sc.error(sc.pos, "invalid float literal")
 		}
+		sc.scanDigits(isdigit, false, "float")
 	}
 
 	sc.endToken(val)
+	s := val.raw
+	if strings.IndexByte(s, '_') >= 0 {
+		s = strings.Replace(s, "_", "", -1)
+	}
 	if fraction || exponent {
 		var err error
-		val.float, err = strconv.ParseFloat(val.raw, 64)
+		val.float, err = strconv.ParseFloat(s, 64)
 		if err != nil {
 			sc.error(sc.pos, "invalid float literal")
 		}
 		return FLOAT
 	} else {
 		var err error
-		s := val.raw
 		if len(s) > 2 && s[0] == '0' && (s[1] == 'o' || s[1] == 'O') {
 			val.int, err = strconv.ParseInt(s[2:], 8, 64)
+		} else if len(s) > 2 && s[0] == '0' && (s[1] == 'b' || s[1] == 'B') {
+			val.int, err = strconv.ParseInt(s[2:], 2, 64)
 		} else {
 			val.int, err = strconv.ParseInt(s, 0, 64)
 		}
@@ -856,6 +1030,36 @@ func (sc *scanner) scanNumber(val *tokenValue, c rune) Token {
 	}
 }
 
+// scanDigits consumes a non-empty sequence of digits, as defined by
+// isdigit, in which single underscores may separate digits.
+// If leading, an underscore may also precede the first digit.
+// It returns the next rune, and reports an invalid literal of the
+// specified kind if the sequence is empty or an underscore is not
+// followed by a digit.
+func (sc *scanner) scanDigits(isdigit func(rune) bool, leading bool, kind string) rune {
+	c := sc.peekRune()
+	if leading && c == '_' {
+		sc.readRune()
+		c = sc.peekRune()
+	}
+	if !isdigit(c) {
+		sc.errorf(sc.pos, "invalid %s literal", kind)
+	}
+	for {
+		if c == '_' {
+			sc.readRune()
+			c = sc.peekRune()
+			if !isdigit(c) {
+				sc.errorf(sc.pos, "invalid %s literal", kind)
+			}
+		} else if !isdigit(c) {
+			return c
+		}
+		sc.readRune()
+		c = sc.peekRune()
+	}
+}
+
 // isIdent reports whether c is an identifier rune.
 func isIdent(c rune) bool {
 	return isdigit(c) || isIdentStart(c)
@@ -870,6 +1074,7 @@ func isIdentStart(c rune) bool {
 
 func isdigit(c rune) bool  { return '0' <= c && c <= '9' }
 func isodigit(c rune) bool { return '0' <= c && c <= '7' }
+func isbdigit(c rune) bool { return c == '0' || c == '1' }
 func isxdigit(c rune) bool { return isdigit(c) || 'A' <= c && c <= 'F' || 'a' <= c && c <= 'f' }
 
 // keywordToken records the special tokens for
@@ -879,6 +1084,7 @@ var keywordToken = map[string]Token{
 	"break":    BREAK,
 	"continue": CONTINUE,
 	"def":      DEF,
+	"del":      DEL,
 	"elif":     ELIF,
 	"else":     ELSE,
 	"for":      FOR,
@@ -894,7 +1100,6 @@ var keywordToken = map[string]Token{
 	"as": ILLEGAL,
 	// "assert":   ILLEGAL, // heavily used by our tests
 	"class":    ILLEGAL,
-	"del":      ILLEGAL,
 	"except":   ILLEGAL,
 	"finally":  ILLEGAL,
 	"from":     ILLEGAL,
@@ -9,7 +9,9 @@ import (
 	"fmt"
 	"go/build"
 	"io/ioutil"
+	"math/rand"
 	"path/filepath"
+	"strings"
 	"testing"
 )
 
@@ -62,6 +64,9 @@ func TestScanner(t *testing.T) {
 		{`print(x)`, "print ( x ) EOF"},
 		{`print(x); print(y)`, "print ( x ) ; print ( y ) EOF"},
 		{`/ // /= //= ///=`, "/ // /= //= // /= EOF"},
+		{`~x ~~1`, "~ x ~ ~ 1 EOF"},
+		{`a|b^c&d`, "a | b ^ c & d EOF"},
+		{`< << <= <<= <<< > >> >= >>= >>>`, "< << <= << = << < > >> >= >> = >> > EOF"},
 		{`# hello
 print(x)`, "print ( x ) EOF"},
 		{`# hello
@@ -125,6 +130,9 @@ pass`, "pass newline pass EOF"}, // consecutive newlines are consolidated
 		{"x = '''a\rb'''", `x = "a\nb" EOF`},
 		{"x = '''a\r\nb'''", `x = "a\nb" EOF`},
 		{"x = '''a\n\rb'''", `x = "a\n\nb" EOF`},
+		{`x = """a "b" 'c'"""`, `x = "a \"b\" 'c'" EOF`},
+		{`x = """a"""""`, `x = "a" "" EOF`},
+		{"x = r\"\"\"a\\n\"b\"\nc\"\"\"", `x = "a\\n\"b\"\nc" EOF`},
 		{"x = r'a\\\nb'", `x = "a\\\nb" EOF`},
 		{"x = r'a\\\rb'", `x = "a\\\nb" EOF`},
 		{"x = r'a\\\r\nb'", `x = "a\\\nb" EOF`},
@@ -188,6 +196,42 @@ pass`, "pass newline pass EOF"}, // consecutive newlines are consolidated
 		{"012934e1", `1.293400e+05 EOF`},
 		{"0123.", `1.230000e+02 EOF`},
 		{"0123.1", `1.231000e+02 EOF`},
+		// binary
+		{"0b1010", `10 EOF`},
+		{"0B11", `3 EOF`},
+		{"0b", `invalid binary literal`},
+		{"0b2", `invalid binary literal`},
+		{"0b102", `2 2 EOF`},
+		// underscores
+		{"1_000_000", `1000000 EOF`},
+		{"0x_ff_ff", `65535 EOF`},
+		{"0o_7_7", `63 EOF`},
+		{"0b_1_0", `2 EOF`},
+		{"0_0", `0 EOF`},
+		{"1_0.2_5e1_0", `1.025000e+11 EOF`},
+		{".5_5", `5.500000e-01 EOF`},
+		{"1__0", `invalid int literal`},
+		{"1_", `invalid int literal`},
+		{"1_.5", `invalid int literal`},
+		{"1.5_", `invalid float literal`},
+		{"1e1_", `invalid float literal`},
+		{"1e", `invalid float literal`},
+		{"0x", `invalid hex literal`},
+		{"0x_", `invalid hex literal`},
+		{"0x__1", `invalid hex literal`},
+		{"0o_", `invalid octal literal`},
+		{"_1", `_1 EOF`}, // an identifier
+		// f-strings
+		{`f"{x}"`, `f-strings are not supported in Skylark; use .format()`},
+		{`elf"x"`, `elf "x" EOF`},
+		// NUL bytes and invalid UTF-8
+		{"\x00", `illegal NUL byte in input`},
+		{"x\x00y", `illegal NUL byte in input`},
+		{"'a\x00b'", `illegal NUL byte in input`},
+		{"x = \xff", `invalid UTF-8 encoding`},
+		{"'\xe4\xb8'", `invalid UTF-8 encoding`},
+		{"# \xff\n", `invalid UTF-8 encoding`},
+		{`'\x00\xff'`, `"\x00\xff" EOF`}, // escapes are fine
 	} {
 		got, err := scan(test.input)
 		if err != nil {
@@ -199,6 +243,94 @@ pass`, "pass newline pass EOF"}, // consecutive newlines are consolidated
 	}
 }
 
+// TestParseGarbage checks that Parse reports a syntax error, and does
+// not panic, for arbitrary inputs, including invalid UTF-8.
+func TestParseGarbage(t *testing.T) {
+	alphabet := []byte("xy01.eb_'\"\\#:=+-*(){}[], \t\r\n\x00\x80\xff\xc3\xa9")
+	words := []string{"def", "if", "else", "for", "in", "lambda", "load", "return", "0x", `'''`}
+	rand := rand.New(rand.NewSource(0))
+	for i := 0; i < 100000; i++ {
+		var src []byte
+		for n := rand.Intn(30); n > 0; n-- {
+			if rand.Intn(8) == 0 {
+				src = append(src, words[rand.Intn(len(words))]...)
+			} else {
+				src = append(src, alphabet[rand.Intn(len(alphabet))])
+			}
+		}
+		_, err := Parse("garbage.sky", src)
+		if err == nil {
+			continue
+		}
+		if _, ok := err.(Error); !ok {
+			t.Errorf("Parse(%q) returned %T, want syntax.Error", src, err)
+		} else if strings.Contains(err.Error(), "internal error") {
+			t.Errorf("Parse(%q) failed: %v", src, err)
+		}
+	}
+}
+
+func TestPublicScanner(t *testing.T) {
+	src := `# greeting
+def f(x):  # f
+    return "hi" + x
+`
+	sc, err := NewScanner("foo.sky", src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	for {
+		tok, val, pos := sc.Scan()
+		fmt.Fprintf(&buf, "%d:%d %s %q\n", pos.Line, pos.Col, tok, val.Raw)
+		if tok == EOF || tok == ILLEGAL {
+			break
+		}
+	}
+	if err := sc.Err(); err != nil {
+		t.Fatal(err)
+	}
+	want := `1:1 comment "# greeting"
+2:1 def "def"
+2:5 identifier "f"
+2:6 ( "("
+2:7 identifier "x"
+2:8 ) ")"
+2:9 : ":"
+2:12 comment "# f"
+2:15 newline "\n"
+3:5 indent ""
+3:5 return "return"
+3:12 string literal "\"hi\""
+3:17 + "+"
+3:19 identifier "x"
+3:20 newline "\n"
+4:1 outdent ""
+4:1 end of file ""
+`
+	if got := buf.String(); got != want {
+		t.Errorf("got tokens:\n%s\nwant:\n%s", got, want)
+	}
+
+	// Errors are returned, not panicked.
+	sc, err = NewScanner("foo.sky", "x = 'unterminated\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for {
+		tok, _, _ := sc.Scan()
+		if tok == ILLEGAL {
+			break
+		}
+		if tok == EOF {
+			t.Fatal("no error for unterminated string")
+		}
+	}
+	if err, want := sc.Err(), "foo.sky:1:5: unexpected newline in string"; err == nil || err.Error() != want {
+		t.Errorf("got error %v, want %s", err, want)
+	}
+}
+
 // dataFile is the same as skylarktest.DataFile.
 // We make a copy to avoid a dependency cycle.
 var dataFile = func(pkgdir, filename string) string {
@@ -224,3 +356,74 @@ func BenchmarkScan(b *testing.B) {
 		}
 	}
 }
+
+// TestTripleQuotedString checks the value of a multi-line docstring
+// and the positions of the tokens that follow it.
+func TestTripleQuotedString(t *testing.T) {
+	src := "def f():\n" +
+		`    """Returns "x".` + "\n" +
+		"\n" +
+		`    It's a 'test'.` + "\n" +
+		`    """` + "\n" +
+		`    return r'''a\n` + "\n" +
+		`b''' + "c"` + "\n"
+	sc, err := NewScanner("foo.sky", src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var strs, toks []string
+	for {
+		tok, val, pos := sc.Scan()
+		if tok == EOF || tok == ILLEGAL {
+			break
+		}
+		if tok == STRING {
+			strs = append(strs, val.String)
+		}
+		toks = append(toks, fmt.Sprintf("%d:%d %s", pos.Line, pos.Col, tok))
+	}
+	if err := sc.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := fmt.Sprintf("%q", strs), `["Returns \"x\".\n\n    It's a 'test'.\n    " "a\\n\nb" "c"]`; got != want {
+		t.Errorf("got strings %s, want %s", got, want)
+	}
+	got := strings.Join(toks, ", ")
+	want := "2:5 string literal, 5:8 newline, 6:5 return, 6:12 string literal, 7:6 +, 7:8 string literal, 7:11 newline"
+	if !strings.Contains(got, want) {
+		t.Errorf("got tokens %s, want %s", got, want)
+	}
+}
+
+func TestCaretString(t *testing.T) {
+	for _, test := range []struct {
+		src, want string
+	}{
+		{"x = 1\ny = (x +\n", `caret.sky:3:1: got end of file, want primary expression
+` + `
+^`},
+		{"x = 1\ny = 'abc\n", `caret.sky:2:5: unexpected newline in string
+y = 'abc
+    ^`},
+		{"# naïve\ns = 'café' $\n", `caret.sky:2:12: unexpected input character '$'
+s = 'café' $
+           ^`},
+		{"if x:\n\ty = 1 $\r\n", "caret.sky:2:8: unexpected input character '$'\n\ty = 1 $\n\t      ^"},
+	} {
+		_, err := Parse("caret.sky", test.src)
+		e, ok := err.(Error)
+		if !ok {
+			t.Errorf("Parse(%q) returned %v, want syntax.Error", test.src, err)
+			continue
+		}
+		if got := e.CaretString([]byte(test.src)); got != test.want {
+			t.Errorf("CaretString for %q: got\n%s\nwant\n%s", test.src, got, test.want)
+		}
+	}
+
+	// If the source does not contain the line, only the message is shown.
+	e := Error{Position{Line: 5, Col: 1}, "oops"}
+	if got, want := e.CaretString([]byte("x = 1\n")), "<unknown>:5:1: oops"; got != want {
+		t.Errorf("CaretString with short source: got %q, want %q", got, want)
+	}
+}
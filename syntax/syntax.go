@@ -50,6 +50,7 @@ type Stmt interface {
 func (*AssignStmt) stmt() {}
 func (*BranchStmt) stmt() {}
 func (*DefStmt) stmt()    {}
+func (*DelStmt) stmt()    {}
 func (*ExprStmt) stmt()   {}
 func (*ForStmt) stmt()    {}
 func (*IfStmt) stmt()     {}
@@ -161,6 +162,18 @@ func (x *BranchStmt) Span() (start, end Position) {
 	return x.TokenPos, x.TokenPos.add(x.Token.String())
 }
 
+// A DelStmt removes an element from a dict or list: del x[k].
+// It is permitted only if ParseOptions.AllowDel is set.
+type DelStmt struct {
+	Del    Position
+	Target *IndexExpr
+}
+
+func (x *DelStmt) Span() (start, end Position) {
+	_, end = x.Target.Span()
+	return x.Del, end
+}
+
 // A ReturnStmt returns from a function.
 type ReturnStmt struct {
 	Return Position
@@ -181,21 +194,23 @@ type Expr interface {
 	expr()
 }
 
-func (*BinaryExpr) expr()    {}
-func (*CallExpr) expr()      {}
-func (*Comprehension) expr() {}
-func (*CondExpr) expr()      {}
-func (*DictEntry) expr()     {}
-func (*DictExpr) expr()      {}
-func (*DotExpr) expr()       {}
-func (*Ident) expr()         {}
-func (*IndexExpr) expr()     {}
-func (*LambdaExpr) expr()    {}
-func (*ListExpr) expr()      {}
-func (*Literal) expr()       {}
-func (*SliceExpr) expr()     {}
-func (*TupleExpr) expr()     {}
-func (*UnaryExpr) expr()     {}
+func (*BinaryExpr) expr()      {}
+func (*CallExpr) expr()        {}
+func (*ComparisonChain) expr() {}
+func (*Comprehension) expr()   {}
+func (*CondExpr) expr()        {}
+func (*DictEntry) expr()       {}
+func (*DictExpr) expr()        {}
+func (*DotExpr) expr()         {}
+func (*OptDotExpr) expr()      {}
+func (*Ident) expr()           {}
+func (*IndexExpr) expr()       {}
+func (*LambdaExpr) expr()      {}
+func (*ListExpr) expr()        {}
+func (*Literal) expr()         {}
+func (*SliceExpr) expr()       {}
+func (*TupleExpr) expr()       {}
+func (*UnaryExpr) expr()       {}
 
 // An Ident represents an identifier.
 type Ident struct {
@@ -204,8 +219,8 @@ type Ident struct {
 
 	// set by resolver:
 
-	Scope uint8 // one of resolve.{Undefined,Local,Free,Global,Builtin}
-	Index int   // index into enclosing {DefStmt,File}.Locals (if scope==Local) or DefStmt.FreeVars (if scope==Free)
+	Scope uint8 // one of resolve.{Undefined,Local,Cell,Free,Global,Builtin}
+	Index int   // index into enclosing {DefStmt,File}.Locals (if scope==Local or Cell) or DefStmt.FreeVars (if scope==Free)
 }
 
 func (x *Ident) Span() (start, end Position) {
@@ -251,6 +266,20 @@ func (x *DotExpr) Span() (start, end Position) {
 	return
 }
 
+// An OptDotExpr represents an optional field or method selector: X?.Name.
+// It yields None if X is None or has no such field or method.
+type OptDotExpr struct {
+	X        Expr
+	Question Position // position of "?."
+	Name     *Ident
+}
+
+func (x *OptDotExpr) Span() (start, end Position) {
+	start, _ = x.X.Span()
+	_, end = x.Name.Span()
+	return
+}
+
 // A Comprehension represents a list or dict comprehension:
 // [Body for ... if ...] or {Body for ... if ...}
 type Comprehension struct {
@@ -409,6 +438,22 @@ func (x *BinaryExpr) Span() (start, end Position) {
 	return start, end
 }
 
+// A ComparisonChain represents a chain of two or more comparisons,
+// such as a < b <= c, which the parser produces only when
+// ParseOptions.AllowChainedComparisons is set.
+// It means a < b and b <= c, except that b is evaluated only once.
+type ComparisonChain struct {
+	Operands []Expr     // len(Operands) == len(Ops)+1
+	OpPos    []Position // position of each operator
+	Ops      []Token    // EQL, NEQ, LT, GT, LE, GE, IN, or NOT_IN
+}
+
+func (x *ComparisonChain) Span() (start, end Position) {
+	start, _ = x.Operands[0].Span()
+	_, end = x.Operands[len(x.Operands)-1].Span()
+	return start, end
+}
+
 // A SliceExpr represents a slice or substring expression: X[Lo:Hi:Step].
 type SliceExpr struct {
 	X            Expr
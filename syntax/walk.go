@@ -46,6 +46,9 @@ func Walk(n Node, f func(Node) bool) {
 		Walk(n.X, f)
 		walkStmts(n.Body, f)
 
+	case *DelStmt:
+		Walk(n.Target, f)
+
 	case *ReturnStmt:
 		if n.Result != nil {
 			Walk(n.Result, f)
@@ -125,10 +128,19 @@ func Walk(n Node, f func(Node) bool) {
 		Walk(n.X, f)
 		Walk(n.Y, f)
 
+	case *ComparisonChain:
+		for _, x := range n.Operands {
+			Walk(x, f)
+		}
+
 	case *DotExpr:
 		Walk(n.X, f)
 		Walk(n.Name, f)
 
+	case *OptDotExpr:
+		Walk(n.X, f)
+		Walk(n.Name, f)
+
 	case *CallExpr:
 		Walk(n.Fn, f)
 		for _, arg := range n.Args {
@@ -70,6 +70,7 @@ import (
 	"math/big"
 	"reflect"
 	"strconv"
+	"sort"
 	"strings"
 	"unicode/utf8"
 
@@ -201,7 +202,7 @@ var (
 //
 // Example usage:
 //
-// 	iter := iterable.Iterator()
+// 	iter := iterable.Iterate()
 //	defer iter.Done()
 //	var x Value
 //	for iter.Next(&x) {
@@ -224,7 +225,21 @@ type Mapping interface {
 	Get(Value) (v Value, found bool, err error)
 }
 
-var _ Mapping = (*Dict)(nil)
+// An IterableMapping is a mapping that supports key enumeration.
+// An application may implement it to provide a dictionary-like value,
+// for example one whose entries are computed on demand.
+//
+// Such a value may be indexed (m[k]), tested for membership (k in m),
+// iterated over (for k in m), used as the operand of a %-format
+// operation with named keys, passed as **kwargs to a function,
+// and used to construct or update a dict (dict(m), d.update(m)).
+type IterableMapping interface {
+	Mapping
+	Iterate() Iterator // see Iterable interface
+	Items() []Tuple    // a new slice containing all key/value pairs
+}
+
+var _ IterableMapping = (*Dict)(nil)
 
 // A HasBinary value may be used as either operand of these binary operators:
 //     +   -   *   /   %   in   not in   |   &
@@ -312,7 +327,20 @@ func (x Bool) CompareSameType(op syntax.Token, y_ Value, depth int) (bool, error
 // Float is the type of a Skylark float.
 type Float float64
 
-func (f Float) String() string { return strconv.FormatFloat(float64(f), 'g', 6, 64) }
+// String returns the shortest decimal representation of f that,
+// when parsed, yields f again, or one of +inf, -inf, or nan.
+func (f Float) String() string {
+	switch {
+	case math.IsInf(float64(f), +1):
+		return "+inf"
+	case math.IsInf(float64(f), -1):
+		return "-inf"
+	case math.IsNaN(float64(f)):
+		return "nan"
+	}
+	return strconv.FormatFloat(float64(f), 'g', -1, 64)
+}
+
 func (f Float) Type() string   { return "float" }
 func (f Float) Freeze()        {} // immutable
 func (f Float) Truth() Bool    { return f != 0.0 }
@@ -326,7 +354,25 @@ func (f Float) Hash() (uint32, error) {
 	return 1618033, nil // NaN, +/-Inf
 }
 
-func floor(f Float) Float { return Float(math.Floor(float64(f))) }
+// floordiv returns x // y, the floor of x / y, for y != 0.
+// Following Python, it is computed from the remainder so that
+// x == (x // y) * y + x % y as nearly as possible,
+// even when x / y is rounded or y is infinite.
+func floordiv(x, y Float) Float {
+	mod := math.Mod(float64(x), float64(y))
+	div := (float64(x) - mod) / float64(y)
+	if mod != 0 && (y < 0) != (mod < 0) {
+		div -= 1.0
+	}
+	if div == 0 {
+		return Float(math.Copysign(0, float64(x/y)))
+	}
+	floordiv := math.Floor(div)
+	if div-floordiv > 0.5 {
+		floordiv += 1.0
+	}
+	return Float(floordiv)
+}
 
 // isFinite reports whether f represents a finite rational value.
 // It is equivalent to !math.IsNan(f) && !math.IsInf(f, 0).
@@ -355,6 +401,21 @@ func (x Float) CompareSameType(op syntax.Token, y_ Value, depth int) (bool, erro
 
 func (f Float) rational() *big.Rat { return new(big.Rat).SetFloat64(float64(f)) }
 
+// cmpInt compares f with i exactly, without converting i to a float,
+// so that large integers are not rounded.
+// It returns false if f is NaN.
+func (f Float) cmpInt(i Int) (int, bool) {
+	switch {
+	case f != f:
+		return 0, false // NaN
+	case math.IsInf(float64(f), +1):
+		return +1, true
+	case math.IsInf(float64(f), -1):
+		return -1, true
+	}
+	return f.rational().Cmp(i.rational()), true
+}
+
 // AsFloat returns the float64 value closest to x.
 // The f result is undefined if x is not a float or int.
 func AsFloat(x Value) (f float64, ok bool) {
@@ -367,7 +428,18 @@ func AsFloat(x Value) (f float64, ok bool) {
 	return 0, false
 }
 
-func (x Float) Mod(y Float) Float { return Float(math.Mod(float64(x), float64(y))) }
+// Mod returns the remainder of floored division of x by y,
+// which has the sign of y, as in Python.
+func (x Float) Mod(y Float) Float {
+	z := math.Mod(float64(x), float64(y))
+	if z == 0 {
+		return Float(math.Copysign(0, float64(y)))
+	}
+	if (z < 0) != (y < 0) {
+		z += float64(y)
+	}
+	return Float(z)
+}
 
 // String is the type of a Skylark string.
 //
@@ -398,6 +470,7 @@ func AsString(x Value) (string, bool) { v, ok := x.(String); return string(v), o
 // either numerically or as successive substrings.
 type stringIterable struct {
 	s          String
+	method     string // name of the string method that created it
 	split      bool
 	codepoints bool
 }
@@ -405,11 +478,7 @@ type stringIterable struct {
 var _ Iterable = (*stringIterable)(nil)
 
 func (si stringIterable) String() string {
-	if si.split {
-		return si.s.String() + ".split_" + si.Type() + "()"
-	} else {
-		return si.s.String() + "." + si.Type() + "()"
-	}
+	return si.s.String() + "." + si.method + "()"
 }
 func (si stringIterable) Type() string {
 	if si.codepoints {
@@ -474,14 +543,38 @@ func (fn *Function) Truth() Bool           { return true }
 
 func (fn *Function) Syntax() *syntax.Function { return fn.syntax }
 
+// Doc returns the documentation string of the function, that is, the
+// string literal that is the first statement of its body, if any.
+func (fn *Function) Doc() string {
+	if len(fn.syntax.Body) > 0 {
+		if stmt, ok := fn.syntax.Body[0].(*syntax.ExprStmt); ok {
+			if lit, ok := stmt.X.(*syntax.Literal); ok && lit.Token == syntax.STRING {
+				return lit.Value.(string)
+			}
+		}
+	}
+	return ""
+}
+
 // A Builtin is a function implemented in Go.
 type Builtin struct {
 	name string
+	doc  string
 	fn   func(thread *Thread, fn *Builtin, args Tuple, kwargs []Tuple) (Value, error)
 	recv Value // for bound methods (e.g. "".startswith)
 }
 
 func (b *Builtin) Name() string { return b.name }
+
+// Doc returns the documentation of the built-in, or "" if it has none.
+func (b *Builtin) Doc() string { return b.doc }
+
+// WithDoc returns a copy of the built-in with the specified documentation.
+func (b *Builtin) WithDoc(doc string) *Builtin {
+	b2 := *b
+	b2.doc = doc
+	return &b2
+}
 func (b *Builtin) Freeze() {
 	if b.recv != nil {
 		b.recv.Freeze()
@@ -498,7 +591,10 @@ func (b *Builtin) Receiver() Value { return b.recv }
 func (b *Builtin) String() string  { return toString(b) }
 func (b *Builtin) Type() string    { return "builtin" }
 func (b *Builtin) Call(thread *Thread, args Tuple, kwargs []Tuple) (Value, error) {
-	return b.fn(thread, b, args, kwargs)
+	if thread == nil {
+		return b.fn(thread, b, args, kwargs)
+	}
+	return thread.callBuiltin(b, args, kwargs)
 }
 func (b *Builtin) Truth() Bool { return true }
 
@@ -522,12 +618,24 @@ func NewBuiltin(name string, fn func(thread *Thread, fn *Builtin, args Tuple, kw
 //     "abc".index("a")
 //
 func (b *Builtin) BindReceiver(recv Value) *Builtin {
-	return &Builtin{name: b.name, fn: b.fn, recv: recv}
+	return &Builtin{name: b.name, doc: b.doc, fn: b.fn, recv: recv}
 }
 
 // A *Dict represents a Skylark dictionary.
+// Its Keys, Items, and Iterate methods visit entries in insertion order;
+// a deleted key that is inserted again goes to the end.
 type Dict struct {
-	ht hashtable
+	ht         hashtable
+	sortedRepr bool // entries are printed in key order; see Thread.SortedDictRepr
+}
+
+// NewDict returns a new empty dictionary with space for at least
+// size entries, so that it need not grow as they are inserted.
+// The zero value of Dict, new(Dict), is also a valid empty dictionary.
+func NewDict(size int) *Dict {
+	dict := new(Dict)
+	dict.ht.init(size)
+	return dict
 }
 
 func (d *Dict) Clear() error                                    { return d.ht.clear() }
@@ -588,6 +696,8 @@ type List struct {
 
 // NewList returns a list containing the specified elements.
 // Callers should not subsequently modify elems.
+// To build a list of known length n without reallocation, call
+// NewList(make([]Value, 0, n)) and then Append each element.
 func NewList(elems []Value) *List { return &List{elems: elems} }
 
 func (l *List) Freeze() {
@@ -757,7 +867,8 @@ func (it *tupleIterator) Done() {}
 
 // A Set represents a Skylark set value.
 type Set struct {
-	ht hashtable // values are all None
+	ht     hashtable // values are all None
+	sorted bool      // elements are iterated in sorted order; see Thread.SortedSets
 }
 
 func (s *Set) Delete(k Value) (found bool, err error) { _, found, err = s.ht.delete(k); return }
@@ -765,10 +876,21 @@ func (s *Set) Clear() error                           { return s.ht.clear() }
 func (s *Set) Has(k Value) (found bool, err error)    { _, found, err = s.ht.lookup(k); return }
 func (s *Set) Insert(k Value) error                   { return s.ht.insert(k, None) }
 func (s *Set) Len() int                               { return int(s.ht.len) }
-func (s *Set) Iterate() Iterator                      { return s.ht.iterate() }
+func (s *Set) Iterate() Iterator {
+	if s.sorted {
+		return &sortedSetIterator{keys: s.ht.iterate(), elems: s.elems()}
+	}
+	return s.ht.iterate()
+}
 func (s *Set) String() string                         { return toString(s) }
 func (s *Set) Type() string                           { return "set" }
-func (s *Set) elems() []Value                         { return s.ht.keys() }
+func (s *Set) elems() []Value {
+	elems := s.ht.keys()
+	if s.sorted {
+		sort.Stable(valueSlice(elems))
+	}
+	return elems
+}
 func (s *Set) Freeze()                                { s.ht.freeze() }
 func (s *Set) Hash() (uint32, error)                  { return 0, fmt.Errorf("unhashable type: set") }
 func (s *Set) Truth() Bool                            { return s.Len() > 0 }
@@ -803,10 +925,134 @@ func setsEqual(x, y *Set, depth int) (bool, error) {
 }
 
 func (s *Set) Union(iter Iterator) (Value, error) {
-	set := new(Set)
+	set := s.copy()
+	var x Value
+	for iter.Next(&x) {
+		if err := set.Insert(x); err != nil {
+			return nil, err
+		}
+	}
+	return set, nil
+}
+
+func (s *Set) Difference(iter Iterator) (Value, error) {
+	set := s.copy()
+	var x Value
+	for iter.Next(&x) {
+		if _, err := set.Delete(x); err != nil {
+			return nil, err
+		}
+	}
+	return set, nil
+}
+
+func (s *Set) Intersection(iter Iterator) (Value, error) {
+	other, err := setOf(iter)
+	if err != nil {
+		return nil, err
+	}
+	set := &Set{sorted: s.sorted}
+	for _, elem := range s.elems() {
+		// Has, Insert cannot fail here.
+		if found, _ := other.Has(elem); found {
+			set.Insert(elem)
+		}
+	}
+	return set, nil
+}
+
+func (s *Set) SymmetricDifference(iter Iterator) (Value, error) {
+	other, err := setOf(iter)
+	if err != nil {
+		return nil, err
+	}
+	set := &Set{sorted: s.sorted}
+	// Has, Insert cannot fail here.
+	for _, elem := range s.elems() {
+		if found, _ := other.Has(elem); !found {
+			set.Insert(elem)
+		}
+	}
+	for _, elem := range other.elems() {
+		if found, _ := s.Has(elem); !found {
+			set.Insert(elem)
+		}
+	}
+	return set, nil
+}
+
+// copy returns a new, mutable set with the same elements as s.
+func (s *Set) copy() *Set {
+	set := &Set{sorted: s.sorted}
 	for _, elem := range s.elems() {
 		set.Insert(elem) // can't fail
 	}
+	return set
+}
+
+// A sortedSetIterator iterates over a snapshot of the elements of a
+// sorted set.  It holds an iterator over the set's hash table so
+// that the set cannot be mutated during iteration.
+type sortedSetIterator struct {
+	keys  *keyIterator
+	elems []Value
+}
+
+func (it *sortedSetIterator) Next(p *Value) bool {
+	if len(it.elems) > 0 {
+		*p = it.elems[0]
+		it.elems = it.elems[1:]
+		return true
+	}
+	return false
+}
+
+func (it *sortedSetIterator) Done() { it.keys.Done() }
+
+// valueSlice orders values for a sorted set.
+type valueSlice []Value
+
+func (s valueSlice) Len() int           { return len(s) }
+func (s valueSlice) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s valueSlice) Less(i, j int) bool { return valueLess(s[i], s[j]) }
+
+// itemsByKey orders dict items by key for Thread.SortedDictRepr.
+type itemsByKey []Tuple
+
+func (s itemsByKey) Len() int           { return len(s) }
+func (s itemsByKey) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s itemsByKey) Less(i, j int) bool { return valueLess(s[i][0], s[j][0]) }
+
+// valueLess orders values for deterministic output.
+// Values are grouped by the names of their types, except that ints
+// and floats form a single group; within a group, they are ordered by
+// Compare where possible, otherwise by their string representations.
+// This is a total order over values of types such as int, float,
+// string, and bool, whose comparisons never fail, but not necessarily
+// over values such as lists of mixed element types, for which some
+// comparisons fail and others do not.
+func valueLess(x, y Value) bool {
+	if xt, yt := orderGroup(x), orderGroup(y); xt != yt {
+		return xt < yt
+	}
+	if lt, err := Compare(syntax.LT, x, y); err == nil {
+		return lt
+	}
+	return x.String() < y.String()
+}
+
+// orderGroup returns the name of the group of values in which
+// valueLess orders x by comparison.
+func orderGroup(x Value) string {
+	if _, ok := x.(Int); ok {
+		return "float" // ints and floats are compared numerically
+	}
+	return x.Type()
+}
+
+// setOf returns a new set containing the elements of iter.
+func setOf(iter Iterator) (*Set, error) {
+	set := new(Set)
 	var x Value
 	for iter.Next(&x) {
 		if err := set.Insert(x); err != nil {
@@ -887,8 +1133,12 @@ func writeValue(out *bytes.Buffer, x Value, path []Value) {
 		if pathContains(path, x) {
 			out.WriteString("...") // dict contains itself
 		} else {
+			items := x.Items()
+			if x.sortedRepr {
+				sort.Stable(itemsByKey(items))
+			}
 			sep := ""
-			for _, item := range x.Items() {
+			for _, item := range items {
 				k, v := item[0], item[1]
 				out.WriteString(sep)
 				writeValue(out, k, path)
@@ -981,31 +1231,17 @@ func CompareDepth(op syntax.Token, x, y Value, depth int) (bool, error) {
 	switch x := x.(type) {
 	case Int:
 		if y, ok := y.(Float); ok {
-			if y != y {
-				return false, nil // y is NaN
-			}
-			var cmp int
-			if !math.IsInf(float64(y), 0) {
-				cmp = x.rational().Cmp(y.rational()) // y is finite
-			} else if y > 0 {
-				cmp = -1 // y is +Inf
-			} else {
-				cmp = +1 // y is -Inf
+			cmp, ok := y.cmpInt(x)
+			if !ok {
+				return op == syntax.NEQ, nil // y is NaN
 			}
-			return threeway(op, cmp), nil
+			return threeway(op, -cmp), nil
 		}
 	case Float:
 		if y, ok := y.(Int); ok {
-			if x != x {
-				return false, nil // x is NaN
-			}
-			var cmp int
-			if !math.IsInf(float64(x), 0) {
-				cmp = x.rational().Cmp(y.rational()) // x is finite
-			} else if x > 0 {
-				cmp = -1 // x is +Inf
-			} else {
-				cmp = +1 // x is -Inf
+			cmp, ok := x.cmpInt(y)
+			if !ok {
+				return op == syntax.NEQ, nil // x is NaN
 			}
 			return threeway(op, cmp), nil
 		}
@@ -1070,6 +1306,9 @@ func Len(x Value) int {
 
 // Iterate return a new iterator for the value if iterable, nil otherwise.
 // If the result is non-nil, the caller must call Done when finished with it.
+// Until then, operations that would modify the structure of x,
+// such as appending to a list, fail, just as they do within a
+// Skylark for loop over x.
 //
 // Warning: Iterate(x) != nil does not imply Len(x) >= 0.
 // Some iterables may have unknown length.
@@ -1079,3 +1318,95 @@ func Iterate(x Value) Iterator {
 	}
 	return nil
 }
+
+// Elements returns a new slice containing the elements of the iterable x,
+// in iteration order, or an error if x is not iterable.
+// While it runs, x has an active iterator, so x may not be modified
+// by another thread concurrently.
+func Elements(x Value) ([]Value, error) {
+	iter := Iterate(x)
+	if iter == nil {
+		return nil, fmt.Errorf("%s value is not iterable", x.Type())
+	}
+	defer iter.Done()
+	var elems []Value
+	if n := Len(x); n > 0 {
+		elems = make([]Value, 0, n)
+	}
+	var elem Value
+	for iter.Next(&elem) {
+		elems = append(elems, elem)
+	}
+	return elems, nil
+}
+
+// Copy returns a deep copy of x in which every list, dict, and set is
+// new and mutable, even if the corresponding part of x is frozen.
+// Tuples are copied too, as they may contain such containers.
+// Immutable values such as strings, numbers, and functions are shared.
+// Cycles in x, such as a list that contains itself, are reproduced
+// in the copy. Copy fails if x contains a value of an application-defined
+// type, whose mutability it cannot determine.
+func Copy(x Value) (Value, error) {
+	return copyValue(x, make(map[Value]Value))
+}
+
+// copyValue copies x. copies maps each list, dict, or set already
+// encountered to its copy.
+func copyValue(x Value, copies map[Value]Value) (Value, error) {
+	switch x := x.(type) {
+	case NoneType, Bool, Int, Float, String, stringIterable, *Function, *Builtin, rangeValue:
+		return x, nil
+
+	case Tuple:
+		tuple := make(Tuple, len(x))
+		for i, elem := range x {
+			y, err := copyValue(elem, copies)
+			if err != nil {
+				return nil, err
+			}
+			tuple[i] = y
+		}
+		return tuple, nil
+
+	case *List:
+		if y, ok := copies[x]; ok {
+			return y, nil
+		}
+		list := &List{elems: make([]Value, len(x.elems))}
+		copies[x] = list
+		for i, elem := range x.elems {
+			y, err := copyValue(elem, copies)
+			if err != nil {
+				return nil, err
+			}
+			list.elems[i] = y
+		}
+		return list, nil
+
+	case *Dict:
+		if y, ok := copies[x]; ok {
+			return y, nil
+		}
+		dict := &Dict{sortedRepr: x.sortedRepr}
+		copies[x] = dict
+		for _, item := range x.Items() {
+			// Keys are hashable, hence immutable.
+			v, err := copyValue(item[1], copies)
+			if err != nil {
+				return nil, err
+			}
+			dict.Set(item[0], v) // can't fail
+		}
+		return dict, nil
+
+	case *Set:
+		if y, ok := copies[x]; ok {
+			return y, nil
+		}
+		set := x.copy() // elements are hashable, hence immutable
+		copies[x] = set
+		return set, nil
+	}
+	return nil, fmt.Errorf("cannot copy value of type %s", x.Type())
+}
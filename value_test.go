@@ -20,3 +20,87 @@ func TestListAppend(t *testing.T) {
 		t.Errorf("failed list.Append() got: %+v, want: hello", res)
 	}
 }
+
+func TestBuiltinDoc(t *testing.T) {
+	if doc := Universe["len"].(*Builtin).Doc(); doc == "" {
+		t.Errorf("len has no documentation")
+	}
+	// Every built-in function in the Universe is documented.
+	for name, v := range Universe {
+		if b, ok := v.(*Builtin); ok && b.Doc() == "" {
+			t.Errorf("built-in %s has no documentation", name)
+		}
+	}
+
+	b := NewBuiltin("f", nil)
+	if doc := b.Doc(); doc != "" {
+		t.Errorf("NewBuiltin: Doc() = %q, want empty", doc)
+	}
+	b2 := b.WithDoc("f does nothing.")
+	if doc := b2.Doc(); doc != "f does nothing." {
+		t.Errorf("WithDoc: Doc() = %q, want %q", doc, "f does nothing.")
+	}
+	if doc := b.Doc(); doc != "" {
+		t.Errorf("WithDoc modified its receiver: Doc() = %q", doc)
+	}
+	if doc := b2.BindReceiver(None).Doc(); doc != "f does nothing." {
+		t.Errorf("BindReceiver: Doc() = %q, want %q", doc, "f does nothing.")
+	}
+}
+
+func TestCopy(t *testing.T) {
+	// A nested frozen dict becomes mutable.
+	inner := NewList([]Value{MakeInt(1)})
+	dict := new(Dict)
+	dict.Set(String("list"), inner)
+	dict.Set(String("tuple"), Tuple{inner, String("x")})
+	dict.Freeze()
+
+	v, err := Copy(dict)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dup := v.(*Dict)
+	if err := dup.Set(String("new"), None); err != nil {
+		t.Errorf("copy of dict is not mutable: %v", err)
+	}
+	list, _, _ := dup.Get(String("list"))
+	if err := list.(*List).Append(MakeInt(2)); err != nil {
+		t.Errorf("copy of nested list is not mutable: %v", err)
+	}
+	tuple, _, _ := dup.Get(String("tuple"))
+	if tuple.(Tuple)[0] != list {
+		t.Errorf("shared list was copied twice")
+	}
+	if got, want := dict.String(), `{"list": [1], "tuple": ([1], "x")}`; got != want {
+		t.Errorf("original changed: got %s, want %s", got, want)
+	}
+	if got, want := dup.String(), `{"list": [1, 2], "tuple": ([1, 2], "x"), "new": None}`; got != want {
+		t.Errorf("copy = %s, want %s", got, want)
+	}
+
+	// A self-referential list yields a self-referential copy.
+	self := NewList(nil)
+	self.Append(self)
+	v, err = Copy(self)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dup := v.(*List); dup == self || dup.Index(0) != dup {
+		t.Errorf("copy of self-referential list is not a new self-referential list")
+	}
+
+	// Values of unknown type cannot be copied.
+	if _, err := Copy(NewList([]Value{opaque{}})); err == nil || err.Error() != "cannot copy value of type opaque" {
+		t.Errorf("Copy(opaque) returned error %v", err)
+	}
+}
+
+// An opaque is a value of an application-defined type.
+type opaque struct{}
+
+func (opaque) String() string        { return "opaque" }
+func (opaque) Type() string          { return "opaque" }
+func (opaque) Freeze()               {}
+func (opaque) Truth() Bool           { return true }
+func (opaque) Hash() (uint32, error) { return 0, nil }